@@ -0,0 +1,243 @@
+package simpleflash
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxRequestSize is the default maximum size of a request body for the APIHandler, in bytes
+const DefaultMaxRequestSize = 32 << 20
+
+// APIHandler is an http.Handler that serves a simple JSON API for Generate and CountTextTokens:
+//
+//	POST /query          generate a response, from JSON or from a multipart form with attachments
+//	POST /count-tokens   count the tokens in a text
+//	GET  /healthz        check that the server is running
+//	GET  /stats          show the cache and cost counters
+type APIHandler struct {
+	MaxRequestSize int64 // the maximum size of a request body, in bytes
+	sf             *SimpleFlash
+	mux            *http.ServeMux
+}
+
+// QueryRequest is the body of a request to POST /query
+type QueryRequest struct {
+	Prompt          string       `json:"prompt"`
+	Model           string       `json:"model,omitempty"`
+	Temperature     *float64     `json:"temperature,omitempty"`
+	System          string       `json:"system,omitempty"`
+	Attachments     []Attachment `json:"attachments,omitempty"` // the data is base64 encoded in JSON
+	History         []Message    `json:"history,omitempty"`
+	MaxOutputTokens int          `json:"max_output_tokens,omitempty"`
+	StopSequences   []string     `json:"stop_sequences,omitempty"`
+	NoCache         bool         `json:"no_cache,omitempty"`
+}
+
+// Stats is the body of the response to GET /stats
+type Stats struct {
+	Cache  *CacheStats      `json:"cache,omitempty"` // nil if the cache is disabled, or can not report statistics
+	Cost   Usage            `json:"cost"`
+	Limit  float64          `json:"limit,omitempty"` // in USD, 0 means no limit
+	Models map[string]Usage `json:"models"`
+	Shared int              `json:"shared"` // requests that were served by an identical request that was in progress
+}
+
+// CacheStats is the cache part of Stats
+type CacheStats struct {
+	Entries    int   `json:"entries"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	Collisions int64 `json:"collisions"`
+}
+
+// NewAPIHandler creates a new APIHandler for the given SimpleFlash
+func NewAPIHandler(sf *SimpleFlash) *APIHandler {
+	h := &APIHandler{MaxRequestSize: DefaultMaxRequestSize, sf: sf, mux: http.NewServeMux()}
+	h.mux.HandleFunc("POST /query", h.query)
+	h.mux.HandleFunc("POST /count-tokens", h.countTokens)
+	h.mux.HandleFunc("GET /healthz", h.healthz)
+	h.mux.HandleFunc("GET /stats", h.stats)
+	return h
+}
+
+// ServeHTTP implements http.Handler
+func (h *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.MaxRequestSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, h.MaxRequestSize)
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// RequireBearerToken wraps the given handler so that requests must have an
+// "Authorization: Bearer <token>" header with the given token
+func RequireBearerToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or invalid bearer token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *APIHandler) query(w http.ResponseWriter, r *http.Request) {
+	var (
+		q   QueryRequest
+		err error
+	)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		q, err = h.multipartQuery(r)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&q)
+	}
+	if err != nil {
+		writeAPIError(w, requestError(err))
+		return
+	}
+	if strings.TrimSpace(q.Prompt) == "" {
+		writeAPIError(w, badRequest("the prompt is empty"))
+		return
+	}
+	res, err := h.sf.Generate(r.Context(), Request{
+		Prompt:          q.Prompt,
+		Model:           q.Model,
+		Temperature:     q.Temperature,
+		System:          q.System,
+		Attachments:     q.Attachments,
+		History:         q.History,
+		MaxOutputTokens: q.MaxOutputTokens,
+		StopSequences:   q.StopSequences,
+		NoCache:         q.NoCache,
+	})
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// multipartQuery reads a QueryRequest from a multipart form. The fields are named like the JSON fields,
+// and every file in the form is an attachment.
+func (h *APIHandler) multipartQuery(r *http.Request) (QueryRequest, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return QueryRequest{}, err
+	}
+	var q QueryRequest
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return q, nil
+		}
+		if err != nil {
+			return QueryRequest{}, err
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return QueryRequest{}, err
+		}
+		if part.FileName() != "" {
+			mimeType := part.Header.Get("Content-Type")
+			if mimeType == "" || mimeType == "application/octet-stream" {
+				mimeType = http.DetectContentType(data)
+			}
+			if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+				mimeType = mediaType
+			}
+			q.Attachments = append(q.Attachments, Attachment{MIMEType: mimeType, Data: data})
+			continue
+		}
+		value := string(data)
+		switch part.FormName() {
+		case "prompt":
+			q.Prompt = value
+		case "model":
+			q.Model = value
+		case "system":
+			q.System = value
+		case "temperature":
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return QueryRequest{}, fmt.Errorf("invalid temperature: %v", err)
+			}
+			q.Temperature = &f
+		case "max_output_tokens":
+			if q.MaxOutputTokens, err = strconv.Atoi(value); err != nil {
+				return QueryRequest{}, fmt.Errorf("invalid max_output_tokens: %v", err)
+			}
+		case "stop_sequences":
+			q.StopSequences = append(q.StopSequences, value)
+		case "no_cache":
+			if q.NoCache, err = strconv.ParseBool(value); err != nil {
+				return QueryRequest{}, fmt.Errorf("invalid no_cache: %v", err)
+			}
+		default:
+			return QueryRequest{}, fmt.Errorf("unknown form field %q", part.FormName())
+		}
+	}
+}
+
+func (h *APIHandler) countTokens(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAPIError(w, requestError(err))
+		return
+	}
+	count, err := h.sf.CountTextTokens(body.Text)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"tokens": count})
+}
+
+func (h *APIHandler) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (h *APIHandler) stats(w http.ResponseWriter, r *http.Request) {
+	stats := Stats{Models: map[string]Usage{}}
+	if cacheStats, ok := cacheStats(h.sf.Cache); ok {
+		stats.Cache = &cacheStats
+	}
+	if h.sf.Coalescer != nil {
+		stats.Shared = h.sf.Coalescer.Shared()
+	}
+	if h.sf.Costs != nil {
+		stats.Cost = h.sf.Costs.Total()
+		stats.Limit = h.sf.Costs.Limit()
+		stats.Models = h.sf.Costs.ByModel()
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// requestError wraps an error from reading the request body as a request error
+func requestError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return err
+	}
+	return badRequest("invalid request: %v", err)
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	errType := errorType(err)
+	var requestErr *badRequestError
+	if errors.As(err, &requestErr) {
+		errType = "invalid_request"
+	}
+	status, _, _ := httpErrorStatus(err)
+	writeJSON(w, status, map[string]string{"error": err.Error(), "type": errType})
+}
@@ -0,0 +1,124 @@
+package simpleflash
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIQuery(t *testing.T) {
+	temperature := 0.2
+	sf := replayFor(t, map[*Request]string{
+		{Prompt: "Hello", System: "Be brief.", Temperature: &temperature}:                             "Hi",
+		{Prompt: "Describe", Attachments: []Attachment{{MIMEType: "image/png", Data: []byte("png")}}}: "An image",
+	})
+	handler := NewAPIHandler(sf)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(`{"prompt": "Hello", "system": "Be brief.", "temperature": 0.2}`)))
+	var res Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusOK || res.Text != "Hi" {
+		t.Errorf("expected the recorded answer, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// JSON with a base64 attachment
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(`{"prompt": "Describe", "attachments": [{"mime_type": "image/png", "data": "cG5n"}]}`)))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "An image") {
+		t.Errorf("expected the answer for the base64 attachment, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// A multipart form with the same attachment
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	_ = mw.WriteField("prompt", "Describe")
+	header := make(map[string][]string)
+	header["Content-Disposition"] = []string{`form-data; name="file"; filename="a.png"`}
+	header["Content-Type"] = []string{"image/png"}
+	part, _ := mw.CreatePart(header)
+	_, _ = part.Write([]byte("png"))
+	_ = mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/query", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "An image") {
+		t.Errorf("expected the answer for the multipart attachment, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	handler := NewAPIHandler(replayFor(t, map[*Request]string{}))
+	handler.MaxRequestSize = 100
+
+	for body, status := range map[string]int{
+		`{"prompt": ""}`: http.StatusBadRequest,
+		`{"prompt": 1}`:  http.StatusBadRequest,
+		`{"prompt": "` + strings.Repeat("x", 200) + `"}`: http.StatusRequestEntityTooLarge,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(body)))
+		if rec.Code != status {
+			t.Errorf("expected status %d, got %d: %s", status, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestAPICountTokensAndStats(t *testing.T) {
+	path := writeFixture(t, Interaction{
+		Request:  RecordedRequest{Kind: "countTokens", Model: testModelName, Parts: []RecordedPart{{Text: "Count me"}}},
+		Response: &RecordedResponse{TotalTokens: 3},
+	})
+	sf, err := NewReplay(path, testModelName, testMultiModalModelName, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf.Costs.Record(testModelName, "", Usage{Calls: 1, InputTokens: 10, OutputTokens: 20})
+	handler := NewAPIHandler(sf)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/count-tokens", strings.NewReader(`{"text": "Count me"}`)))
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"tokens":3}` {
+		t.Errorf("expected the recorded token count, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats Stats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Cache == nil || stats.Cost.InputTokens != 10 || stats.Models[testModelName].OutputTokens != 20 {
+		t.Errorf("expected cache and cost counters, got %s", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected /healthz to return 200, got %d", rec.Code)
+	}
+}
+
+func TestRequireBearerToken(t *testing.T) {
+	handler := RequireBearerToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for header, status := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+		"Bearer secret": http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != status {
+			t.Errorf("expected status %d for %q, got %d", status, header, rec.Code)
+		}
+	}
+}
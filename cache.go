@@ -0,0 +1,158 @@
+package simpleflash
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultCacheTTL is how long a cached response is fresh, if sf.CacheTTL is 0
+const DefaultCacheTTL = 24 * time.Hour
+
+// CacheEntry is a cached response or failure, together with its metadata
+type CacheEntry struct {
+	Text         string    `json:"text,omitempty"`
+	Model        string    `json:"model"`
+	Created      time.Time `json:"created"`
+	FinishReason string    `json:"finish_reason,omitempty"`
+	InputTokens  int       `json:"input_tokens,omitempty"`
+	OutputTokens int       `json:"output_tokens,omitempty"`
+	ErrorType    string    `json:"error_type,omitempty"` // set for cached failures, like "blocked" or "invalid_argument"
+	Error        string    `json:"error,omitempty"`      // the message of a cached failure
+}
+
+// CachedError is returned when a request is known to fail, because the same request failed recently.
+// Only failures that will happen again, like blocked prompts and invalid arguments, are cached,
+// and only if sf.NegativeTTL is set.
+type CachedError struct {
+	Type    string    // like "blocked" or "invalid_argument"
+	Message string    // the message of the original error
+	Created time.Time // when the original error happened
+}
+
+func (e *CachedError) Error() string {
+	return e.Message + " (cached)"
+}
+
+// cacheTTL returns how long a cached response is fresh
+func (sf *SimpleFlash) cacheTTL() time.Duration {
+	if sf.CacheTTL > 0 {
+		return sf.CacheTTL
+	}
+	return DefaultCacheTTL
+}
+
+// cacheLifetime returns how long entries must be kept in the cache
+func (sf *SimpleFlash) cacheLifetime() time.Duration {
+	return max(sf.cacheTTL()+sf.StaleTTL, sf.NegativeTTL)
+}
+
+// loadEntry returns the cache entry with the given key, and if it is stale.
+// Entries that are too old to be used are not returned.
+func (sf *SimpleFlash) loadEntry(ctx context.Context, cacheKey string) (entry *CacheEntry, stale bool, ok bool) {
+	data, err := sf.Cache.Get(ctx, cacheKey)
+	if err != nil {
+		return nil, false, false
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, false, false
+	}
+	age := time.Since(entry.Created)
+	switch {
+	case entry.ErrorType != "":
+		return entry, false, age < sf.NegativeTTL
+	case age < sf.cacheTTL():
+		return entry, false, true
+	case age < sf.cacheTTL()+sf.StaleTTL:
+		return entry, true, true
+	}
+	return nil, false, false
+}
+
+// storeEntry stores the given entry in the cache, for as long as it can be used
+func (sf *SimpleFlash) storeEntry(ctx context.Context, cacheKey string, entry CacheEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	ttl := sf.cacheTTL() + sf.StaleTTL
+	if entry.ErrorType != "" {
+		ttl = sf.NegativeTTL
+	}
+	if ttl -= time.Since(entry.Created); ttl > 0 {
+		_ = sf.Cache.Set(ctx, cacheKey, data, ttl)
+	}
+}
+
+// storeFailure stores the given error in the cache, if negative caching is enabled and the error will happen again
+func (sf *SimpleFlash) storeFailure(ctx context.Context, cacheKey, modelName string, err error) {
+	if sf.NegativeTTL <= 0 {
+		return
+	}
+	if errType, ok := deterministicFailure(err); ok {
+		sf.storeEntry(ctx, cacheKey, CacheEntry{Model: modelName, Created: time.Now(), ErrorType: errType, Error: err.Error()})
+	}
+}
+
+// deterministicFailure returns the type of the given error, if the same request would fail in the same way again
+func deterministicFailure(err error) (string, bool) {
+	var (
+		blockedErr *genai.BlockedError
+		apiErr     *googleapi.Error
+	)
+	switch {
+	case errors.As(err, &blockedErr):
+		return "blocked", true
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusBadRequest:
+		return "invalid_argument", true
+	case status.Code(err) == codes.InvalidArgument:
+		return "invalid_argument", true
+	}
+	return "", false
+}
+
+// response returns the cached response, or the cached failure as a *CachedError
+func (entry *CacheEntry) response() (*Response, error) {
+	if entry.ErrorType != "" {
+		return nil, &CachedError{Type: entry.ErrorType, Message: entry.Error, Created: entry.Created}
+	}
+	created := entry.Created
+	return &Response{
+		Text:         entry.Text,
+		Model:        entry.Model,
+		Cached:       true,
+		CachedAt:     &created,
+		FinishReason: entry.FinishReason,
+		InputTokens:  entry.InputTokens,
+		OutputTokens: entry.OutputTokens,
+	}, nil
+}
+
+// revalidate replaces a stale cache entry with a new response, in the background.
+// Concurrent refreshes of the same entry are collapsed into one by sf.Coalescer, if set.
+func (sf *SimpleFlash) revalidate(ctx context.Context, modelName, cacheKey string, req Request) {
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		ctx, tel := sf.startCall(ctx, "Revalidate", modelName)
+		refresh := func(ctx context.Context) (*Response, error) {
+			return sf.call(ctx, tel, modelName, cacheKey, true, req, nil)
+		}
+		var (
+			res *Response
+			err error
+		)
+		if sf.Coalescer != nil {
+			res, _, err = sf.Coalescer.Do(ctx, cacheKey, refresh)
+		} else {
+			res, err = refresh(ctx)
+		}
+		tel.end(res, err)
+	}()
+}
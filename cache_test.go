@@ -0,0 +1,50 @@
+package simpleflash
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	req := Request{Prompt: "What do cows say?"}
+	sf := replayFor(t, map[*Request]string{&req: "Moo."})
+	sf.StaleTTL = time.Hour
+	if err := sf.InitCache(); err != nil {
+		t.Fatal(err)
+	}
+	cacheKey := cacheKeyFor(sf.modelFor(req), req)
+
+	// An expired entry is served, and refreshed in the background
+	sf.storeEntry(context.Background(), cacheKey, CacheEntry{Text: "Baa.", Model: testModelName, Created: time.Now().Add(-DefaultCacheTTL - time.Minute)})
+	res, err := sf.Generate(context.Background(), req)
+	if err != nil || res.Text != "Baa." || !res.Stale || !res.Cached || res.CachedAt == nil {
+		t.Fatalf("expected the stale response, got %+v (%v)", res, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if entry, stale, ok := sf.loadEntry(context.Background(), cacheKey); ok && !stale && entry.Text == "Moo." {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the entry to be refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The metadata of the new entry is returned with the cached response
+	res, err = sf.Generate(context.Background(), req)
+	if err != nil || res.Text != "Moo." || res.Stale || res.InputTokens != 5 || res.OutputTokens != 7 || res.FinishReason != "FinishReasonStop" || res.Cost != 0 {
+		t.Errorf("expected the fresh cached response with its metadata, got %+v (%v)", res, err)
+	}
+
+	// Entries that are too old are not used at all, even if the store still has them
+	data, _ := json.Marshal(CacheEntry{Text: "Baa.", Model: testModelName, Created: time.Now().Add(-DefaultCacheTTL - 2*time.Hour)})
+	if err := sf.Cache.Set(context.Background(), cacheKey, data, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if res, err = sf.Generate(context.Background(), req); err != nil || res.Text != "Moo." || res.Cached {
+		t.Errorf("expected a new response, got %+v (%v)", res, err)
+	}
+}
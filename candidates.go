@@ -0,0 +1,144 @@
+package simpleflash
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// DefaultCandidateTemperature is the temperature of requests for several candidates that do not set one,
+// so that the candidates differ
+const DefaultCandidateTemperature = 0.7
+
+// Selector picks the answer from the candidates of a response, by returning its index
+type Selector func(candidates []string) int
+
+// MajorityVote returns a Selector that picks the most common answer, after normalizing the case,
+// the whitespace and the punctuation at the ends. Ties are won by the answer that came first.
+// This is also known as self-consistency.
+func MajorityVote() Selector {
+	return func(candidates []string) int {
+		counts := make(map[string]int)
+		for _, candidate := range candidates {
+			counts[normalizeAnswer(candidate)]++
+		}
+		best := 0
+		for i, candidate := range candidates {
+			if counts[normalizeAnswer(candidate)] > counts[normalizeAnswer(candidates[best])] {
+				best = i
+			}
+		}
+		return best
+	}
+}
+
+// Longest returns a Selector that picks the longest answer
+func Longest() Selector {
+	return ScoreWith(func(candidate string) float64 {
+		return float64(utf8.RuneCountInString(candidate))
+	})
+}
+
+// Shortest returns a Selector that picks the shortest answer
+func Shortest() Selector {
+	return ScoreWith(func(candidate string) float64 {
+		return -float64(utf8.RuneCountInString(candidate))
+	})
+}
+
+// ScoreWith returns a Selector that picks the answer with the highest score.
+// Ties are won by the answer that came first.
+func ScoreWith(score func(candidate string) float64) Selector {
+	return func(candidates []string) int {
+		best := 0
+		bestScore := 0.0
+		for i, candidate := range candidates {
+			if s := score(candidate); i == 0 || s > bestScore {
+				best, bestScore = i, s
+			}
+		}
+		return best
+	}
+}
+
+// normalizeAnswer returns the answer in lower case, with single spaces and without punctuation at the ends
+func normalizeAnswer(answer string) string {
+	answer = strings.Join(strings.Fields(strings.ToLower(answer)), " ")
+	return strings.TrimFunc(answer, func(r rune) bool {
+		return unicode.IsPunct(r) || unicode.IsSpace(r)
+	})
+}
+
+// submit sends the request and returns the texts of the candidates in the response
+func (sf *SimpleFlash) submit(ctx context.Context, tel *callTelemetry, modelName string, model *genai.GenerativeModel, history []*genai.Content, parts []genai.Part, onChunk ChunkFunc) ([]string, string, Usage, error) {
+	genaiRes, err := sf.generateContent(ctx, model, history, parts, onChunk)
+	if err != nil {
+		return nil, "", Usage{}, fmt.Errorf("unable to generate contents: %w", err)
+	}
+	usage := sf.recordUsage(modelName, genaiRes)
+	tel.response(genaiRes)
+	text, err := responseText(genaiRes)
+	if err != nil {
+		return nil, "", usage, err
+	}
+	texts := []string{text}
+	for _, candidate := range genaiRes.Candidates[1:] {
+		if candidate != nil && candidate.Content != nil && len(candidate.Content.Parts) > 0 {
+			texts = append(texts, strings.TrimSpace(fmt.Sprintf("%s", candidate.Content.Parts[0])))
+		}
+	}
+	return texts, genaiRes.Candidates[0].FinishReason.String(), usage, nil
+}
+
+// submitCandidates asks for n candidates in one request. If the model does not support that,
+// n requests are sent at the same time instead.
+func (sf *SimpleFlash) submitCandidates(ctx context.Context, tel *callTelemetry, modelName string, req Request, history []*genai.Content, parts []genai.Part, n int) ([]string, string, Usage, error) {
+	model := sf.configureModel(modelName, req)
+	model.SetCandidateCount(int32(n))
+	texts, finishReason, usage, err := sf.submit(ctx, tel, modelName, model, history, parts, nil)
+	if errType, ok := deterministicFailure(err); !ok || errType != "invalid_argument" {
+		return texts, finishReason, usage, err
+	}
+
+	// Sample n times, with the settings of the request
+	model = sf.configureModel(modelName, req)
+	var (
+		wg            sync.WaitGroup
+		mut           sync.Mutex
+		samples       = make([]string, n)
+		finishReasons = make([]string, n)
+		errs          = make([]error, n)
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sampleTexts, sampleFinishReason, sampleUsage, err := sf.submit(ctx, tel, modelName, model, history, parts, nil)
+			mut.Lock()
+			defer mut.Unlock()
+			usage.add(sampleUsage)
+			if errs[i] = err; err == nil {
+				samples[i], finishReasons[i] = sampleTexts[0], sampleFinishReason
+			}
+		}(i)
+	}
+	wg.Wait()
+	texts, finishReason = nil, ""
+	for i, sample := range samples {
+		if errs[i] == nil {
+			texts = append(texts, sample)
+			if finishReason == "" {
+				finishReason = finishReasons[i]
+			}
+		}
+	}
+	if len(texts) == 0 {
+		return nil, "", usage, errs[0]
+	}
+	return texts, finishReason, usage, nil
+}
@@ -0,0 +1,60 @@
+package simpleflash
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSelectors(t *testing.T) {
+	candidates := []string{"Oslo", "Bergen, Norway", " oslo.", "Bergen"}
+	for name, tc := range map[string]struct {
+		selector Selector
+		expected int
+	}{
+		"majority": {MajorityVote(), 0},
+		"longest":  {Longest(), 1},
+		"shortest": {Shortest(), 0},
+		"score":    {ScoreWith(func(c string) float64 { return float64(strings.Count(c, "e")) }), 1},
+	} {
+		if got := tc.selector(candidates); got != tc.expected {
+			t.Errorf("%s: expected %d, got %d", name, tc.expected, got)
+		}
+	}
+	if got := MajorityVote()([]string{"a", "b", "B", "a.", "b!"}); got != 1 {
+		t.Errorf("expected the first of the most common answers, got %d", got)
+	}
+}
+
+func TestCandidatesInDeterministicMode(t *testing.T) {
+	sf := replayFor(t, map[*Request]string{})
+	if _, err := sf.Generate(context.Background(), Request{Prompt: "x", Candidates: 2, Mode: ModeDeterministic}); err == nil || !strings.Contains(err.Error(), "deterministic mode") {
+		t.Errorf("expected an error for candidates in deterministic mode, got %v", err)
+	}
+	sf.Mode = ModeDeterministic
+	if _, err := sf.Generate(context.Background(), Request{Prompt: "x", Candidates: 2}); err == nil || !strings.Contains(err.Error(), "deterministic mode") {
+		t.Errorf("expected an error for candidates when the SimpleFlash is in deterministic mode, got %v", err)
+	}
+	if _, err := sf.Query(context.Background(), "x", WithCandidates(2, MajorityVote())); !errors.Is(err, ErrInvalidOptions) || !strings.Contains(err.Error(), "deterministic mode") {
+		t.Errorf("expected an ErrInvalidOptions error for candidates in deterministic mode, got %v", err)
+	}
+}
+
+func TestCandidateTemperature(t *testing.T) {
+	// Without a temperature, the candidates are sampled at DefaultCandidateTemperature
+	temperature := DefaultCandidateTemperature
+	sf := replayResponses(t, replayedResponse{Request{Prompt: "Pick a color", Temperature: &temperature, Candidates: 3}, []string{"Red", "Blue", "blue."}})
+	res, err := sf.Generate(context.Background(), Request{Prompt: "Pick a color", Candidates: 3, Selector: MajorityVote()})
+	if err != nil || res.Text != "Blue" || len(res.Candidates) != 3 {
+		t.Errorf("expected the most common of 3 candidates, got %+v (%v)", res, err)
+	}
+
+	zero := 0.0
+	if _, err := sf.Generate(context.Background(), Request{Prompt: "x", Candidates: 2, Temperature: &zero}); err == nil || !strings.Contains(err.Error(), "temperature 0") {
+		t.Errorf("expected an error for candidates at temperature 0, got %v", err)
+	}
+	if _, err := sf.Query(context.Background(), "x", WithCandidates(2, MajorityVote()), WithTemperature(0)); !errors.Is(err, ErrInvalidOptions) || !strings.Contains(err.Error(), "temperature 0") {
+		t.Errorf("expected an ErrInvalidOptions error for candidates at temperature 0, got %v", err)
+	}
+}
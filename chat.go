@@ -0,0 +1,92 @@
+package simpleflash
+
+import (
+	"context"
+
+	"cloud.google.com/go/vertexai/genai"
+	"google.golang.org/api/iterator"
+)
+
+// Roles of the messages in a conversation
+const (
+	RoleUser  = "user"
+	RoleModel = "model"
+)
+
+// Message is a turn in a conversation, for use as the History of a Request
+type Message struct {
+	Role        string       `json:"role"` // RoleUser or RoleModel
+	Text        string       `json:"text"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// ChunkFunc is called with each chunk of text as it is streamed from the model
+type ChunkFunc func(text string)
+
+// GenerateStream is like Generate, but calls onChunk with each chunk of the response as it arrives.
+// A cached response is passed to onChunk in one piece. Processors are applied to the complete response,
+// and if a response is rejected, the new attempt is streamed too.
+func (sf *SimpleFlash) GenerateStream(ctx context.Context, req Request, onChunk ChunkFunc) (*Response, error) {
+	res, err := sf.generate(ctx, req, onChunk)
+	if err != nil {
+		return nil, err
+	}
+	return sf.postProcess(ctx, req, res, onChunk)
+}
+
+// historyContents converts the given messages to genai contents
+func historyContents(history []Message) []*genai.Content {
+	contents := make([]*genai.Content, 0, len(history))
+	for _, msg := range history {
+		contents = append(contents, &genai.Content{Role: msg.Role, Parts: messageParts(msg.Text, msg.Attachments)})
+	}
+	return contents
+}
+
+// messageParts converts the given text and attachments to genai parts
+func messageParts(text string, attachments []Attachment) []genai.Part {
+	parts := []genai.Part{genai.Text(text)}
+	for _, attachment := range attachments {
+		parts = append(parts, genai.Blob{MIMEType: attachment.MIMEType, Data: attachment.Data})
+	}
+	return parts
+}
+
+// send sends the history and the parts to the model. If onChunk is not nil, the response is streamed.
+func send(ctx context.Context, model *genai.GenerativeModel, history []*genai.Content, parts []genai.Part, onChunk ChunkFunc) (*genai.GenerateContentResponse, error) {
+	if len(history) == 0 && onChunk == nil {
+		return model.GenerateContent(ctx, parts...)
+	}
+	cs := model.StartChat()
+	cs.History = history
+	if onChunk == nil {
+		return cs.SendMessage(ctx, parts...)
+	}
+	iter := cs.SendMessageStream(ctx, parts...)
+	var usage *genai.UsageMetadata
+	for {
+		res, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The usage metadata of the last response covers the whole response
+		if res.UsageMetadata != nil {
+			usage = res.UsageMetadata
+		}
+		if len(res.Candidates) > 0 && res.Candidates[0] != nil && res.Candidates[0].Content != nil {
+			for _, part := range res.Candidates[0].Content.Parts {
+				if text, ok := part.(genai.Text); ok {
+					onChunk(string(text))
+				}
+			}
+		}
+	}
+	merged := iter.MergedResponse()
+	if merged != nil {
+		merged.UsageMetadata = usage
+	}
+	return merged, nil
+}
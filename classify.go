@@ -0,0 +1,158 @@
+package simpleflash
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// structuredRetries is how many times Classify and Extract ask again for a valid answer, if sf.ValidationRetries is 0
+const structuredRetries = 2
+
+// ClassifyOptions are the settings of a call to Classify
+type ClassifyOptions struct {
+	Instructions string // optional guidance, like what the labels mean
+	Model        string // if empty, sf.ModelName is used
+	Samples      int    // if > 1, the text is classified this many times, and the confidence is the share of the votes. Not in ModeDeterministic.
+}
+
+// Classification is the label that was picked by Classify
+type Classification struct {
+	Label      string         `json:"label"`
+	Confidence float64        `json:"confidence"`      // from 0 to 1
+	Votes      map[string]int `json:"votes,omitempty"` // the votes for each label, if several samples were generated and the response is not cached
+}
+
+// classifyPrompt asks for one of the labels
+const classifyPrompt = `Classify the text below with exactly one of these labels: %s.
+%s
+Reply with the label, and how confident you are that it is correct, from 0 to 1.
+
+Text:
+%s`
+
+// Classify picks the label that fits the text best. The answer is constrained to the labels with a
+// response schema, and answers with other labels are rejected and asked for again. Without samples,
+// the confidence is the one reported by the model, which is only a rough estimate.
+func (sf *SimpleFlash) Classify(ctx context.Context, text string, labels []string, opts ClassifyOptions) (*Classification, error) {
+	if len(labels) < 2 {
+		return nil, errors.New("at least 2 labels are needed")
+	}
+	seen := make(map[string]bool)
+	for _, label := range labels {
+		if strings.TrimSpace(label) == "" || seen[label] {
+			return nil, fmt.Errorf("the labels must be unique and not empty: %q", labels)
+		}
+		seen[label] = true
+	}
+	if opts.Samples > 1 && sf.Mode == ModeDeterministic {
+		return nil, fmt.Errorf("%d samples are requested, but the SimpleFlash is in deterministic mode, where they would all be the same", opts.Samples)
+	}
+	var instructions string
+	if opts.Instructions != "" {
+		instructions = "\n" + strings.TrimSpace(opts.Instructions) + "\n"
+	}
+	req := Request{
+		Prompt:         fmt.Sprintf(classifyPrompt, strings.Join(labels, ", "), instructions, text),
+		Model:          opts.Model,
+		Mode:           ModeDeterministic,
+		ResponseSchema: classifySchema(labels),
+		Processors: []Processor{func(answer string) (string, error) {
+			c, err := parseClassification(answer, labels)
+			if err != nil {
+				return "", err
+			}
+			data, err := json.Marshal(c)
+			return string(data), err
+		}},
+	}
+	if sf.ValidationRetries == 0 {
+		req.ValidationRetries = structuredRetries
+	}
+	if opts.Samples > 1 {
+		// The samples are drawn at a temperature above 0, so that they can disagree
+		temperature := DefaultCandidateTemperature
+		req.Mode = ModeDefault
+		req.Temperature = &temperature
+		req.Candidates = opts.Samples
+		req.Selector = labelVote(labels)
+	}
+	res, err := sf.Generate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var c Classification
+	if err := json.Unmarshal([]byte(res.Text), &c); err != nil {
+		return nil, fmt.Errorf("failed to decode the classification: %v", err)
+	}
+	if len(res.Candidates) > 1 {
+		c.Votes = make(map[string]int)
+		for _, candidate := range res.Candidates {
+			if vote, err := parseClassification(candidate, labels); err == nil {
+				c.Votes[vote.Label]++
+			}
+		}
+		c.Confidence = float64(c.Votes[c.Label]) / float64(len(res.Candidates))
+	}
+	return &c, nil
+}
+
+// classifySchema returns the response schema for a classification with the given labels
+func classifySchema(labels []string) *genai.Schema {
+	return &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"label":      {Type: genai.TypeString, Format: "enum", Enum: labels},
+			"confidence": {Type: genai.TypeNumber, Description: "from 0 to 1"},
+		},
+		Required: []string{"label", "confidence"},
+	}
+}
+
+// parseClassification decodes a classification from an answer, and checks the label.
+// The label is matched without regard to case, but the returned label is spelled as in labels.
+func parseClassification(answer string, labels []string) (*Classification, error) {
+	var c Classification
+	if err := json.Unmarshal([]byte(jsonText(answer)), &c); err != nil {
+		return nil, invalid(answer, `the answer must be a JSON object like {"label": %q, "confidence": 0.9}`, labels[0])
+	}
+	for _, label := range labels {
+		if strings.EqualFold(strings.TrimSpace(c.Label), label) {
+			c.Label = label
+			c.Confidence = min(max(c.Confidence, 0), 1)
+			c.Votes = nil
+			return &c, nil
+		}
+	}
+	return nil, invalid(answer, "the label must be one of %s, not %q", strings.Join(labels, ", "), c.Label)
+}
+
+// labelVote returns a Selector that picks the first answer with the most common label
+func labelVote(labels []string) Selector {
+	return func(candidates []string) int {
+		winners := make([]string, len(candidates))
+		for i, candidate := range candidates {
+			if c, err := parseClassification(candidate, labels); err == nil {
+				winners[i] = c.Label
+			} else {
+				winners[i] = fmt.Sprintf("\x00%d", i) // invalid answers do not vote together
+			}
+		}
+		return MajorityVote()(winners)
+	}
+}
+
+// jsonText returns the JSON in an answer, without surrounding whitespace or a fenced code block
+func jsonText(answer string) string {
+	answer = strings.TrimSpace(answer)
+	if strings.HasPrefix(answer, "```") {
+		if blocks := codeBlocks(answer); len(blocks) > 0 {
+			return strings.TrimSpace(blocks[0].code)
+		}
+	}
+	return answer
+}
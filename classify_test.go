@@ -0,0 +1,67 @@
+package simpleflash
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	labels := []string{"positive", "negative"}
+	prompt := fmt.Sprintf(classifyPrompt, "positive, negative", "", "I love it")
+	wrong := `{"label": "happy", "confidence": 0.8}`
+	sf := replayFor(t, map[*Request]string{
+		{Prompt: prompt, Mode: ModeDeterministic, ResponseSchema: classifySchema(labels)}: wrong,
+		{
+			Prompt:         fmt.Sprintf(retryPrompt, `the label must be one of positive, negative, not "happy"`),
+			History:        []Message{{Role: RoleUser, Text: prompt}, {Role: RoleModel, Text: wrong}},
+			Mode:           ModeDeterministic,
+			ResponseSchema: classifySchema(labels),
+		}: "```json\n{\"label\": \"Positive\", \"confidence\": 1.5}\n```",
+	})
+	c, err := sf.Classify(context.Background(), "I love it", labels, ClassifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Label != "positive" || c.Confidence != 1 || c.Votes != nil {
+		t.Errorf("expected the label of the second answer, with the confidence clamped to 1, got %+v", c)
+	}
+
+	for _, labels := range [][]string{{"one"}, {"a", "a"}, {"a", " "}} {
+		if _, err := sf.Classify(context.Background(), "x", labels, ClassifyOptions{}); err == nil {
+			t.Errorf("expected an error for the labels %q", labels)
+		}
+	}
+
+	// Samples that disagree lower the confidence
+	temperature := DefaultCandidateTemperature
+	sampled := replayResponses(t, replayedResponse{
+		Request{Prompt: prompt, Temperature: &temperature, Candidates: 4, ResponseSchema: classifySchema(labels)},
+		[]string{`{"label": "positive", "confidence": 0.9}`, `{"label": "negative", "confidence": 0.6}`, `{"label": "positive", "confidence": 0.8}`, `{"label": "Positive", "confidence": 1}`},
+	})
+	if c, err = sampled.Classify(context.Background(), "I love it", labels, ClassifyOptions{Samples: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if c.Label != "positive" || c.Confidence != 0.75 || c.Votes["positive"] != 3 || c.Votes["negative"] != 1 {
+		t.Errorf("expected 3 of 4 votes for positive, got %+v", c)
+	}
+
+	// Samples would all be the same in deterministic mode
+	sf.Mode = ModeDeterministic
+	if _, err := sf.Classify(context.Background(), "x", labels, ClassifyOptions{Samples: 3}); err == nil {
+		t.Error("expected an error for samples in deterministic mode")
+	}
+}
+
+func TestLabelVote(t *testing.T) {
+	candidates := []string{
+		`{"label": "spam", "confidence": 0.9}`,
+		`not JSON`,
+		`{"label": "ham", "confidence": 0.6}`,
+		`not JSON`,
+		`{"label": "HAM", "confidence": 0.7}`,
+	}
+	if got := labelVote([]string{"spam", "ham"})(candidates); got != 2 {
+		t.Errorf("expected the first answer with the most common label, got %d", got)
+	}
+}
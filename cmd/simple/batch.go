@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/xyproto/simpleflash"
+)
+
+// Columns that are added to every row in the batch output
+const (
+	rowColumn      = "row"
+	responseColumn = "response"
+	statusColumn   = "status"
+	errorColumn    = "error"
+)
+
+// Values of the status column
+const (
+	statusOK    = "ok"
+	statusError = "error"
+)
+
+// batchRow is a row of the batch input, with its ID
+type batchRow struct {
+	id     string
+	fields map[string]string
+}
+
+// generateFunc generates a response for a request, like SimpleFlash.Generate
+type generateFunc func(ctx context.Context, req simpleflash.Request) (*simpleflash.Response, error)
+
+// runBatch runs the batch subcommand and returns the exit code
+func runBatch(args []string, stdout, stderr io.Writer) int {
+	var temperature temperatureFlag
+	fs := flag.NewFlagSet("simple batch", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, `Usage: simple batch --input rows.csv --output results.csv --template 'Summarize: {{.text}}' [flags]
+
+Render the template for every row of a JSONL or CSV file, send the prompts to Gemini
+and write the rows with the response, status and error columns added.
+Input columns with those names are not allowed.
+Rows that are already in the output file with status ok are skipped, so an interrupted
+run can be resumed, and rows that failed are tried again.
+
+Flags:
+`)
+		fs.PrintDefaults()
+	}
+	input := fs.String("input", "", "the JSONL or CSV file with one row per prompt")
+	output := fs.String("output", "", "the JSONL or CSV file to write the results to")
+	templateText := fs.String("template", "", "the prompt template, like 'Translate {{.text}}', where the fields are the columns of each row")
+	templateFile := fs.String("template-file", "", "read the prompt template from this file")
+	idColumn := fs.String("id-column", "", "the column that identifies each row when resuming (default: the row number)")
+	concurrency := fs.Int("concurrency", 4, "the number of prompts to send at the same time")
+	model := fs.String("model", "", "the model to use (default: "+textModel+")")
+	fs.Var(&temperature, "temperature", "the temperature, between 0 and 2")
+	timeout := fs.Duration("timeout", time.Minute, "the timeout for each prompt")
+	system := fs.String("system", "", "a system instruction")
+	noCache := fs.Bool("no-cache", false, "do not use the response cache")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if *templateFile != "" {
+		data, err := os.ReadFile(*templateFile)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		*templateText = string(data)
+	}
+	if *input == "" || *output == "" || *templateText == "" || *concurrency < 1 {
+		fmt.Fprintln(stderr, "Error: --input, --output and --template (or --template-file) are required, and --concurrency must be at least 1")
+		fs.Usage()
+		return exitUsage
+	}
+	tmpl, err := template.New("prompt").Option("missingkey=error").Parse(*templateText)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error: invalid template:", err)
+		return exitUsage
+	}
+
+	sf, err := newSimpleFlash(!*noCache, *timeout)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	defer sf.Close()
+
+	b := &batch{
+		tmpl:        tmpl,
+		idColumn:    *idColumn,
+		concurrency: *concurrency,
+		request:     simpleflash.Request{Model: *model, Temperature: temperature.value, System: *system, NoCache: *noCache},
+		generate:    sf.Generate,
+	}
+	done, failed, skipped, err := b.run(*input, *output)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	fmt.Fprintf(stdout, "%d rows done, %d failed, %d skipped\n", done, failed, skipped)
+	if failed > 0 {
+		return exitError
+	}
+	return exitOK
+}
+
+// batch runs a prompt template over the rows of a file
+type batch struct {
+	tmpl        *template.Template
+	idColumn    string
+	concurrency int
+	request     simpleflash.Request // the settings for every request, without the prompt
+	generate    generateFunc
+}
+
+// run processes the rows of the input file that are not already in the output file,
+// and appends the results to the output file
+func (b *batch) run(inputPath, outputPath string) (done, failed, skipped int, err error) {
+	rows, columns, err := readRows(inputPath, b.idColumn)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if b.idColumn == "" && slices.Contains(columns, rowColumn) {
+		return 0, 0, 0, fmt.Errorf("%s has a %q column, which would be replaced by the row number: use --id-column to identify the rows", inputPath, rowColumn)
+	}
+	for _, column := range []string{responseColumn, statusColumn, errorColumn} {
+		if slices.Contains(columns, column) {
+			return 0, 0, 0, fmt.Errorf("%s has a %q column, which would be replaced by the result: rename the column", inputPath, column)
+		}
+	}
+	finished, err := finishedRows(outputPath, b.idColumn)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	f, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	w, err := newRowWriter(f, outputPath, columns, fi.Size() > 0)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	var (
+		mut      sync.Mutex
+		writeErr error
+		wg       sync.WaitGroup
+		sem      = make(chan struct{}, b.concurrency)
+	)
+	for _, row := range rows {
+		if finished[row.id] {
+			skipped++
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(row batchRow) {
+			defer func() { <-sem; wg.Done() }()
+			result := b.process(row)
+			mut.Lock()
+			defer mut.Unlock()
+			if result[statusColumn] == statusOK {
+				done++
+			} else {
+				failed++
+			}
+			if err := w.write(result); err != nil && writeErr == nil {
+				writeErr = err
+			}
+		}(row)
+	}
+	wg.Wait()
+	return done, failed, skipped, writeErr
+}
+
+// process renders the prompt for the given row and sends it, and returns the row with the result columns
+func (b *batch) process(row batchRow) map[string]string {
+	result := make(map[string]string, len(row.fields)+4)
+	for k, v := range row.fields {
+		result[k] = v
+	}
+	if b.idColumn == "" {
+		result[rowColumn] = row.id
+	}
+	result[statusColumn] = statusError
+
+	var prompt strings.Builder
+	if err := b.tmpl.Execute(&prompt, row.fields); err != nil {
+		result[errorColumn] = fmt.Sprintf("failed to render the template: %v", err)
+		return result
+	}
+	req := b.request
+	req.Prompt = prompt.String()
+	res, err := b.generate(context.Background(), req)
+	if err != nil {
+		result[errorColumn] = err.Error()
+		return result
+	}
+	result[responseColumn] = res.Text
+	result[statusColumn] = statusOK
+	return result
+}
+
+// isCSV returns true if the given file should be read and written as CSV, and false for JSONL
+func isCSV(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".csv")
+}
+
+// readRows reads the rows of a JSONL or CSV file, and returns them together with the column names.
+// The ID of each row is the value of idColumn, or the row number if idColumn is empty.
+func readRows(path, idColumn string) ([]batchRow, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var (
+		rows    []batchRow
+		columns []string
+	)
+	add := func(fields map[string]string) error {
+		id := strconv.Itoa(len(rows) + 1)
+		if idColumn != "" {
+			var ok bool
+			if id, ok = fields[idColumn]; !ok {
+				return fmt.Errorf("row %d of %s has no %q column", len(rows)+1, path, idColumn)
+			}
+		}
+		rows = append(rows, batchRow{id: id, fields: fields})
+		return nil
+	}
+
+	if isCSV(path) {
+		r := csv.NewReader(f)
+		records, err := r.ReadAll()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		if len(records) == 0 {
+			return nil, nil, nil
+		}
+		columns = records[0]
+		for _, record := range records[1:] {
+			fields := make(map[string]string, len(columns))
+			for i, column := range columns {
+				if i < len(record) {
+					fields[column] = record[i]
+				}
+			}
+			if err := add(fields); err != nil {
+				return nil, nil, err
+			}
+		}
+		return rows, columns, nil
+	}
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var values map[string]any
+		if err := json.Unmarshal([]byte(line), &values); err != nil {
+			return nil, nil, fmt.Errorf("failed to read line %d of %s: %v", lineNumber, path, err)
+		}
+		fields := make(map[string]string, len(values))
+		for k, v := range values {
+			if s, ok := v.(string); ok {
+				fields[k] = s
+			} else {
+				data, _ := json.Marshal(v)
+				fields[k] = string(data)
+			}
+			if !seen[k] {
+				seen[k] = true
+				columns = append(columns, k)
+			}
+		}
+		if err := add(fields); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(columns)
+	return rows, columns, nil
+}
+
+// finishedRows returns the IDs of the rows that are already in the given output file with status ok, if it exists.
+// Rows that failed are not finished, so they are tried again.
+func finishedRows(path, idColumn string) (map[string]bool, error) {
+	finished := make(map[string]bool)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return finished, nil
+	}
+	if idColumn == "" {
+		idColumn = rowColumn
+	}
+	rows, _, err := readRows(path, idColumn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the existing output: %v", err)
+	}
+	for _, row := range rows {
+		if row.fields[statusColumn] == statusOK {
+			finished[row.id] = true
+		}
+	}
+	return finished, nil
+}
+
+// rowWriter writes result rows as JSONL or CSV
+type rowWriter struct {
+	csv     *csv.Writer
+	json    *json.Encoder
+	columns []string
+}
+
+// newRowWriter creates a rowWriter for the given columns of the input.
+// The CSV header is only written if the output file was empty.
+func newRowWriter(w io.Writer, path string, columns []string, resuming bool) (*rowWriter, error) {
+	if !isCSV(path) {
+		return &rowWriter{json: json.NewEncoder(w)}, nil
+	}
+	rw := &rowWriter{csv: csv.NewWriter(w)}
+	for _, column := range columns {
+		switch column {
+		case rowColumn, responseColumn, statusColumn, errorColumn:
+		default:
+			rw.columns = append(rw.columns, column)
+		}
+	}
+	rw.columns = append(rw.columns, rowColumn, responseColumn, statusColumn, errorColumn)
+	if !resuming {
+		if err := rw.csv.Write(rw.columns); err != nil {
+			return nil, err
+		}
+		rw.csv.Flush()
+	}
+	return rw, rw.csv.Error()
+}
+
+// write writes and flushes one result row
+func (rw *rowWriter) write(row map[string]string) error {
+	if rw.json != nil {
+		return rw.json.Encode(row)
+	}
+	record := make([]string, len(rw.columns))
+	for i, column := range rw.columns {
+		record[i] = row[column]
+	}
+	if err := rw.csv.Write(record); err != nil {
+		return err
+	}
+	rw.csv.Flush()
+	return rw.csv.Error()
+}
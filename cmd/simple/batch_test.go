@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"text/template"
+
+	"github.com/xyproto/simpleflash"
+)
+
+// fakeBatch returns a batch that answers every prompt with the prompt in upper case,
+// or fails if the prompt contains "fail", and counts the calls
+func fakeBatch(t *testing.T, calls *int32) *batch {
+	t.Helper()
+	return &batch{
+		tmpl:        template.Must(template.New("prompt").Option("missingkey=error").Parse("Say {{.word}}")),
+		concurrency: 2,
+		generate: func(ctx context.Context, req simpleflash.Request) (*simpleflash.Response, error) {
+			atomic.AddInt32(calls, 1)
+			if strings.Contains(req.Prompt, "fail") {
+				return nil, errors.New("failed on purpose")
+			}
+			return &simpleflash.Response{Text: strings.ToUpper(req.Prompt)}, nil
+		},
+	}
+}
+
+func TestBatchCSV(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.csv")
+	output := filepath.Join(dir, "output.csv")
+	if err := os.WriteFile(input, []byte("word\nhi\nfail\nbye\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	done, failed, skipped, err := fakeBatch(t, &calls).run(input, output)
+	if err != nil || done != 2 || failed != 1 || skipped != 0 {
+		t.Fatalf("expected 2 done and 1 failed, got %d, %d, %d (%v)", done, failed, skipped, err)
+	}
+	rows, columns, err := readRows(output, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(columns, ",") != "word,row,response,status,error" || len(rows) != 3 {
+		t.Fatalf("unexpected output columns %v or rows %v", columns, rows)
+	}
+	for _, row := range rows {
+		switch row.fields["word"] {
+		case "hi":
+			if row.fields["response"] != "SAY HI" || row.fields["status"] != statusOK || row.fields["row"] != "1" {
+				t.Errorf("unexpected result %v", row.fields)
+			}
+		case "fail":
+			if row.fields["status"] != statusError || row.fields["error"] != "failed on purpose" {
+				t.Errorf("unexpected result %v", row.fields)
+			}
+		}
+	}
+
+	// Resuming skips the rows that are done, tries the failed row again, and does not write the header again
+	calls = 0
+	if err := os.WriteFile(input, []byte("word\nhi\nfail\nbye\nagain\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	done, failed, skipped, err = fakeBatch(t, &calls).run(input, output)
+	if err != nil || done != 1 || failed != 1 || skipped != 2 || calls != 2 {
+		t.Errorf("expected the failed and the new row to be processed, got %d, %d, %d and %d calls (%v)", done, failed, skipped, calls, err)
+	}
+	if rows, _, err := readRows(output, ""); err != nil || len(rows) != 5 {
+		t.Errorf("expected 5 rows in the output, got %d (%v)", len(rows), err)
+	}
+
+	// Without --id-column, a row column in the input would be replaced
+	if err := os.WriteFile(input, []byte("word,row\nhi,x\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := fakeBatch(t, &calls).run(input, filepath.Join(dir, "other.csv")); err == nil {
+		t.Error("expected an error for an input with a row column")
+	}
+
+	// Input columns with the names of the result columns would be replaced too
+	for _, column := range []string{"response", "status", "error"} {
+		if err := os.WriteFile(input, []byte("word,"+column+"\nhi,x\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := fakeBatch(t, &calls).run(input, filepath.Join(dir, "other.csv")); err == nil || !strings.Contains(err.Error(), column) {
+			t.Errorf("expected an error for an input with a %s column, got %v", column, err)
+		}
+	}
+}
+
+func TestBatchJSONL(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.jsonl")
+	output := filepath.Join(dir, "output.jsonl")
+	if err := os.WriteFile(input, []byte(`{"id": "a", "word": "one"}`+"\n"+`{"id": "b", "word": "two"}`+"\n"+`{"id": "c"}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var calls int32
+	b := fakeBatch(t, &calls)
+	b.idColumn = "id"
+	done, failed, _, err := b.run(input, output)
+	if err != nil || done != 2 || failed != 1 {
+		t.Fatalf("expected 2 done and 1 failed template, got %d and %d (%v)", done, failed, err)
+	}
+	if calls != 2 {
+		t.Errorf("expected a row with a missing field not to be sent, got %d calls", calls)
+	}
+	rows, _, err := readRows(output, "id")
+	if err != nil || len(rows) != 3 {
+		t.Fatalf("expected 3 rows in the output, got %d (%v)", len(rows), err)
+	}
+	for _, row := range rows {
+		if row.id == "c" && !strings.Contains(row.fields["error"], "failed to render the template") {
+			t.Errorf("expected a template error, got %v", row.fields)
+		}
+	}
+
+	// Resuming with the ID column only tries the row that failed again
+	calls = 0
+	if _, failed, skipped, err := b.run(input, output); err != nil || skipped != 2 || failed != 1 || calls != 0 {
+		t.Errorf("expected the done rows to be skipped, got %d skipped, %d failed and %d calls (%v)", skipped, failed, calls, err)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xyproto/simpleflash"
+)
+
+const chatHelp = `Commands:
+  /model [name]      show or set the model
+  /temp [value]      show or set the temperature, or "default" to unset it
+  /attach <file>     attach a file to the next message
+  /save <file>       save the transcript, as JSON if the filename ends with .json, otherwise as Markdown
+  /load <file>       load a transcript that was saved as JSON
+  /reset             forget the conversation and any pending attachments
+  /tokens            count the tokens in the system prompt and the conversation
+  /help              show this help
+  /quit              end the chat session
+`
+
+// transcript is a chat session, as saved with /save and loaded with /load
+type transcript struct {
+	Model       string                `json:"model,omitempty"`
+	Temperature *float64              `json:"temperature,omitempty"`
+	System      string                `json:"system,omitempty"`
+	Messages    []simpleflash.Message `json:"messages"`
+}
+
+// chatSession is an interactive chat session with Gemini
+type chatSession struct {
+	sf          *simpleflash.SimpleFlash
+	transcript  transcript
+	attachments []simpleflash.Attachment // attached to the next message
+	out         io.Writer
+}
+
+// runChat runs the interactive chat subcommand and returns the exit code
+func runChat(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var temperature temperatureFlag
+	fs := flag.NewFlagSet("simple chat", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	model := fs.String("model", "", "the model to use (default: "+textModel+", or "+multiModalModel+" with attachments)")
+	fs.Var(&temperature, "temperature", "the temperature, between 0 and 2")
+	timeout := fs.Duration("timeout", time.Minute, "the timeout for each message")
+	system := fs.String("system", "", "a system instruction")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	sf, err := newSimpleFlash(false, *timeout)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	defer sf.Close()
+
+	cs := &chatSession{
+		sf:         sf,
+		transcript: transcript{Model: *model, Temperature: temperature.value, System: *system},
+		out:        stdout,
+	}
+	fmt.Fprintln(stdout, "Chatting with Gemini. Type /help for commands, /quit or Ctrl-D to quit.")
+	scanner := bufio.NewScanner(stdin)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for {
+		fmt.Fprint(stdout, "> ")
+		if !scanner.Scan() {
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "/") {
+			quit, err := cs.command(line)
+			if err != nil {
+				fmt.Fprintln(stderr, "Error:", err)
+			}
+			if quit {
+				return exitOK
+			}
+			continue
+		}
+		if err := cs.send(line); err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+		}
+	}
+	fmt.Fprintln(stdout)
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	return exitOK
+}
+
+// send sends a message with the pending attachments, streams the answer and adds both to the history
+func (cs *chatSession) send(text string) error {
+	req := simpleflash.Request{
+		Prompt:      text,
+		Model:       cs.transcript.Model,
+		Temperature: cs.transcript.Temperature,
+		System:      cs.transcript.System,
+		Attachments: cs.attachments,
+		History:     cs.transcript.Messages,
+	}
+	res, err := cs.sf.GenerateStream(context.Background(), req, func(chunk string) {
+		fmt.Fprint(cs.out, chunk)
+	})
+	fmt.Fprintln(cs.out)
+	if err != nil {
+		return err
+	}
+	cs.transcript.Messages = append(cs.transcript.Messages,
+		simpleflash.Message{Role: simpleflash.RoleUser, Text: text, Attachments: cs.attachments},
+		simpleflash.Message{Role: simpleflash.RoleModel, Text: res.Text},
+	)
+	cs.attachments = nil
+	return nil
+}
+
+// command runs the given slash command. Returns true if the session should end.
+func (cs *chatSession) command(line string) (bool, error) {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+	switch name {
+	case "/quit", "/exit":
+		return true, nil
+	case "/help":
+		fmt.Fprint(cs.out, chatHelp)
+	case "/model":
+		if arg != "" {
+			cs.transcript.Model = arg
+		}
+		if cs.transcript.Model == "" {
+			fmt.Fprintf(cs.out, "Model: %s (default)\n", cs.sf.ModelName)
+		} else {
+			fmt.Fprintf(cs.out, "Model: %s\n", cs.transcript.Model)
+		}
+	case "/temp":
+		switch arg {
+		case "":
+		case "default":
+			cs.transcript.Temperature = nil
+		default:
+			var temperature temperatureFlag
+			if err := temperature.Set(arg); err != nil {
+				return false, fmt.Errorf("invalid temperature: %v", err)
+			}
+			cs.transcript.Temperature = temperature.value
+		}
+		if cs.transcript.Temperature == nil {
+			fmt.Fprintln(cs.out, "Temperature: default")
+		} else {
+			fmt.Fprintf(cs.out, "Temperature: %s\n", strconv.FormatFloat(*cs.transcript.Temperature, 'f', -1, 64))
+		}
+	case "/attach":
+		if arg == "" {
+			return false, errors.New("usage: /attach <file>")
+		}
+		attachment, err := readAttachment(arg)
+		if err != nil {
+			return false, err
+		}
+		cs.attachments = append(cs.attachments, attachment)
+		fmt.Fprintf(cs.out, "Attached %s (%s, %d bytes) to the next message\n", arg, attachment.MIMEType, len(attachment.Data))
+	case "/save":
+		if arg == "" {
+			return false, errors.New("usage: /save <file>")
+		}
+		if err := cs.save(arg); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(cs.out, "Saved %d messages to %s\n", len(cs.transcript.Messages), arg)
+	case "/load":
+		if arg == "" {
+			return false, errors.New("usage: /load <file>")
+		}
+		if err := cs.load(arg); err != nil {
+			return false, err
+		}
+		fmt.Fprintf(cs.out, "Loaded %d messages from %s\n", len(cs.transcript.Messages), arg)
+	case "/reset":
+		cs.transcript.Messages = nil
+		cs.attachments = nil
+		fmt.Fprintln(cs.out, "The conversation has been reset")
+	case "/tokens":
+		count, err := cs.sf.CountRequestTokens(simpleflash.Request{
+			Model:       cs.transcript.Model,
+			System:      cs.transcript.System,
+			Attachments: cs.attachments,
+			History:     cs.transcript.Messages,
+		})
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(cs.out, "Tokens: %d\n", count)
+	default:
+		return false, fmt.Errorf("unknown command %s, try /help", name)
+	}
+	return false, nil
+}
+
+// save saves the transcript as JSON or Markdown, depending on the file extension
+func (cs *chatSession) save(filename string) error {
+	var data []byte
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		var err error
+		data, err = json.MarshalIndent(cs.transcript, "", "  ")
+		if err != nil {
+			return err
+		}
+	} else {
+		data = []byte(cs.transcript.markdown())
+	}
+	return os.WriteFile(filename, data, 0o644)
+}
+
+// load loads a transcript that was saved as JSON
+func (cs *chatSession) load(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var t transcript
+	if err := json.Unmarshal(data, &t); err != nil {
+		return fmt.Errorf("failed to load %s, only transcripts saved as JSON can be loaded: %v", filename, err)
+	}
+	cs.transcript = t
+	cs.attachments = nil
+	return nil
+}
+
+// markdown formats the transcript as Markdown
+func (t transcript) markdown() string {
+	var sb strings.Builder
+	sb.WriteString("# Chat transcript\n\n")
+	if t.Model != "" {
+		fmt.Fprintf(&sb, "* Model: %s\n", t.Model)
+	}
+	if t.Temperature != nil {
+		fmt.Fprintf(&sb, "* Temperature: %s\n", strconv.FormatFloat(*t.Temperature, 'f', -1, 64))
+	}
+	if t.System != "" {
+		fmt.Fprintf(&sb, "* System: %s\n", t.System)
+	}
+	for _, msg := range t.Messages {
+		heading := "User"
+		if msg.Role == simpleflash.RoleModel {
+			heading = "Gemini"
+		}
+		fmt.Fprintf(&sb, "\n## %s\n\n%s\n", heading, msg.Text)
+		for _, attachment := range msg.Attachments {
+			fmt.Fprintf(&sb, "\n*Attachment: %s, %d bytes*\n", attachment.MIMEType, len(attachment.Data))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xyproto/simpleflash"
+)
+
+func TestChatCommands(t *testing.T) {
+	var out bytes.Buffer
+	cs := &chatSession{sf: &simpleflash.SimpleFlash{ModelName: textModel}, out: &out}
+
+	if _, err := cs.command("/temp 0.5"); err != nil || cs.transcript.Temperature == nil || *cs.transcript.Temperature != 0.5 {
+		t.Errorf("expected the temperature to be set to 0.5, got %v", err)
+	}
+	if _, err := cs.command("/temp 5"); err == nil {
+		t.Error("expected an error for a temperature that is out of range")
+	}
+	if _, err := cs.command("/model gemini-1.5-pro"); err != nil || cs.transcript.Model != "gemini-1.5-pro" {
+		t.Errorf("expected the model to be set, got %v", err)
+	}
+	if _, err := cs.command("/nope"); err == nil {
+		t.Error("expected an error for an unknown command")
+	}
+	if quit, _ := cs.command("/quit"); !quit {
+		t.Error("expected /quit to end the session")
+	}
+}
+
+func TestChatSaveAndLoad(t *testing.T) {
+	var out bytes.Buffer
+	cs := &chatSession{sf: &simpleflash.SimpleFlash{ModelName: textModel}, out: &out}
+	cs.transcript.Messages = []simpleflash.Message{
+		{Role: simpleflash.RoleUser, Text: "Hi"},
+		{Role: simpleflash.RoleModel, Text: "Hello!"},
+	}
+	dir := t.TempDir()
+
+	jsonFile := filepath.Join(dir, "chat.json")
+	if _, err := cs.command("/save " + jsonFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.command("/reset"); err != nil || len(cs.transcript.Messages) != 0 {
+		t.Fatalf("expected the conversation to be reset, got %v", err)
+	}
+	if _, err := cs.command("/load " + jsonFile); err != nil {
+		t.Fatal(err)
+	}
+	if len(cs.transcript.Messages) != 2 || cs.transcript.Messages[1].Text != "Hello!" {
+		t.Errorf("expected the saved messages to be loaded, got %+v", cs.transcript.Messages)
+	}
+
+	markdown := cs.transcript.markdown()
+	if !strings.Contains(markdown, "## User\n\nHi\n") || !strings.Contains(markdown, "## Gemini\n\nHello!\n") {
+		t.Errorf("unexpected Markdown transcript:\n%s", markdown)
+	}
+	if _, err := cs.command("/load " + filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("expected an error when loading a missing transcript")
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/xyproto/simpleflash/eval"
+)
+
+// runEval runs the eval subcommand and returns the exit code
+func runEval(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("simple eval", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, `Usage: simple eval --suite suite.json [--baseline baseline.json] [flags]
+
+Run the cases of an evaluation suite through Gemini, score the answers and print a report.
+If a baseline report is given, the results are compared with it.
+The exit code is 1 if the pass rate is too low, a case regressed or the mean score dropped too much.
+
+Flags:
+`)
+		fs.PrintDefaults()
+	}
+	suitePath := fs.String("suite", "", "the JSON or YAML file with the evaluation suite")
+	baselinePath := fs.String("baseline", "", "a report from an earlier run to compare with")
+	savePath := fs.String("save", "", "write the report to this file, for use as a baseline")
+	jsonOutput := fs.Bool("json", false, "output the report as JSON")
+	concurrency := fs.Int("concurrency", 4, "the number of cases to run at the same time")
+	timeout := fs.Duration("timeout", time.Minute, "the timeout for each request")
+	noCache := fs.Bool("no-cache", false, "do not use the response cache")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if *suitePath == "" || *concurrency < 1 {
+		fmt.Fprintln(stderr, "Error: --suite is required, and --concurrency must be at least 1")
+		fs.Usage()
+		return exitUsage
+	}
+
+	suite, err := eval.LoadSuite(*suitePath)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	var baseline *eval.Report
+	if *baselinePath != "" {
+		if baseline, err = eval.LoadReport(*baselinePath); err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+	}
+
+	sf, err := newSimpleFlash(!*noCache, *timeout)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	defer sf.Close()
+	runner := eval.NewRunner(sf)
+	runner.Concurrency = *concurrency
+	return reportEval(runner, suite, baseline, *savePath, *jsonOutput, stdout, stderr)
+}
+
+// reportEval runs the suite, writes the report and returns the exit code
+func reportEval(runner *eval.Runner, suite *eval.Suite, baseline *eval.Report, savePath string, jsonOutput bool, stdout, stderr io.Writer) int {
+	report, err := runner.Run(context.Background(), suite, baseline)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	if savePath != "" {
+		if err := report.Save(savePath); err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+	}
+	if jsonOutput {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		fmt.Fprintln(stdout, string(data))
+	} else if err := report.WriteText(stdout); err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	if !report.OK {
+		return exitError
+	}
+	return exitOK
+}
@@ -1,47 +1,246 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"mime"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/xyproto/env/v2"
 	"github.com/xyproto/simpleflash"
 )
 
+const (
+	textModel = "gemini-1.5-flash"
+	//textModel       = "gemini-1.5-pro"
+	multiModalModel = "gemini-1.0-pro-vision"
+)
+
+// Exit codes
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+const usageText = `Usage: simple [flags] [prompt...]
+       simple chat [flags]
+       simple batch [flags]
+       simple eval [flags]
+
+Send a prompt to Gemini and print the response.
+If no prompt is given as arguments, it is read from stdin.
+Use the chat subcommand to start an interactive chat session,
+the batch subcommand to run a prompt template over the rows of a JSONL or CSV file,
+and the eval subcommand to score the answers to an evaluation suite.
+
+Environment variables:
+  PROJECT_ID        the Google Cloud project ID (required)
+  PROJECT_LOCATION  the Google Cloud location (default: europe-west4)
+
+Flags:
+`
+
+// attachFlags collects the filenames given with the repeatable --attach flag
+type attachFlags []string
+
+func (a *attachFlags) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *attachFlags) Set(filename string) error {
+	*a = append(*a, filename)
+	return nil
+}
+
+// temperatureFlag is a float flag that remembers if it was set
+type temperatureFlag struct {
+	value *float64
+}
+
+func (t *temperatureFlag) String() string {
+	if t.value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*t.value, 'f', -1, 64)
+}
+
+func (t *temperatureFlag) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	if f < 0 || f > 2 {
+		return errors.New("the temperature must be between 0 and 2")
+	}
+	t.value = &f
+	return nil
+}
+
 func main() {
-	const (
-		textModel       = "gemini-1.5-flash"
-		//textModel       = "gemini-1.5-pro"
-		multiModalModel = "gemini-1.0-pro-vision"
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command line client and returns the exit code
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "chat":
+			return runChat(args[1:], stdin, stdout, stderr)
+		case "batch":
+			return runBatch(args[1:], stdout, stderr)
+		case "eval":
+			return runEval(args[1:], stdout, stderr)
+		}
+	}
+	var (
+		attachments attachFlags
+		temperature temperatureFlag
 	)
+	fs := flag.NewFlagSet("simple", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usageText)
+		fs.PrintDefaults()
+	}
+	model := fs.String("model", "", "the model to use (default: "+textModel+", or "+multiModalModel+" with attachments)")
+	fs.Var(&temperature, "temperature", "the temperature, between 0 and 2")
+	timeout := fs.Duration("timeout", 10*time.Second, "the timeout for the request")
+	system := fs.String("system", "", "a system instruction")
+	fs.Var(&attachments, "attach", "a file to attach to the prompt, can be given several times")
+	jsonOutput := fs.Bool("json", false, "output the response and its metadata as JSON")
+	noCache := fs.Bool("no-cache", false, "do not use the response cache")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	prompt, err := readPrompt(fs.Args(), stdin)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	if prompt == "" {
+		fmt.Fprintln(stderr, "Error: no prompt given")
+		fs.Usage()
+		return exitUsage
+	}
+
+	req := simpleflash.Request{
+		Prompt:      prompt,
+		Model:       *model,
+		Temperature: temperature.value,
+		System:      *system,
+		NoCache:     *noCache,
+	}
+	for _, filename := range attachments {
+		attachment, err := readAttachment(filename)
+		if err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		req.Attachments = append(req.Attachments, attachment)
+	}
+
+	sf, err := newSimpleFlash(!*noCache, *timeout)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
+	defer sf.Close()
+
+	res, err := sf.Generate(context.Background(), req)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return exitError
+	}
 
+	if *jsonOutput {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(res); err != nil {
+			fmt.Fprintln(stderr, "Error:", err)
+			return exitError
+		}
+		return exitOK
+	}
+
+	fmt.Fprintln(stdout, res.Text)
+	return exitOK
+}
+
+// newSimpleFlash creates a SimpleFlash, configured by the PROJECT_ID and PROJECT_LOCATION environment variables
+func newSimpleFlash(cache bool, timeout time.Duration) (*simpleflash.SimpleFlash, error) {
 	var (
 		projectLocation = env.Str("PROJECT_LOCATION", "europe-west4") // europe-west4 is just the default
 		projectID       = env.Str("PROJECT_ID")
 	)
 
-	if projectID == "" {
-		fmt.Fprintln(os.Stderr, "Error: PROJECT_ID environment variable is not set.")
-		return
+	if projectID == "" && env.No(simpleflash.ReplayEnv) {
+		return nil, errors.New("PROJECT_ID environment variable is not set")
 	}
 
-	sf, err := simpleflash.New(textModel, multiModalModel, projectLocation, projectID, true)
+	sf, err := simpleflash.New(textModel, multiModalModel, projectLocation, projectID, cache)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error:", err)
-		return
+		return nil, err
 	}
 
-	sf.Timeout = 10 * time.Second
+	sf.Timeout = timeout
 
-	const prompt = "Write a haiku about the color of cows."
+	return sf, nil
+}
+
+// readPrompt returns the prompt from the given arguments, or from stdin if there are no arguments
+// or if the only argument is "-"
+func readPrompt(args []string, stdin io.Reader) (string, error) {
+	if len(args) > 0 && !(len(args) == 1 && args[0] == "-") {
+		return strings.TrimSpace(strings.Join(args, " ")), nil
+	}
+	if f, ok := stdin.(*os.File); ok && len(args) == 0 {
+		// Do not wait for input from an interactive terminal
+		if fi, err := f.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			return "", nil
+		}
+	}
+	data, err := io.ReadAll(stdin)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the prompt from stdin: %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
 
-	// Query Gemini with the prompt, nothing multimodal
-	output, err := sf.QueryGemini(prompt, nil, nil, nil)
+// readAttachment reads the given file and detects its MIME type
+func readAttachment(filename string) (simpleflash.Attachment, error) {
+	data, err := os.ReadFile(filename)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error:", err)
-		return
+		return simpleflash.Attachment{}, fmt.Errorf("failed to read attachment: %v", err)
 	}
+	return simpleflash.Attachment{MIMEType: detectMIMEType(filename, data), Data: data}, nil
+}
 
-	fmt.Println(output)
+// detectMIMEType sniffs the MIME type of the given data, and falls back to the file extension
+// if sniffing only gives a generic type
+func detectMIMEType(filename string, data []byte) string {
+	mimeType := http.DetectContentType(data)
+	if mimeType == "application/octet-stream" || strings.HasPrefix(mimeType, "text/plain") {
+		if byExt := mime.TypeByExtension(filepath.Ext(filename)); byExt != "" {
+			mimeType = byExt
+		}
+	}
+	// Remove parameters like "; charset=utf-8"
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		return mediaType
+	}
+	return mimeType
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadPrompt(t *testing.T) {
+	prompt, err := readPrompt([]string{"Write", "a", "haiku"}, strings.NewReader("ignored"))
+	if err != nil || prompt != "Write a haiku" {
+		t.Errorf("expected the prompt from the arguments, got %q (%v)", prompt, err)
+	}
+	prompt, err = readPrompt(nil, strings.NewReader("  From stdin\n"))
+	if err != nil || prompt != "From stdin" {
+		t.Errorf("expected the prompt from stdin, got %q (%v)", prompt, err)
+	}
+	prompt, err = readPrompt([]string{"-"}, strings.NewReader("Dash"))
+	if err != nil || prompt != "Dash" {
+		t.Errorf("expected the prompt from stdin for -, got %q (%v)", prompt, err)
+	}
+}
+
+func TestDetectMIMEType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	if got := detectMIMEType("image.bin", png); got != "image/png" {
+		t.Errorf("expected image/png to be sniffed, got %q", got)
+	}
+	if got := detectMIMEType("notes.md", []byte("# Notes\n")); got != "text/markdown" {
+		t.Errorf("expected text/markdown from the extension, got %q", got)
+	}
+	if got := detectMIMEType("notes", []byte("plain text")); got != "text/plain" {
+		t.Errorf("expected text/plain, got %q", got)
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"--no-such-flag"}, strings.NewReader(""), &stdout, &stderr); code != exitUsage {
+		t.Errorf("expected exit code %d for an unknown flag, got %d", exitUsage, code)
+	}
+	if code := run(nil, strings.NewReader(""), &stdout, &stderr); code != exitUsage {
+		t.Errorf("expected exit code %d without a prompt, got %d", exitUsage, code)
+	}
+	if code := run([]string{"--attach", "/does/not/exist", "hi"}, strings.NewReader(""), &stdout, &stderr); code != exitError {
+		t.Errorf("expected exit code %d for a missing attachment, got %d", exitError, code)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/xyproto/env/v2"
+	"github.com/xyproto/simpleflash"
+)
+
+const (
+	textModel       = "gemini-1.5-flash"
+	multiModalModel = "gemini-1.0-pro-vision"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "the address to listen on")
+	noCache := flag.Bool("no-cache", false, "do not use the response cache")
+	redisAddr := flag.String("redis", "", "share the response cache through the Redis server at this address, like localhost:6379")
+	timeout := flag.Duration("timeout", time.Minute, "the timeout for each request to Gemini")
+	maxRequestSize := flag.Int64("max-request-size", simpleflash.DefaultMaxRequestSize, "the maximum size of a request body, in bytes")
+	maxConcurrent := flag.Int("max-concurrent", 0, "how many OpenAI-compatible completions are generated at the same time, for all clients, no limit if 0")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for ongoing requests when shutting down")
+	flag.Parse()
+
+	var (
+		projectLocation = env.Str("PROJECT_LOCATION", "europe-west4") // europe-west4 is just the default
+		projectID       = env.Str("PROJECT_ID")
+		token           = env.Str("SIMPLEFLASH_TOKEN") // if set, clients must send it as a bearer token
+	)
+	if projectID == "" && env.No(simpleflash.ReplayEnv) {
+		log.Fatalln("PROJECT_ID environment variable is not set")
+	}
+
+	sf, err := simpleflash.New(textModel, multiModalModel, projectLocation, projectID, !*noCache)
+	if err != nil {
+		log.Fatalf("Could not initialize simpleflash: %v", err)
+	}
+	defer sf.Close()
+	sf.Timeout = *timeout
+	if *redisAddr != "" && !*noCache {
+		redis := simpleflash.NewRedisKV(*redisAddr)
+		redis.Password = env.Str("REDIS_PASSWORD")
+		defer redis.Close()
+		sf.Cache = simpleflash.NewCompressedKV(redis)
+	}
+
+	api := simpleflash.NewAPIHandler(sf)
+	api.MaxRequestSize = *maxRequestSize
+
+	// The OpenAI-compatible API is served under /v1/ and the native API everywhere else
+	openAI := simpleflash.NewOpenAIHandler(sf)
+	openAI.MaxConcurrent = *maxConcurrent
+	mux := http.NewServeMux()
+	mux.Handle("/v1/", http.MaxBytesHandler(openAI, *maxRequestSize))
+	mux.Handle("/", api)
+
+	var handler http.Handler = mux
+	if token != "" {
+		// Health checks do not need the token
+		authMux := http.NewServeMux()
+		authMux.Handle("GET /healthz", api)
+		authMux.Handle("/", simpleflash.RequireBearerToken(token, mux))
+		handler = authMux
+	} else {
+		log.Println("SIMPLEFLASH_TOKEN is not set, so the API is open to everyone who can reach it")
+	}
+
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		log.Println("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Could not shut down gracefully: %v", err)
+		}
+	}()
+
+	log.Printf("Serving on %s", *addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalln(err)
+	}
+	<-shutdownDone
+}
@@ -0,0 +1,101 @@
+package simpleflash
+
+import (
+	"context"
+	"sync"
+)
+
+// Coalescer collapses identical concurrent requests into one call to Gemini, whose response is
+// shared with every caller that is waiting for it. Requests are identical if they have the same cache key.
+//
+// The call is not tied to the context of the caller that started it: if that caller gives up,
+// the call continues for the others, and it is only cancelled when every caller has given up.
+type Coalescer struct {
+	mut     sync.Mutex
+	flights map[string]*flight
+	shared  int
+}
+
+// flight is a call that is in progress
+type flight struct {
+	done    chan struct{}
+	res     *Response
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// NewCoalescer creates a new Coalescer
+func NewCoalescer() *Coalescer {
+	return &Coalescer{flights: make(map[string]*flight)}
+}
+
+// Do calls fn, unless a call with the same key is already in progress, in which case the result of
+// that call is waited for. The returned bool is true for the caller that started the call. The other
+// callers get a copy of the response, with Shared set and no Cost, since the cost was only paid once.
+func (c *Coalescer) Do(ctx context.Context, key string, fn func(ctx context.Context) (*Response, error)) (*Response, bool, error) {
+	c.mut.Lock()
+	f, inProgress := c.flights[key]
+	if !inProgress {
+		// The call keeps the values of ctx, like the trace, but not its cancellation
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		c.flights[key] = f
+		go func() {
+			res, err := fn(callCtx)
+			cancel()
+			c.mut.Lock()
+			f.res, f.err = res, err
+			c.forget(key, f)
+			c.mut.Unlock()
+			close(f.done)
+		}()
+	} else {
+		c.shared++
+	}
+	f.waiters++
+	c.mut.Unlock()
+
+	select {
+	case <-f.done:
+		if f.err != nil {
+			return nil, !inProgress, f.err
+		}
+		res := *f.res
+		if inProgress {
+			res.Shared = true
+			res.Cost = 0
+		}
+		return &res, !inProgress, nil
+	case <-ctx.Done():
+		c.mut.Lock()
+		defer c.mut.Unlock()
+		if f.waiters--; f.waiters == 0 {
+			// Nobody is waiting for the call anymore, and new callers should not join it
+			f.cancel()
+			c.forget(key, f)
+		}
+		return nil, !inProgress, ctx.Err()
+	}
+}
+
+// forget removes the given flight, unless it has already been replaced by a new call with the same key
+func (c *Coalescer) forget(key string, f *flight) {
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+}
+
+// InFlight returns the number of calls that are in progress
+func (c *Coalescer) InFlight() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return len(c.flights)
+}
+
+// Shared returns the number of requests that were served by a call that was already in progress
+func (c *Coalescer) Shared() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.shared
+}
@@ -0,0 +1,128 @@
+package simpleflash
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalescer(t *testing.T) {
+	c := NewCoalescer()
+	release := make(chan struct{})
+	var calls atomic.Int32
+	fn := func(ctx context.Context) (*Response, error) {
+		calls.Add(1)
+		<-release
+		return &Response{Text: "shared", Cost: 0.5}, nil
+	}
+
+	const n = 10
+	var (
+		wg      sync.WaitGroup
+		leaders atomic.Int32
+		costs   sync.Map
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, leader, err := c.Do(context.Background(), "key", fn)
+			if err != nil || res.Text != "shared" || res.Shared == leader {
+				t.Errorf("unexpected result %+v, leader %v (%v)", res, leader, err)
+				return
+			}
+			if leader {
+				leaders.Add(1)
+			}
+			costs.Store(i, res.Cost)
+		}(i)
+	}
+	for c.Shared() < n-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 || leaders.Load() != 1 {
+		t.Errorf("expected 1 call and 1 leader, got %d and %d", calls.Load(), leaders.Load())
+	}
+	total := 0.0
+	costs.Range(func(_, cost any) bool { total += cost.(float64); return true })
+	if total != 0.5 {
+		t.Errorf("expected the cost to be counted once, got %v", total)
+	}
+	if c.InFlight() != 0 {
+		t.Errorf("expected no calls in progress, got %d", c.InFlight())
+	}
+}
+
+func TestCoalescerLeaderCanceled(t *testing.T) {
+	c := NewCoalescer()
+	started, release := make(chan struct{}), make(chan struct{})
+	fn := func(ctx context.Context) (*Response, error) {
+		close(started)
+		select {
+		case <-release:
+			return &Response{Text: "done"}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		_, _, err := c.Do(leaderCtx, "key", fn)
+		leaderErr <- err
+	}()
+	<-started
+	followerRes := make(chan *Response)
+	go func() {
+		res, _, _ := c.Do(context.Background(), "key", fn)
+		followerRes <- res
+	}()
+	for c.Shared() < 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The leader gives up, but the call continues for the follower
+	cancelLeader()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the leader to be canceled, got %v", err)
+	}
+	close(release)
+	if res := <-followerRes; res == nil || res.Text != "done" || !res.Shared {
+		t.Errorf("expected the follower to get the response, got %+v", res)
+	}
+}
+
+func TestCoalescerAllCanceled(t *testing.T) {
+	c := NewCoalescer()
+	canceled := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for c.InFlight() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	_, _, err := c.Do(ctx, "key", func(ctx context.Context) (*Response, error) {
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the call to be canceled, got %v", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the call to be canceled when nobody is waiting for it")
+	}
+	if c.InFlight() != 0 {
+		t.Errorf("expected no calls in progress, got %d", c.InFlight())
+	}
+}
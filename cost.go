@@ -0,0 +1,227 @@
+package simpleflash
+
+import (
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// Price is the price of using a model, in USD per million tokens
+type Price struct {
+	Input  float64
+	Output float64
+}
+
+// DefaultPrices contains the prices for the Gemini models, keyed by model name.
+// Versioned model names are matched by the longest prefix, like for DefaultModelLimits.
+var DefaultPrices = map[string]Price{
+	"gemini-1.0-pro":        {Input: 0.5, Output: 1.5},
+	"gemini-1.0-pro-vision": {Input: 0.5, Output: 1.5},
+	"gemini-1.5-flash":      {Input: 0.075, Output: 0.3},
+	"gemini-1.5-pro":        {Input: 1.25, Output: 5},
+}
+
+// Usage is the accumulated token usage and cost for a model, a tag or in total
+type Usage struct {
+	Calls        int     `json:"calls"`
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	Cost         float64 `json:"cost"` // in USD
+}
+
+// add adds the given usage to u
+func (u *Usage) add(other Usage) {
+	u.Calls += other.Calls
+	u.InputTokens += other.InputTokens
+	u.OutputTokens += other.OutputTokens
+	u.Cost += other.Cost
+}
+
+// BudgetExceededError is returned when the spend limit of a CostTracker has been reached,
+// or would be reached by the calls in progress and the call that was refused
+type BudgetExceededError struct {
+	Spent    float64 // in USD
+	Reserved float64 // the estimated cost of the calls in progress and of the refused call, in USD
+	Limit    float64 // in USD
+}
+
+func (e *BudgetExceededError) Error() string {
+	if e.Reserved > 0 {
+		return fmt.Sprintf("budget exceeded: spent $%.6f and reserved $%.6f, but the limit is $%.6f", e.Spent, e.Reserved, e.Limit)
+	}
+	return fmt.Sprintf("budget exceeded: spent $%.6f, but the limit is $%.6f", e.Spent, e.Limit)
+}
+
+// CostTracker keeps the cumulative token usage and cost, per model and per tag.
+// It is safe for concurrent use.
+type CostTracker struct {
+	mut      sync.Mutex
+	limit    float64
+	reserved float64 // the estimated cost of the calls in progress
+	total    Usage
+	byModel  map[string]Usage
+	byTag    map[string]Usage
+}
+
+// NewCostTracker creates a new CostTracker with the given spend limit in USD. 0 means no limit.
+func NewCostTracker(limit float64) *CostTracker {
+	return &CostTracker{
+		limit:   limit,
+		byModel: make(map[string]Usage),
+		byTag:   make(map[string]Usage),
+	}
+}
+
+// SetLimit sets the hard spend limit, in USD. 0 means no limit.
+func (ct *CostTracker) SetLimit(limit float64) {
+	ct.mut.Lock()
+	defer ct.mut.Unlock()
+	ct.limit = limit
+}
+
+// Limit returns the hard spend limit, in USD. 0 means no limit.
+func (ct *CostTracker) Limit() float64 {
+	ct.mut.Lock()
+	defer ct.mut.Unlock()
+	return ct.limit
+}
+
+// Record adds the given usage for the given model and tag
+func (ct *CostTracker) Record(modelName, tag string, usage Usage) {
+	ct.mut.Lock()
+	defer ct.mut.Unlock()
+	ct.total.add(usage)
+	modelUsage := ct.byModel[modelName]
+	modelUsage.add(usage)
+	ct.byModel[modelName] = modelUsage
+	if tag != "" {
+		tagUsage := ct.byTag[tag]
+		tagUsage.add(usage)
+		ct.byTag[tag] = tagUsage
+	}
+}
+
+// Total returns the total usage
+func (ct *CostTracker) Total() Usage {
+	ct.mut.Lock()
+	defer ct.mut.Unlock()
+	return ct.total
+}
+
+// ByModel returns a copy of the usage per model name
+func (ct *CostTracker) ByModel() map[string]Usage {
+	ct.mut.Lock()
+	defer ct.mut.Unlock()
+	return copyUsage(ct.byModel)
+}
+
+// ByTag returns a copy of the usage per tag
+func (ct *CostTracker) ByTag() map[string]Usage {
+	ct.mut.Lock()
+	defer ct.mut.Unlock()
+	return copyUsage(ct.byTag)
+}
+
+// Reset clears all recorded usage, but keeps the spend limit
+func (ct *CostTracker) Reset() {
+	ct.mut.Lock()
+	defer ct.mut.Unlock()
+	ct.total = Usage{}
+	ct.byModel = make(map[string]Usage)
+	ct.byTag = make(map[string]Usage)
+}
+
+// CheckBudget returns a *BudgetExceededError if the spend limit has been reached
+func (ct *CostTracker) CheckBudget() error {
+	ct.mut.Lock()
+	defer ct.mut.Unlock()
+	if ct.limit > 0 && ct.total.Cost >= ct.limit {
+		return &BudgetExceededError{Spent: ct.total.Cost, Limit: ct.limit}
+	}
+	return nil
+}
+
+// Reserve reserves the estimated cost of a call, or returns a *BudgetExceededError if the spend limit has
+// been reached, or would be reached by the calls in progress and this call. The check and the reservation
+// are done together, so concurrent calls can not all pass the check. The reservation must be ended with
+// Settle when the call is done and its actual usage has been recorded.
+func (ct *CostTracker) Reserve(estimate float64) error {
+	ct.mut.Lock()
+	defer ct.mut.Unlock()
+	if ct.limit > 0 && (ct.total.Cost >= ct.limit || ct.total.Cost+ct.reserved+estimate > ct.limit) {
+		return &BudgetExceededError{Spent: ct.total.Cost, Reserved: ct.reserved + estimate, Limit: ct.limit}
+	}
+	ct.reserved += estimate
+	return nil
+}
+
+// Settle ends a reservation that was made with Reserve
+func (ct *CostTracker) Settle(estimate float64) {
+	ct.mut.Lock()
+	defer ct.mut.Unlock()
+	ct.reserved = max(ct.reserved-estimate, 0)
+}
+
+func copyUsage(m map[string]Usage) map[string]Usage {
+	c := make(map[string]Usage, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// PriceFor returns the price for the given model name, and true if it is known.
+// The Prices field of the SimpleFlash struct is consulted before DefaultPrices.
+func (sf *SimpleFlash) PriceFor(modelName string) (Price, bool) {
+	if price, ok := lookupModel(sf.Prices, modelName); ok {
+		return price, true
+	}
+	return lookupModel(DefaultPrices, modelName)
+}
+
+// WithTag returns a copy of sf that records costs under the given tag.
+// The copy shares the client, cache and cost tracker with sf.
+func (sf *SimpleFlash) WithTag(tag string) *SimpleFlash {
+	c := *sf
+	c.costTag = tag
+	return &c
+}
+
+// recordUsage records and returns the token usage and cost of the given response
+func (sf *SimpleFlash) recordUsage(modelName string, res *genai.GenerateContentResponse) Usage {
+	if res == nil || res.UsageMetadata == nil {
+		return Usage{}
+	}
+	usage := Usage{
+		Calls:        1,
+		InputTokens:  int(res.UsageMetadata.PromptTokenCount),
+		OutputTokens: int(res.UsageMetadata.CandidatesTokenCount),
+	}
+	if price, ok := sf.PriceFor(modelName); ok {
+		usage.Cost = (float64(usage.InputTokens)*price.Input + float64(usage.OutputTokens)*price.Output) / 1e6
+	}
+	if sf.Costs != nil {
+		sf.Costs.Record(modelName, sf.costTag, usage)
+	}
+	return usage
+}
+
+// reserveBudget reserves the estimated cost of the request in sf.Costs, and returns the estimate, which must be
+// passed to sf.Costs.Settle when the call is done. The estimate is based on the estimated input tokens and
+// req.MaxOutputTokens, times the number of candidates, and is 0 if the price of the model is not known.
+func (sf *SimpleFlash) reserveBudget(modelName string, req Request) (float64, error) {
+	if sf.Costs == nil {
+		return 0, nil
+	}
+	var estimate float64
+	if price, ok := sf.PriceFor(modelName); ok {
+		inputTokens := EstimateTokens(req.Prompt) + contextTokens(req)
+		estimate = (float64(inputTokens)*price.Input + float64(req.MaxOutputTokens)*price.Output) / 1e6
+		estimate *= float64(max(req.Candidates, 1))
+	}
+	if err := sf.Costs.Reserve(estimate); err != nil {
+		return 0, err
+	}
+	return estimate, nil
+}
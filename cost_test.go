@@ -0,0 +1,94 @@
+package simpleflash
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+func TestRecordUsage(t *testing.T) {
+	sf := &SimpleFlash{
+		Costs:  NewCostTracker(0),
+		Prices: map[string]Price{"test-model": {Input: 1, Output: 2}},
+	}
+	res := &genai.GenerateContentResponse{
+		UsageMetadata: &genai.UsageMetadata{PromptTokenCount: 1000000, CandidatesTokenCount: 500000},
+	}
+
+	sf.recordUsage("test-model-001", res)
+	sf.WithTag("batch").recordUsage("test-model-001", res)
+
+	total := sf.Costs.Total()
+	if total.Calls != 2 || total.InputTokens != 2000000 || total.OutputTokens != 1000000 {
+		t.Errorf("unexpected total usage: %+v", total)
+	}
+	if math.Abs(total.Cost-4) > 1e-9 {
+		t.Errorf("expected a total cost of $4, got $%f", total.Cost)
+	}
+	if calls := sf.Costs.ByModel()["test-model-001"].Calls; calls != 2 {
+		t.Errorf("expected 2 calls for the model, got %d", calls)
+	}
+	if tagged := sf.Costs.ByTag()["batch"]; tagged.Calls != 1 || math.Abs(tagged.Cost-2) > 1e-9 {
+		t.Errorf("unexpected usage for the tag: %+v", tagged)
+	}
+
+	sf.Costs.Reset()
+	if total := sf.Costs.Total(); total.Calls != 0 {
+		t.Errorf("expected no calls after a reset, got %d", total.Calls)
+	}
+}
+
+func TestCheckBudget(t *testing.T) {
+	ct := NewCostTracker(1)
+	if err := ct.CheckBudget(); err != nil {
+		t.Errorf("expected no error before spending anything, got %v", err)
+	}
+	ct.Record("test-model", "", Usage{Calls: 1, Cost: 1.5})
+	var budgetErr *BudgetExceededError
+	if err := ct.CheckBudget(); !errors.As(err, &budgetErr) {
+		t.Fatalf("expected a *BudgetExceededError, got %v", err)
+	}
+	if budgetErr.Spent != 1.5 || budgetErr.Limit != 1 {
+		t.Errorf("unexpected budget error: %+v", budgetErr)
+	}
+	ct.SetLimit(0)
+	if err := ct.CheckBudget(); err != nil {
+		t.Errorf("expected no error without a limit, got %v", err)
+	}
+}
+
+func TestReserveBudget(t *testing.T) {
+	ct := NewCostTracker(1)
+	var (
+		wg       sync.WaitGroup
+		reserved atomic.Int32
+	)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ct.Reserve(0.3) == nil {
+				reserved.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := reserved.Load(); n != 3 {
+		t.Fatalf("expected 3 of 10 concurrent calls to fit in the budget, got %d", n)
+	}
+	for range 3 {
+		ct.Settle(0.3)
+	}
+	ct.Record("test-model", "", Usage{Calls: 1, Cost: 0.5})
+	var budgetErr *BudgetExceededError
+	if err := ct.Reserve(0.6); !errors.As(err, &budgetErr) || budgetErr.Reserved != 0.6 {
+		t.Errorf("expected a call that would exceed the limit to be refused, got %v", err)
+	}
+	if err := ct.Reserve(0.4); err != nil {
+		t.Errorf("expected a call that fits in the limit to be allowed, got %v", err)
+	}
+}
@@ -0,0 +1,296 @@
+package simpleflash
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+
+	aiplatform "cloud.google.com/go/aiplatform/apiv1beta1"
+	"cloud.google.com/go/aiplatform/apiv1beta1/aiplatformpb"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// DefaultEmbeddingModelName is the embedding model that is used if EmbeddingModelName is not set
+const DefaultEmbeddingModelName = "text-embedding-004"
+
+// DefaultEmbedBatchSize is the maximum number of texts that are sent in one embedding request, if not set in EmbedOptions
+const DefaultEmbedBatchSize = 250
+
+// EmbedTaskType tells the embedding model what the embeddings will be used for
+type EmbedTaskType string
+
+const (
+	TaskRetrievalQuery     EmbedTaskType = "RETRIEVAL_QUERY"
+	TaskRetrievalDocument  EmbedTaskType = "RETRIEVAL_DOCUMENT"
+	TaskSemanticSimilarity EmbedTaskType = "SEMANTIC_SIMILARITY"
+	TaskClassification     EmbedTaskType = "CLASSIFICATION"
+	TaskClustering         EmbedTaskType = "CLUSTERING"
+	TaskQuestionAnswering  EmbedTaskType = "QUESTION_ANSWERING"
+	TaskFactVerification   EmbedTaskType = "FACT_VERIFICATION"
+)
+
+// EmbedOptions are the options for Embed. The zero value uses the defaults of the model.
+type EmbedOptions struct {
+	Model      string        // if empty, sf.EmbeddingModelName is used
+	TaskType   EmbedTaskType // optional
+	Dimensions int           // the output dimensionality, if 0 the default of the model is used
+	BatchSize  int           // the maximum number of texts per request, if 0 DefaultEmbedBatchSize is used
+	NoCache    bool          // if true, the cache is neither read from nor written to
+}
+
+// Embedder computes embeddings. SimpleFlash uses VertexAI by default, and FakeEmbedder can be used in tests.
+type Embedder interface {
+	Embed(ctx context.Context, modelName string, texts []string, opts EmbedOptions) ([][]float32, error)
+}
+
+// Embed returns an embedding for each of the given texts. The texts are sent in batches of opts.BatchSize,
+// and embeddings that are in the cache are not requested again.
+func (sf *SimpleFlash) Embed(ctx context.Context, texts []string, opts EmbedOptions) (embeddings [][]float32, err error) {
+	modelName := opts.Model
+	if modelName == "" {
+		modelName = sf.EmbeddingModelName
+	}
+	if modelName == "" {
+		modelName = DefaultEmbeddingModelName
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultEmbedBatchSize
+	}
+
+	ctx, tel := sf.startCall(ctx, "Embed", modelName)
+	defer func() { tel.end(nil, err) }()
+
+	if sf.Embedder == nil && (sf.Recorder == nil || sf.Recorder.Mode() != ReplayMode) {
+		return nil, errors.New("no Embedder is configured")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sf.Timeout)
+	defer cancel()
+
+	// Find the embeddings that are not in the cache
+	useCache := sf.Cache != nil && !opts.NoCache
+	embeddings = make([][]float32, len(texts))
+	var missing []int
+	for i, text := range texts {
+		if useCache {
+			if data, err := sf.Cache.Get(ctx, embedCacheKey(modelName, opts, text)); err == nil {
+				embeddings[i] = decodeEmbedding(data)
+				continue
+			}
+		}
+		missing = append(missing, i)
+	}
+	if useCache {
+		tel.cacheLookup(len(missing) == 0)
+	}
+
+	for start := 0; start < len(missing); start += batchSize {
+		end := min(start+batchSize, len(missing))
+		batch := make([]string, 0, end-start)
+		for _, i := range missing[start:end] {
+			batch = append(batch, texts[i])
+		}
+		batchEmbeddings, err := sf.embed(ctx, modelName, batch, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to embed texts: %w", err)
+		}
+		if len(batchEmbeddings) != len(batch) {
+			return nil, fmt.Errorf("expected %d embeddings, got %d", len(batch), len(batchEmbeddings))
+		}
+		for j, i := range missing[start:end] {
+			embeddings[i] = batchEmbeddings[j]
+			if useCache {
+				_ = sf.Cache.Set(ctx, embedCacheKey(modelName, opts, texts[i]), encodeEmbedding(batchEmbeddings[j]), sf.cacheTTL())
+			}
+		}
+	}
+	return embeddings, nil
+}
+
+// embed computes the embeddings of a batch of texts with sf.Embedder, and records them if sf.Recorder is set.
+// If sf.Recorder is in ReplayMode and there is no Embedder, the embeddings are replayed.
+func (sf *SimpleFlash) embed(ctx context.Context, modelName string, texts []string, opts EmbedOptions) ([][]float32, error) {
+	if sf.Recorder == nil || sf.Embedder != nil && sf.Recorder.Mode() == ReplayMode {
+		return sf.Embedder.Embed(ctx, modelName, texts, opts)
+	}
+	return sf.Recorder.embed(modelName, texts, opts, func() ([][]float32, error) {
+		return sf.Embedder.Embed(ctx, modelName, texts, opts)
+	})
+}
+
+// embedCacheKey generates a unique cache key for the embedding of the given text
+func embedCacheKey(modelName string, opts EmbedOptions, text string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "embed\x00%s\x00%s\x00%d\x00", modelName, opts.TaskType, opts.Dimensions)
+	h.Write([]byte(text))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// encodeEmbedding encodes an embedding as little endian float32 values
+func encodeEmbedding(embedding []float32) []byte {
+	data := make([]byte, 4*len(embedding))
+	for i, f := range embedding {
+		binary.LittleEndian.PutUint32(data[4*i:], math.Float32bits(f))
+	}
+	return data
+}
+
+// decodeEmbedding decodes an embedding that was encoded with encodeEmbedding
+func decodeEmbedding(data []byte) []float32 {
+	embedding := make([]float32, len(data)/4)
+	for i := range embedding {
+		embedding[i] = math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return embedding
+}
+
+// vertexEmbedder computes embeddings with the VertexAI prediction API.
+// The prediction client is created by the first call to Embed, so SimpleFlash values that never
+// compute embeddings do not connect to the prediction API.
+type vertexEmbedder struct {
+	projectID       string
+	projectLocation string
+	opts            []option.ClientOption
+	once            sync.Once
+	client          *aiplatform.PredictionClient
+	err             error // the error from creating the client
+}
+
+// newVertexEmbedder creates a vertexEmbedder for the given project and location
+func newVertexEmbedder(projectID, projectLocation string, opts ...option.ClientOption) *vertexEmbedder {
+	opts = append([]option.ClientOption{option.WithEndpoint(projectLocation + "-aiplatform.googleapis.com:443")}, opts...)
+	return &vertexEmbedder{projectID: projectID, projectLocation: projectLocation, opts: opts}
+}
+
+// predictionClient returns the prediction client, and creates it the first time
+func (e *vertexEmbedder) predictionClient() (*aiplatform.PredictionClient, error) {
+	e.once.Do(func() {
+		if e.client, e.err = aiplatform.NewPredictionClient(context.Background(), e.opts...); e.err != nil {
+			e.err = fmt.Errorf("failed to create prediction client: %v", e.err)
+		}
+	})
+	return e.client, e.err
+}
+
+// Close closes the prediction client, if it was created. Embed can not be used afterwards.
+func (e *vertexEmbedder) Close() error {
+	e.once.Do(func() { e.err = errors.New("the embedder is closed") })
+	if e.client == nil {
+		return nil
+	}
+	return e.client.Close()
+}
+
+// Embed implements Embedder
+func (e *vertexEmbedder) Embed(ctx context.Context, modelName string, texts []string, opts EmbedOptions) ([][]float32, error) {
+	req := &aiplatformpb.PredictRequest{
+		Endpoint: fmt.Sprintf("projects/%s/locations/%s/publishers/google/models/%s", e.projectID, e.projectLocation, modelName),
+	}
+	for _, text := range texts {
+		instance := map[string]any{"content": text}
+		if opts.TaskType != "" {
+			instance["task_type"] = string(opts.TaskType)
+		}
+		value, err := structpb.NewValue(instance)
+		if err != nil {
+			return nil, err
+		}
+		req.Instances = append(req.Instances, value)
+	}
+	if opts.Dimensions > 0 {
+		parameters, err := structpb.NewValue(map[string]any{"outputDimensionality": opts.Dimensions})
+		if err != nil {
+			return nil, err
+		}
+		req.Parameters = parameters
+	}
+	client, err := e.predictionClient()
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Predict(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	embeddings := make([][]float32, 0, len(res.Predictions))
+	for _, prediction := range res.Predictions {
+		values := prediction.GetStructValue().GetFields()["embeddings"].GetStructValue().GetFields()["values"].GetListValue().GetValues()
+		if len(values) == 0 {
+			return nil, errors.New("empty embedding in response")
+		}
+		embedding := make([]float32, len(values))
+		for i, v := range values {
+			embedding[i] = float32(v.GetNumberValue())
+		}
+		embeddings = append(embeddings, embedding)
+	}
+	return embeddings, nil
+}
+
+// FakeEmbedder is an Embedder for tests, that does not contact VertexAI.
+// Each word is hashed to a dimension, so texts that share words get similar embeddings.
+// It is safe for concurrent use.
+type FakeEmbedder struct {
+	Dimensions int // used if EmbedOptions.Dimensions is 0, the default is 64
+	mut        sync.Mutex
+	requests   int
+}
+
+// Embed implements Embedder
+func (f *FakeEmbedder) Embed(ctx context.Context, modelName string, texts []string, opts EmbedOptions) ([][]float32, error) {
+	f.mut.Lock()
+	f.requests++
+	f.mut.Unlock()
+	dimensions := opts.Dimensions
+	if dimensions <= 0 {
+		dimensions = f.Dimensions
+	}
+	if dimensions <= 0 {
+		dimensions = 64
+	}
+	embeddings := make([][]float32, len(texts))
+	for i, text := range texts {
+		embedding := make([]float32, dimensions)
+		for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		}) {
+			h := fnv.New32a()
+			h.Write([]byte(word))
+			embedding[h.Sum32()%uint32(dimensions)]++
+		}
+		normalize(embedding)
+		embeddings[i] = embedding
+	}
+	return embeddings, nil
+}
+
+// Requests returns the number of times Embed has been called
+func (f *FakeEmbedder) Requests() int {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.requests
+}
+
+// normalize scales the given vector to unit length, unless it is all zeros
+func normalize(v []float32) {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return
+	}
+	length := float32(math.Sqrt(sum))
+	for i := range v {
+		v[i] /= length
+	}
+}
@@ -0,0 +1,97 @@
+package simpleflash
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+)
+
+func TestEmbed(t *testing.T) {
+	fake := &FakeEmbedder{}
+	sf := &SimpleFlash{Embedder: fake, Timeout: time.Minute}
+	if err := sf.InitCache(); err != nil {
+		t.Fatal(err)
+	}
+	texts := []string{"red apples", "green apples", "blue cars", "red cars", "fast trains"}
+	embeddings, err := sf.Embed(context.Background(), texts, EmbedOptions{Dimensions: 32, BatchSize: 2, TaskType: TaskRetrievalDocument})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(embeddings) != len(texts) || len(embeddings[0]) != 32 {
+		t.Fatalf("expected %d embeddings with 32 dimensions, got %d", len(texts), len(embeddings))
+	}
+	if fake.Requests() != 3 {
+		t.Errorf("expected 5 texts to be sent in 3 batches, got %d requests", fake.Requests())
+	}
+
+	// Cached embeddings are not requested again, and come back in the same order
+	again, err := sf.Embed(context.Background(), []string{"blue cars", "new text", "red apples"}, EmbedOptions{Dimensions: 32, BatchSize: 2, TaskType: TaskRetrievalDocument})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fake.Requests() != 4 {
+		t.Errorf("expected only the new text to be requested, got %d requests", fake.Requests())
+	}
+	for i := range again[0] {
+		if again[0][i] != embeddings[2][i] || again[2][i] != embeddings[0][i] {
+			t.Fatal("expected the cached embeddings to be returned in order")
+		}
+	}
+
+	// Other options do not use the same cache entries
+	if _, err := sf.Embed(context.Background(), []string{"red apples"}, EmbedOptions{Dimensions: 16}); err != nil || fake.Requests() != 5 {
+		t.Errorf("expected a request for other options, got %d requests (%v)", fake.Requests(), err)
+	}
+}
+
+func TestFakeEmbedderSimilarity(t *testing.T) {
+	embeddings, err := (&FakeEmbedder{}).Embed(context.Background(), "", []string{"the red apple", "a red apple", "trains are fast"}, EmbedOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := func(a, b []float32) (sum float64) {
+		for i := range a {
+			sum += float64(a[i] * b[i])
+		}
+		return sum
+	}
+	if math.Abs(dot(embeddings[0], embeddings[0])-1) > 1e-6 {
+		t.Errorf("expected a unit vector, got length %f", dot(embeddings[0], embeddings[0]))
+	}
+	if dot(embeddings[0], embeddings[1]) <= dot(embeddings[0], embeddings[2]) {
+		t.Error("expected texts that share words to be more similar")
+	}
+}
+
+func TestEmbedWithoutEmbedder(t *testing.T) {
+	sf := &SimpleFlash{Timeout: time.Minute}
+	if _, err := sf.Embed(context.Background(), []string{"x"}, EmbedOptions{}); err == nil {
+		t.Error("expected an error without an Embedder")
+	}
+}
+
+func TestEncodeEmbedding(t *testing.T) {
+	embedding := []float32{0, -1.5, 3.25, float32(math.Pi)}
+	decoded := decodeEmbedding(encodeEmbedding(embedding))
+	for i := range embedding {
+		if decoded[i] != embedding[i] {
+			t.Fatalf("expected %v, got %v", embedding, decoded)
+		}
+	}
+}
+
+func TestVertexEmbedderIsLazy(t *testing.T) {
+	e := newVertexEmbedder("test-project", testLocation, option.WithoutAuthentication())
+	if e.client != nil {
+		t.Fatal("expected no prediction client before the first call to Embed")
+	}
+	if err := e.Close(); err != nil {
+		t.Errorf("expected closing an unused embedder to succeed, got %v", err)
+	}
+	if _, err := e.Embed(context.Background(), DefaultEmbeddingModelName, []string{"x"}, EmbedOptions{}); err == nil {
+		t.Error("expected an error from a closed embedder")
+	}
+}
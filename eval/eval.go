@@ -0,0 +1,432 @@
+// Package eval runs suites of prompts through SimpleFlash, scores the answers and compares
+// the results with a baseline, so that changes to prompts and models can be checked in CI.
+package eval
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xyproto/simpleflash"
+	"gopkg.in/yaml.v3"
+)
+
+// Scorers that can be used for a Case
+const (
+	ScorerExact      = "exact"      // the normalized answer equals the expected answer
+	ScorerContains   = "contains"   // the normalized answer contains the expected answer
+	ScorerRegexp     = "regexp"     // the answer matches the regular expression in Pattern
+	ScorerSimilarity = "similarity" // the cosine similarity of the embeddings of the answer and the expected answer
+	ScorerJudge      = "judge"      // a judge model scores the answer according to the rubric, or the expected answer
+)
+
+// Default pass thresholds, for cases and suites that do not set one
+const (
+	DefaultSimilarityThreshold = 0.8
+	DefaultJudgeThreshold      = 0.7
+	DefaultPassRate            = 1.0
+)
+
+// Suite is a set of cases, as read from a JSON or YAML file
+type Suite struct {
+	Name          string   `json:"name" yaml:"name"`
+	Model         string   `json:"model,omitempty" yaml:"model,omitempty"`                   // the model that answers the prompts, the default model if empty
+	System        string   `json:"system,omitempty" yaml:"system,omitempty"`                 // the system instruction for every case
+	Temperature   *float64 `json:"temperature,omitempty" yaml:"temperature,omitempty"`       // the temperature for every case
+	JudgeModel    string   `json:"judge_model,omitempty" yaml:"judge_model,omitempty"`       // the model that judges the answers, the default model if empty
+	PassRate      *float64 `json:"pass_rate,omitempty" yaml:"pass_rate,omitempty"`           // the fraction of cases that must pass, DefaultPassRate if nil
+	MaxRegression float64  `json:"max_regression,omitempty" yaml:"max_regression,omitempty"` // how much lower the mean score may be than in the baseline
+	Cases         []Case   `json:"cases" yaml:"cases"`
+}
+
+// Case is a prompt and how to score the answer
+type Case struct {
+	ID        string   `json:"id" yaml:"id"`
+	Prompt    string   `json:"prompt" yaml:"prompt"`
+	Expected  string   `json:"expected,omitempty" yaml:"expected,omitempty"`   // the expected answer
+	Pattern   string   `json:"pattern,omitempty" yaml:"pattern,omitempty"`     // the regular expression, for ScorerRegexp
+	Rubric    string   `json:"rubric,omitempty" yaml:"rubric,omitempty"`       // what the judge should look for, for ScorerJudge
+	Scorer    string   `json:"scorer,omitempty" yaml:"scorer,omitempty"`       // ScorerExact if empty
+	Threshold *float64 `json:"threshold,omitempty" yaml:"threshold,omitempty"` // the minimum score to pass, from 0 to 1
+}
+
+// Result is the outcome of a Case
+type Result struct {
+	ID     string  `json:"id"`
+	Answer string  `json:"answer"`
+	Score  float64 `json:"score"` // from 0 to 1
+	Passed bool    `json:"passed"`
+	Reason string  `json:"reason,omitempty"` // the reasoning of the judge, if any
+	Error  string  `json:"error,omitempty"`
+}
+
+// Report is the outcome of running a Suite, and of comparing it with a baseline
+type Report struct {
+	Suite     string    `json:"suite"`
+	Time      time.Time `json:"time"`
+	Results   []Result  `json:"results"`
+	Passed    int       `json:"passed"`
+	Failed    int       `json:"failed"`
+	PassRate  float64   `json:"pass_rate"`
+	MeanScore float64   `json:"mean_score"`
+	OK        bool      `json:"ok"` // true if the pass rate is high enough, no case regressed and the mean score did not drop more than MaxRegression
+
+	Baseline    *Baseline `json:"baseline,omitempty"`
+	Regressions []string  `json:"regressions,omitempty"` // cases that passed in the baseline, but fail now
+	Fixed       []string  `json:"fixed,omitempty"`       // cases that failed in the baseline, but pass now
+}
+
+// Baseline is the summary of the report that a Report was compared with
+type Baseline struct {
+	Time      time.Time `json:"time"`
+	PassRate  float64   `json:"pass_rate"`
+	MeanScore float64   `json:"mean_score"`
+}
+
+// Runner runs suites. Generate and Embed are usually the methods of a SimpleFlash.
+type Runner struct {
+	Generate    func(ctx context.Context, req simpleflash.Request) (*simpleflash.Response, error)
+	Embed       func(ctx context.Context, texts []string, opts simpleflash.EmbedOptions) ([][]float32, error)
+	Concurrency int // how many cases are run at the same time, 1 if 0
+}
+
+// NewRunner creates a Runner that uses the given SimpleFlash
+func NewRunner(sf *simpleflash.SimpleFlash) *Runner {
+	return &Runner{Generate: sf.Generate, Embed: sf.Embed, Concurrency: 4}
+}
+
+// LoadSuite reads a suite from a JSON file, or a YAML file if the extension is .yaml or .yml, and checks it
+func LoadSuite(path string) (*Suite, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var suite Suite
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		err = yaml.Unmarshal(data, &suite)
+	} else {
+		err = json.Unmarshal(data, &suite)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if err := suite.Check(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &suite, nil
+}
+
+// Check returns an error if a case has no ID, a duplicate ID, an unknown scorer or is missing what its scorer needs
+func (s *Suite) Check() error {
+	if len(s.Cases) == 0 {
+		return errors.New("the suite has no cases")
+	}
+	seen := make(map[string]bool)
+	for i, c := range s.Cases {
+		if c.ID == "" {
+			return fmt.Errorf("case %d has no id", i+1)
+		}
+		if seen[c.ID] {
+			return fmt.Errorf("the id %q is used by several cases", c.ID)
+		}
+		seen[c.ID] = true
+		if c.Prompt == "" {
+			return fmt.Errorf("case %q has no prompt", c.ID)
+		}
+		switch c.scorer() {
+		case ScorerExact, ScorerContains, ScorerSimilarity:
+			if c.Expected == "" {
+				return fmt.Errorf("case %q needs an expected answer for the %s scorer", c.ID, c.scorer())
+			}
+		case ScorerRegexp:
+			if _, err := regexp.Compile(c.Pattern); err != nil || c.Pattern == "" {
+				return fmt.Errorf("case %q needs a valid pattern for the regexp scorer", c.ID)
+			}
+		case ScorerJudge:
+			if c.Expected == "" && c.Rubric == "" {
+				return fmt.Errorf("case %q needs an expected answer or a rubric for the judge scorer", c.ID)
+			}
+		default:
+			return fmt.Errorf("case %q has an unknown scorer %q", c.ID, c.Scorer)
+		}
+	}
+	return nil
+}
+
+// scorer returns the scorer of the case, ScorerExact by default
+func (c Case) scorer() string {
+	if c.Scorer == "" {
+		return ScorerExact
+	}
+	return c.Scorer
+}
+
+// threshold returns the minimum score for the case to pass
+func (c Case) threshold() float64 {
+	switch {
+	case c.Threshold != nil:
+		return *c.Threshold
+	case c.scorer() == ScorerSimilarity:
+		return DefaultSimilarityThreshold
+	case c.scorer() == ScorerJudge:
+		return DefaultJudgeThreshold
+	}
+	return 1
+}
+
+// Run runs every case of the suite and scores the answers. If baseline is not nil, the report
+// is compared with it. Failing cases do not result in an error, only in a report that is not OK.
+func (r *Runner) Run(ctx context.Context, suite *Suite, baseline *Report) (*Report, error) {
+	if err := suite.Check(); err != nil {
+		return nil, err
+	}
+	concurrency := max(r.Concurrency, 1)
+	results := make([]Result, len(suite.Cases))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, c := range suite.Cases {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, c Case) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = r.runCase(ctx, suite, c)
+		}(i, c)
+	}
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	report := &Report{Suite: suite.Name, Time: time.Now(), Results: results}
+	for _, result := range results {
+		if result.Passed {
+			report.Passed++
+		} else {
+			report.Failed++
+		}
+		report.MeanScore += result.Score
+	}
+	report.PassRate = float64(report.Passed) / float64(len(results))
+	report.MeanScore /= float64(len(results))
+
+	passRate := DefaultPassRate
+	if suite.PassRate != nil {
+		passRate = *suite.PassRate
+	}
+	report.OK = report.PassRate >= passRate
+	if baseline != nil {
+		report.compare(baseline, suite.MaxRegression)
+	}
+	return report, nil
+}
+
+// compare compares the report with the baseline, and marks it as not OK if a case regressed,
+// or if the mean score is more than maxRegression lower than in the baseline
+func (rep *Report) compare(baseline *Report, maxRegression float64) {
+	rep.Baseline = &Baseline{Time: baseline.Time, PassRate: baseline.PassRate, MeanScore: baseline.MeanScore}
+	passedBefore := make(map[string]bool)
+	for _, result := range baseline.Results {
+		passedBefore[result.ID] = result.Passed
+	}
+	for _, result := range rep.Results {
+		before, ok := passedBefore[result.ID]
+		switch {
+		case !ok:
+		case before && !result.Passed:
+			rep.Regressions = append(rep.Regressions, result.ID)
+		case !before && result.Passed:
+			rep.Fixed = append(rep.Fixed, result.ID)
+		}
+	}
+	// Allow for rounding errors in the saved scores
+	if len(rep.Regressions) > 0 || rep.MeanScore < baseline.MeanScore-maxRegression-1e-9 {
+		rep.OK = false
+	}
+}
+
+// runCase gets the answer to a case and scores it
+func (r *Runner) runCase(ctx context.Context, suite *Suite, c Case) Result {
+	result := Result{ID: c.ID}
+	res, err := r.Generate(ctx, simpleflash.Request{Prompt: c.Prompt, Model: suite.Model, System: suite.System, Temperature: suite.Temperature})
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Answer = res.Text
+	result.Score, result.Reason, err = r.score(ctx, suite, c, res.Text)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Passed = result.Score >= c.threshold()
+	return result
+}
+
+// score scores the answer to a case, from 0 to 1
+func (r *Runner) score(ctx context.Context, suite *Suite, c Case, answer string) (float64, string, error) {
+	switch c.scorer() {
+	case ScorerExact:
+		return boolScore(normalize(answer) == normalize(c.Expected)), "", nil
+	case ScorerContains:
+		return boolScore(strings.Contains(normalize(answer), normalize(c.Expected))), "", nil
+	case ScorerRegexp:
+		return boolScore(regexp.MustCompile(c.Pattern).MatchString(answer)), "", nil
+	case ScorerSimilarity:
+		if r.Embed == nil {
+			return 0, "", errors.New("the similarity scorer needs embeddings, but the runner has no Embed function")
+		}
+		embeddings, err := r.Embed(ctx, []string{answer, c.Expected}, simpleflash.EmbedOptions{TaskType: simpleflash.TaskSemanticSimilarity})
+		if err != nil {
+			return 0, "", err
+		}
+		return max(simpleflash.CosineSimilarity(embeddings[0], embeddings[1]), 0), "", nil
+	case ScorerJudge:
+		return r.judge(ctx, suite, c, answer)
+	}
+	return 0, "", fmt.Errorf("unknown scorer %q", c.Scorer)
+}
+
+// judgePrompt asks the judge model to score an answer
+const judgePrompt = `You are grading the answer to a prompt.
+
+Prompt:
+%s
+
+%s
+
+Answer:
+%s
+
+Give the answer a score from 0 (useless or wrong) to 10 (perfect), and a short reason.`
+
+// verdict is the answer of the judge model
+type verdict struct {
+	Score  float64 `json:"score" description:"from 0 (useless or wrong) to 10 (perfect)"`
+	Reason string  `json:"reason" description:"a short explanation of the score"`
+}
+
+// judgeRetries is how many times the judge is asked again for a verdict that can be decoded
+const judgeRetries = 2
+
+// judge asks the judge model to score the answer. The verdict is constrained with a response schema.
+func (r *Runner) judge(ctx context.Context, suite *Suite, c Case, answer string) (float64, string, error) {
+	schema, err := simpleflash.SchemaFor(reflect.TypeOf(verdict{}))
+	if err != nil {
+		return 0, "", err
+	}
+	var criteria string
+	if c.Rubric != "" {
+		criteria = "Grading rubric:\n" + c.Rubric
+	}
+	if c.Expected != "" {
+		criteria = strings.TrimSpace(criteria + "\n\nExpected answer:\n" + c.Expected)
+	}
+	res, err := r.Generate(ctx, simpleflash.Request{
+		Prompt:            fmt.Sprintf(judgePrompt, c.Prompt, criteria, answer),
+		Model:             suite.JudgeModel,
+		Mode:              simpleflash.ModeDeterministic,
+		ResponseSchema:    schema,
+		ValidationRetries: judgeRetries,
+		Processors: []simpleflash.Processor{func(text string) (string, error) {
+			var v verdict
+			if err := json.Unmarshal([]byte(text), &v); err != nil {
+				return "", &simpleflash.ValidationError{Message: fmt.Sprintf("the answer must be JSON that matches the schema: %v", err), Text: text}
+			}
+			return text, nil
+		}},
+	})
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to judge the answer: %w", err)
+	}
+	var v verdict
+	if err := json.Unmarshal([]byte(res.Text), &v); err != nil {
+		return 0, "", fmt.Errorf("the judge did not reply with valid JSON: %v", err)
+	}
+	return min(max(v.Score/10, 0), 1), v.Reason, nil
+}
+
+// boolScore returns 1 for true and 0 for false
+func boolScore(ok bool) float64 {
+	if ok {
+		return 1
+	}
+	return 0
+}
+
+// normalize returns the text in lower case, with single spaces and without punctuation at the end
+func normalize(text string) string {
+	text = strings.Join(strings.Fields(strings.ToLower(text)), " ")
+	return strings.TrimRight(text, ".!?")
+}
+
+// LoadReport reads a report, like a baseline, from a JSON file
+func LoadReport(path string) (*Report, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var report Report
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return &report, nil
+}
+
+// Save writes the report to a JSON file, for use as a baseline
+func (rep *Report) Save(path string) error {
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// WriteText writes a human readable summary of the report
+func (rep *Report) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Suite: %s\n\n", rep.Suite)
+	results := append([]Result(nil), rep.Results...)
+	sort.SliceStable(results, func(i, j int) bool { return !results[i].Passed && results[j].Passed })
+	for _, result := range results {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(&b, "%s  %-24s %.2f", status, result.ID, result.Score)
+		switch {
+		case result.Error != "":
+			fmt.Fprintf(&b, "  error: %s", result.Error)
+		case result.Reason != "":
+			fmt.Fprintf(&b, "  %s", result.Reason)
+		}
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "\n%d passed, %d failed, pass rate %.2f, mean score %.2f\n", rep.Passed, rep.Failed, rep.PassRate, rep.MeanScore)
+	if rep.Baseline != nil {
+		fmt.Fprintf(&b, "Baseline: pass rate %.2f, mean score %.2f (%+.2f)\n", rep.Baseline.PassRate, rep.Baseline.MeanScore, rep.MeanScore-rep.Baseline.MeanScore)
+		if len(rep.Regressions) > 0 {
+			fmt.Fprintf(&b, "Regressions: %s\n", strings.Join(rep.Regressions, ", "))
+		}
+		if len(rep.Fixed) > 0 {
+			fmt.Fprintf(&b, "Fixed: %s\n", strings.Join(rep.Fixed, ", "))
+		}
+	}
+	if rep.OK {
+		b.WriteString("OK\n")
+	} else {
+		b.WriteString("NOT OK\n")
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,183 @@
+package eval
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xyproto/simpleflash"
+)
+
+// fakeRunner returns a Runner that answers with the given answers, keyed by prompt,
+// and that lets a judge reply with the given verdict
+func fakeRunner(answers map[string]string, verdict string) *Runner {
+	return &Runner{
+		Generate: func(ctx context.Context, req simpleflash.Request) (*simpleflash.Response, error) {
+			if strings.HasPrefix(req.Prompt, "You are grading") {
+				if req.Mode != simpleflash.ModeDeterministic || req.ResponseSchema == nil {
+					return nil, context.Canceled
+				}
+				return &simpleflash.Response{Text: verdict}, nil
+			}
+			return &simpleflash.Response{Text: answers[req.Prompt]}, nil
+		},
+		Embed:       (&simpleflash.SimpleFlash{Embedder: &simpleflash.FakeEmbedder{}}).Embed,
+		Concurrency: 2,
+	}
+}
+
+func TestScorers(t *testing.T) {
+	suite := &Suite{
+		Name: "scorers",
+		Cases: []Case{
+			{ID: "exact", Prompt: "capital", Expected: "paris", Scorer: ScorerExact},
+			{ID: "exact-wrong", Prompt: "capital2", Expected: "paris"},
+			{ID: "contains", Prompt: "sentence", Expected: "blue", Scorer: ScorerContains},
+			{ID: "regexp", Prompt: "number", Pattern: `^\d+$`, Scorer: ScorerRegexp},
+			{ID: "similarity", Prompt: "same", Expected: "An identical answer", Scorer: ScorerSimilarity},
+			{ID: "judge", Prompt: "poem", Rubric: "Rhymes", Scorer: ScorerJudge},
+		},
+	}
+	answers := map[string]string{
+		"capital":  "Paris.",
+		"capital2": "Lyon",
+		"sentence": "The sky is Blue today",
+		"number":   "42",
+		"same":     "An identical answer",
+		"poem":     "Roses are red",
+	}
+	report, err := fakeRunner(answers, `{"score": 8, "reason": "it rhymes"}`).Run(context.Background(), suite, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range report.Results {
+		if result.Passed != (result.ID != "exact-wrong") {
+			t.Errorf("unexpected result for %s: %+v", result.ID, result)
+		}
+	}
+	if judge := report.Results[5]; judge.Score != 0.8 || judge.Reason != "it rhymes" {
+		t.Errorf("expected the score and reason of the judge, got %+v", judge)
+	}
+	if report.Passed != 5 || report.Failed != 1 || report.OK {
+		t.Errorf("expected 5 passed, 1 failed and not OK, got %+v", report)
+	}
+
+	passRate := 0.8
+	suite.PassRate = &passRate
+	if report, err = fakeRunner(answers, `{"score": 8}`).Run(context.Background(), suite, nil); err != nil || !report.OK {
+		t.Errorf("expected OK with a pass rate of 0.8, got %+v (%v)", report, err)
+	}
+}
+
+func TestBaseline(t *testing.T) {
+	dir := t.TempDir()
+	suitePath := filepath.Join(dir, "suite.json")
+	err := os.WriteFile(suitePath, []byte(`{
+  "name": "baseline",
+  "max_regression": 0.1,
+  "cases": [
+    {"id": "a", "prompt": "a", "expected": "yes"},
+    {"id": "b", "prompt": "b", "expected": "yes"}
+  ]
+}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	suite, err := LoadSuite(suitePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passRate := 0.5
+	suite.PassRate = &passRate
+
+	baseline, err := fakeRunner(map[string]string{"a": "yes", "b": "no"}, "").Run(context.Background(), suite, nil)
+	if err != nil || !baseline.OK {
+		t.Fatalf("expected an OK baseline, got %+v (%v)", baseline, err)
+	}
+	baselinePath := filepath.Join(dir, "baseline.json")
+	if err := baseline.Save(baselinePath); err != nil {
+		t.Fatal(err)
+	}
+	if baseline, err = LoadReport(baselinePath); err != nil {
+		t.Fatal(err)
+	}
+
+	// One case is fixed and one regressed, so the mean score is the same, but the regression is not OK
+	report, err := fakeRunner(map[string]string{"a": "no", "b": "yes"}, "").Run(context.Background(), suite, baseline)
+	if err != nil || report.OK || report.MeanScore != baseline.MeanScore {
+		t.Fatalf("expected a report with the same mean score that is not OK, got %+v (%v)", report, err)
+	}
+	if strings.Join(report.Regressions, ",") != "a" || strings.Join(report.Fixed, ",") != "b" {
+		t.Errorf("expected a to regress and b to be fixed, got %v and %v", report.Regressions, report.Fixed)
+	}
+
+	// Both cases pass, so nothing regressed
+	if report, err = fakeRunner(map[string]string{"a": "yes", "b": "yes"}, "").Run(context.Background(), suite, baseline); err != nil || !report.OK {
+		t.Errorf("expected an OK report when a case is fixed, got %+v (%v)", report, err)
+	}
+
+	// Both cases fail, so the mean score drops by 0.5
+	if report, err = fakeRunner(nil, "").Run(context.Background(), suite, baseline); err != nil || report.OK {
+		t.Errorf("expected the regression to make the report not OK, got %+v (%v)", report, err)
+	}
+	var b strings.Builder
+	if err := report.WriteText(&b); err != nil || !strings.Contains(b.String(), "Regressions: a") || !strings.HasSuffix(b.String(), "NOT OK\n") {
+		t.Errorf("unexpected text report %q (%v)", b.String(), err)
+	}
+}
+
+func TestLoadYAMLSuite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "suite.yml")
+	yamlSuite := `name: capitals
+judge_model: gemini-1.5-pro
+pass_rate: 0.5
+cases:
+  - id: norway
+    prompt: What is the capital of Norway?
+    expected: Oslo
+  - id: france
+    prompt: What is the capital of France?
+    scorer: judge
+    rubric: Mentions Paris
+    threshold: 0.9
+`
+	if err := os.WriteFile(path, []byte(yamlSuite), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	suite, err := LoadSuite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if suite.Name != "capitals" || suite.JudgeModel != "gemini-1.5-pro" || *suite.PassRate != 0.5 || len(suite.Cases) != 2 {
+		t.Fatalf("unexpected suite %+v", suite)
+	}
+	if c := suite.Cases[1]; c.ID != "france" || c.Scorer != ScorerJudge || c.Rubric != "Mentions Paris" || *c.Threshold != 0.9 {
+		t.Errorf("unexpected case %+v", c)
+	}
+}
+
+func TestLoadSuiteErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"suite.yaml":       "name: x",
+		"not-yaml.yml":     "cases: [",
+		"empty.json":       `{"cases": []}`,
+		"duplicate.json":   `{"cases": [{"id": "a", "prompt": "x", "expected": "y"}, {"id": "a", "prompt": "x", "expected": "y"}]}`,
+		"pattern.json":     `{"cases": [{"id": "a", "prompt": "x", "scorer": "regexp", "pattern": "("}]}`,
+		"unknown.json":     `{"cases": [{"id": "a", "prompt": "x", "scorer": "vibes"}]}`,
+		"judge.json":       `{"cases": [{"id": "a", "prompt": "x", "scorer": "judge"}]}`,
+		"no-prompt.json":   `{"cases": [{"id": "a", "expected": "y"}]}`,
+		"not-json.json":    `cases:`,
+		"no-expected.json": `{"cases": [{"id": "a", "prompt": "x"}]}`,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadSuite(path); err == nil {
+			t.Errorf("expected an error for %s", name)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package simpleflash
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// ExtractOptions are the settings of a call to Extract
+type ExtractOptions struct {
+	Instructions string // optional guidance, like how to handle missing values
+	Model        string // if empty, sf.ModelName is used
+}
+
+// extractPrompt asks for the fields of a JSON object
+const extractPrompt = `Extract the information in the text below as a JSON object that matches the given schema.
+Use null, or leave out the field, for information that is not in the text.
+%s
+Text:
+%s`
+
+// Extract fills a value of type T, usually a struct, with information from unstructured text.
+// A response schema is made from the type: the fields are named like with encoding/json, fields
+// without omitempty that are not pointers are required, and a `description:"..."` struct tag
+// describes a field to the model. Answers that can not be decoded are rejected and asked for again.
+func Extract[T any](ctx context.Context, sf *SimpleFlash, text string, opts ExtractOptions) (T, error) {
+	var value T
+	schema, err := SchemaFor(reflect.TypeOf(value))
+	if err != nil {
+		return value, err
+	}
+	var instructions string
+	if opts.Instructions != "" {
+		instructions = strings.TrimSpace(opts.Instructions) + "\n"
+	}
+	req := Request{
+		Prompt:         fmt.Sprintf(extractPrompt, instructions, text),
+		Model:          opts.Model,
+		Mode:           ModeDeterministic,
+		ResponseSchema: schema,
+		Processors: []Processor{func(answer string) (string, error) {
+			var v T
+			answer = jsonText(answer)
+			if err := json.Unmarshal([]byte(answer), &v); err != nil {
+				return "", invalid(answer, "the answer must be JSON that matches the schema: %v", err)
+			}
+			return answer, nil
+		}},
+	}
+	if sf.ValidationRetries == 0 {
+		req.ValidationRetries = structuredRetries
+	}
+	res, err := sf.Generate(ctx, req)
+	if err != nil {
+		return value, err
+	}
+	if err := json.Unmarshal([]byte(res.Text), &value); err != nil {
+		return value, fmt.Errorf("failed to decode the extracted information: %v", err)
+	}
+	return value, nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// SchemaFor returns a response schema for values of the given type, as they are encoded by encoding/json.
+// Maps, interfaces, channels, functions and recursive types are not supported.
+func SchemaFor(t reflect.Type) (*genai.Schema, error) {
+	return schemaFor(t, make(map[reflect.Type]bool))
+}
+
+// schemaFor returns a response schema for the type. The struct types that are being visited are in parents.
+func schemaFor(t reflect.Type, parents map[reflect.Type]bool) (*genai.Schema, error) {
+	if t == nil {
+		return nil, errors.New("can not make a schema for a nil interface")
+	}
+	switch {
+	case t == timeType:
+		return &genai.Schema{Type: genai.TypeString, Description: "an RFC 3339 date and time"}, nil
+	case t.Kind() == reflect.Pointer:
+		schema, err := schemaFor(t.Elem(), parents)
+		if err != nil {
+			return nil, err
+		}
+		schema.Nullable = true
+		return schema, nil
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return &genai.Schema{Type: genai.TypeString}, nil
+	case reflect.Bool:
+		return &genai.Schema{Type: genai.TypeBoolean}, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &genai.Schema{Type: genai.TypeInteger}, nil
+	case reflect.Float32, reflect.Float64:
+		return &genai.Schema{Type: genai.TypeNumber}, nil
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &genai.Schema{Type: genai.TypeString, Format: "byte"}, nil
+		}
+		items, err := schemaFor(t.Elem(), parents)
+		if err != nil {
+			return nil, err
+		}
+		return &genai.Schema{Type: genai.TypeArray, Items: items}, nil
+	case reflect.Struct:
+		if parents[t] {
+			return nil, fmt.Errorf("can not make a schema for the recursive type %s", t)
+		}
+		parents[t] = true
+		defer delete(parents, t)
+		schema := &genai.Schema{Type: genai.TypeObject, Properties: make(map[string]*genai.Schema)}
+		if err := addFields(schema, t, parents); err != nil {
+			return nil, err
+		}
+		return schema, nil
+	}
+	return nil, fmt.Errorf("can not make a schema for the type %s", t)
+}
+
+// addFields adds the exported fields of the struct type to the properties of the schema.
+// Embedded structs without a JSON name are flattened, like encoding/json does.
+func addFields(schema *genai.Schema, t reflect.Type, parents map[reflect.Type]bool) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				if err := addFields(schema, embedded, parents); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fieldSchema, err := schemaFor(field.Type, parents)
+		if err != nil {
+			return fmt.Errorf("field %s: %w", field.Name, err)
+		}
+		if description := field.Tag.Get("description"); description != "" {
+			fieldSchema.Description = description
+		}
+		schema.Properties[name] = fieldSchema
+		if !fieldSchema.Nullable && !strings.Contains(","+options+",", ",omitempty,") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	return nil
+}
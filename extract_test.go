@@ -0,0 +1,73 @@
+package simpleflash
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// invoice is extracted in the tests
+type invoice struct {
+	Number   string     `json:"number" description:"the invoice number"`
+	Total    float64    `json:"total"`
+	Paid     bool       `json:"paid,omitempty"`
+	Due      *time.Time `json:"due"`
+	Lines    []line     `json:"lines"`
+	internal string
+}
+
+type line struct {
+	Item     string `json:"item"`
+	Quantity int    `json:"quantity"`
+}
+
+func TestSchemaFor(t *testing.T) {
+	schema, err := SchemaFor(reflect.TypeOf(invoice{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schema.Type != genai.TypeObject || len(schema.Properties) != 5 || !slices.Equal(schema.Required, []string{"number", "total", "lines"}) {
+		t.Errorf("unexpected schema %+v", schema)
+	}
+	if number := schema.Properties["number"]; number.Type != genai.TypeString || number.Description != "the invoice number" {
+		t.Errorf("unexpected schema for the number %+v", number)
+	}
+	if due := schema.Properties["due"]; due.Type != genai.TypeString || !due.Nullable {
+		t.Errorf("expected a nullable string for the time, got %+v", due)
+	}
+	if items := schema.Properties["lines"].Items; items == nil || items.Properties["quantity"].Type != genai.TypeInteger {
+		t.Errorf("unexpected schema for the lines %+v", items)
+	}
+
+	type node struct {
+		Children []node
+	}
+	for _, v := range []any{map[string]int{}, node{}, struct{ F func() }{}} {
+		if _, err := SchemaFor(reflect.TypeOf(v)); err == nil {
+			t.Errorf("expected an error for %T", v)
+		}
+	}
+}
+
+func TestExtract(t *testing.T) {
+	text := "Invoice 17: 2 apples, 12.50 in total, due 2024-07-01"
+	schema, err := SchemaFor(reflect.TypeOf(invoice{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf := replayFor(t, map[*Request]string{
+		{Prompt: fmt.Sprintf(extractPrompt, "", text), Mode: ModeDeterministic, ResponseSchema: schema}: `{"number": "17", "total": 12.5, "due": "2024-07-01T00:00:00Z", "lines": [{"item": "apple", "quantity": 2}]}`,
+	})
+	inv, err := Extract[invoice](context.Background(), sf, text, ExtractOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.Number != "17" || inv.Total != 12.5 || inv.Due == nil || inv.Due.Month() != time.July || len(inv.Lines) != 1 || inv.Lines[0].Quantity != 2 {
+		t.Errorf("unexpected invoice %+v", inv)
+	}
+}
@@ -0,0 +1,316 @@
+package simpleflash
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // GIF images can be given, and are sent as PNG
+	"image/jpeg"
+	"image/png"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// DefaultMaxImageDimension is the longest side, in pixels, that images are scaled down to
+// before they are sent, if ImageOptions.MaxDimension is 0
+const DefaultMaxImageDimension = 2048
+
+// DefaultJPEGQuality is the quality of the JPEG images that are sent, if ImageOptions.Quality is 0
+const DefaultJPEGQuality = 85
+
+// maxImagePixels is the largest number of pixels in an image.Image that the image helpers accept
+const maxImagePixels = 100_000_000
+
+// minImageDimension is the smallest longest side that an image is scaled down to, to fit the inline data limit
+const minImageDimension = 64
+
+// ImageFormat is the format that images are sent in
+type ImageFormat string
+
+const (
+	ImageAuto ImageFormat = ""     // JPEG images are sent as JPEG, and other images as PNG, unless JPEG is needed to fit the limit
+	ImageJPEG ImageFormat = "jpeg" // smaller, and good for photos
+	ImagePNG  ImageFormat = "png"  // lossless, and good for screenshots and text
+)
+
+// TextLayout is how ExtractTextFromImage lays out the text it finds
+type TextLayout int
+
+const (
+	LayoutLines      TextLayout = iota // the lines as they are in the image, in reading order
+	LayoutParagraphs                   // lines that belong together are joined into paragraphs
+	LayoutMarkdown                     // headings, lists and tables are written as Markdown
+)
+
+// ImageOptions are the settings of DescribeImage, ExtractTextFromImage and CompareImages
+type ImageOptions struct {
+	Instructions string      // optional guidance, like "Focus on the people" or "The image is a receipt"
+	Model        string      // if empty, sf.MultiModalModelName is used
+	MaxDimension int         // the longest side of the images in pixels, DefaultMaxImageDimension if 0
+	Format       ImageFormat // the format the images are sent in
+	Quality      int         // the quality of JPEG images, from 1 to 100, DefaultJPEGQuality if 0
+	Layout       TextLayout  // used by ExtractTextFromImage
+}
+
+// ImageComparison is the result of CompareImages
+type ImageComparison struct {
+	Similar     bool     `json:"similar"`     // true if the images show the same subject
+	Similarity  float64  `json:"similarity"`  // from 0 (unrelated) to 1 (identical)
+	Differences []string `json:"differences"` // the differences, most important first
+	Summary     string   `json:"summary"`
+}
+
+// Prompts that are used by the image helpers
+const (
+	describeImagePrompt = "Describe this image in detail: what it shows, the setting, the colors, and any text in it."
+	compareImagesPrompt = "Compare the two images. Tell if they show the same subject, how similar they are from 0 (unrelated) to 1 (identical), what the differences are, most important first, and summarize the comparison."
+)
+
+// extractTextPrompts are the prompts of ExtractTextFromImage, for each layout
+var extractTextPrompts = map[TextLayout]string{
+	LayoutLines:      "Extract all text in this image, exactly as it is written. Keep the line breaks, and put the lines in reading order, column by column. Reply with only the text.",
+	LayoutParagraphs: "Extract all text in this image, exactly as it is written. Join lines that belong to the same paragraph, and separate paragraphs with a blank line. Reply with only the text.",
+	LayoutMarkdown:   "Extract all text in this image, exactly as it is written, as Markdown. Use headings for headings, lists for lists and tables for tables, and keep the reading order. Reply with only the Markdown.",
+}
+
+// DescribeImage describes an image. The image can be a file path, an image.Image, or a JPEG, PNG or GIF image
+// as []byte. The image is scaled down and converted before it is sent, and the description is cached by the
+// content of the image.
+func (sf *SimpleFlash) DescribeImage(ctx context.Context, img any, opts ImageOptions) (string, error) {
+	return sf.askAboutImages(ctx, "describe", describeImagePrompt, Request{}, opts, img)
+}
+
+// ExtractTextFromImage returns the text in an image (OCR), laid out according to opts.Layout.
+// The image is given and handled like for DescribeImage.
+func (sf *SimpleFlash) ExtractTextFromImage(ctx context.Context, img any, opts ImageOptions) (string, error) {
+	prompt, ok := extractTextPrompts[opts.Layout]
+	if !ok {
+		return "", fmt.Errorf("unknown text layout %d", opts.Layout)
+	}
+	return sf.askAboutImages(ctx, "ocr", prompt, Request{Mode: ModeDeterministic}, opts, img)
+}
+
+// CompareImages compares two images. The images are given and handled like for DescribeImage,
+// and each one gets half of the inline data limit of the model.
+func (sf *SimpleFlash) CompareImages(ctx context.Context, a, b any, opts ImageOptions) (*ImageComparison, error) {
+	schema, err := SchemaFor(reflect.TypeOf(ImageComparison{}))
+	if err != nil {
+		return nil, err
+	}
+	req := Request{
+		Mode:           ModeDeterministic,
+		ResponseSchema: schema,
+		Processors: []Processor{func(answer string) (string, error) {
+			var comparison ImageComparison
+			answer = jsonText(answer)
+			if err := json.Unmarshal([]byte(answer), &comparison); err != nil {
+				return "", invalid(answer, "the answer must be JSON that matches the schema: %v", err)
+			}
+			return answer, nil
+		}},
+	}
+	if sf.ValidationRetries == 0 {
+		req.ValidationRetries = structuredRetries
+	}
+	text, err := sf.askAboutImages(ctx, "compare", compareImagesPrompt, req, opts, a, b)
+	if err != nil {
+		return nil, err
+	}
+	var comparison ImageComparison
+	if err := json.Unmarshal([]byte(text), &comparison); err != nil {
+		return nil, fmt.Errorf("failed to decode the comparison: %v", err)
+	}
+	comparison.Similarity = min(max(comparison.Similarity, 0), 1)
+	return &comparison, nil
+}
+
+// askAboutImages sends the prompt with the images, and returns the answer. The images are identified
+// in the cache key by their content and the options, instead of by the converted images.
+func (sf *SimpleFlash) askAboutImages(ctx context.Context, task, prompt string, req Request, opts ImageOptions, sources ...any) (string, error) {
+	modelName := opts.Model
+	if modelName == "" {
+		modelName = sf.MultiModalModelName
+	}
+	if modelName == "" {
+		return "", errors.New("no multimodal model is configured")
+	}
+	if opts.Instructions != "" {
+		prompt += "\n" + strings.TrimSpace(opts.Instructions)
+	}
+	limits, _ := sf.LimitsFor(modelName)
+	maxBytes := limits.MaxInlineData / len(sources)
+	h := sha256.New()
+	fmt.Fprintf(h, "image\x00%s\x00%d\x00%s\x00%d\x00%d", task, opts.MaxDimension, opts.Format, opts.Quality, maxBytes)
+	for i, source := range sources {
+		data, err := loadImage(source)
+		if err != nil {
+			return "", fmt.Errorf("image %d: %w", i+1, err)
+		}
+		fmt.Fprintf(h, "\x00%x", sha256.Sum256(data))
+		attachment, err := normalizeImage(data, opts, maxBytes)
+		if err != nil {
+			return "", fmt.Errorf("image %d: %w", i+1, err)
+		}
+		req.Attachments = append(req.Attachments, attachment)
+	}
+	req.Prompt = prompt
+	req.Model = modelName
+	req.attachmentDigest = fmt.Sprintf("%x", h.Sum(nil))
+	res, err := sf.Generate(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	return res.Text, nil
+}
+
+// loadImage returns the encoded image for a file path, an image.Image or a []byte.
+// An image.Image is encoded as PNG, so that equal images have the same content hash.
+func loadImage(source any) ([]byte, error) {
+	switch source := source.(type) {
+	case string:
+		data, err := os.ReadFile(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the image: %w", err)
+		}
+		return loadImage(data)
+	case []byte:
+		if len(source) == 0 {
+			return nil, errors.New("the image is empty")
+		}
+		return source, nil
+	case image.Image:
+		bounds := source.Bounds()
+		if bounds.Empty() || bounds.Dx() > maxImagePixels/bounds.Dy() {
+			return nil, fmt.Errorf("the image must have between 1 and %d pixels, not %dx%d", maxImagePixels, bounds.Dx(), bounds.Dy())
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, source); err != nil {
+			return nil, fmt.Errorf("failed to encode the image: %v", err)
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unsupported image type %T, use a file path, an image.Image or a []byte", source)
+}
+
+// normalizeImage scales the image down to opts.MaxDimension and converts it to the format in opts. If the image
+// is larger than maxBytes, it is made smaller, with a lower JPEG quality or fewer pixels, until it fits.
+// Images that already fit, and are in the right format, are returned as they are. If maxBytes is 0, there is no limit.
+func normalizeImage(data []byte, opts ImageOptions, maxBytes int) (Attachment, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to decode the image: %v", err)
+	}
+	// Check the size from the header, before the pixels are decoded into memory
+	if config.Width <= 0 || config.Height <= 0 || config.Width > maxImagePixels/config.Height {
+		return Attachment{}, fmt.Errorf("the image must have between 1 and %d pixels, not %dx%d", maxImagePixels, config.Width, config.Height)
+	}
+	maxDimension := opts.MaxDimension
+	if maxDimension <= 0 {
+		maxDimension = DefaultMaxImageDimension
+	}
+	longest := max(config.Width, config.Height)
+	if (format == "jpeg" || format == "png") && (opts.Format == ImageAuto || string(opts.Format) == format) &&
+		longest <= maxDimension && (maxBytes <= 0 || len(data) <= maxBytes) {
+		return Attachment{MIMEType: "image/" + format, Data: data}, nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to decode the image: %v", err)
+	}
+	out := opts.Format
+	if out == ImageAuto {
+		out = ImagePNG
+		if format == "jpeg" {
+			out = ImageJPEG
+		}
+	}
+	quality := opts.Quality
+	if quality <= 0 {
+		quality = DefaultJPEGQuality
+	}
+	dimension := min(maxDimension, longest)
+	for {
+		encoded, err := encodeImage(resizeImage(img, dimension), out, quality)
+		if err != nil {
+			return Attachment{}, err
+		}
+		if maxBytes <= 0 || len(encoded) <= maxBytes {
+			return Attachment{MIMEType: "image/" + string(out), Data: encoded}, nil
+		}
+		switch {
+		case opts.Format == ImageAuto && out == ImagePNG:
+			out = ImageJPEG // much smaller for photos
+		case out == ImageJPEG && quality > 50:
+			quality = max(quality-15, 50)
+		default:
+			dimension = dimension * 3 / 4
+		}
+		if dimension < minImageDimension {
+			return Attachment{}, fmt.Errorf("the image can not be made smaller than %d bytes", maxBytes)
+		}
+	}
+}
+
+// encodeImage encodes the image as JPEG or PNG. Transparent parts are made white in JPEG images.
+func encodeImage(img image.Image, format ImageFormat, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case ImagePNG:
+		err = png.Encode(&buf, img)
+	case ImageJPEG:
+		if o, ok := img.(interface{ Opaque() bool }); !ok || !o.Opaque() {
+			background := image.NewRGBA(img.Bounds())
+			draw.Draw(background, background.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+			draw.Draw(background, background.Bounds(), img, img.Bounds().Min, draw.Over)
+			img = background
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	default:
+		return nil, fmt.Errorf("unsupported image format %q, use %q or %q", format, ImageJPEG, ImagePNG)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the image: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// resizeImage scales the image down, so that the longest side is at most maxDimension pixels.
+// Each new pixel is the average of the pixels it covers.
+func resizeImage(img image.Image, maxDimension int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if max(w, h) <= maxDimension {
+		return img
+	}
+	nw, nh := maxDimension, max(h*maxDimension/w, 1)
+	if h > w {
+		nw, nh = max(w*maxDimension/h, 1), maxDimension
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, nw, nh))
+	for y := 0; y < nh; y++ {
+		y0 := bounds.Min.Y + y*h/nh
+		y1 := max(bounds.Min.Y+(y+1)*h/nh, y0+1)
+		for x := 0; x < nw; x++ {
+			x0 := bounds.Min.X + x*w/nw
+			x1 := max(bounds.Min.X+(x+1)*w/nw, x0+1)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
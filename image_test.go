@@ -0,0 +1,106 @@
+package simpleflash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// testImage returns an image of the given size, with noise if noisy is true
+func testImage(w, h int, noisy bool) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	rng := rand.New(rand.NewSource(1))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255}
+			if noisy {
+				c.R, c.G, c.B = uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256))
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestNormalizeImage(t *testing.T) {
+	small, err := loadImage(testImage(100, 50, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachment, err := normalizeImage(small, ImageOptions{}, 0)
+	if err != nil || attachment.MIMEType != "image/png" || !bytes.Equal(attachment.Data, small) {
+		t.Errorf("expected a small PNG image to be sent as it is, got %s (%v)", attachment.MIMEType, err)
+	}
+
+	// Large images are scaled down
+	large, _ := loadImage(testImage(3000, 1000, false))
+	attachment, err = normalizeImage(large, ImageOptions{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config, format, err := image.DecodeConfig(bytes.NewReader(attachment.Data)); err != nil || format != "png" || config.Width != 2048 || config.Height != 682 {
+		t.Errorf("expected a 2048x682 PNG image, got a %dx%d %s image (%v)", config.Width, config.Height, format, err)
+	}
+
+	// Images are converted to the given format
+	attachment, err = normalizeImage(small, ImageOptions{Format: ImageJPEG, MaxDimension: 40}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config, format, err := image.DecodeConfig(bytes.NewReader(attachment.Data)); err != nil || attachment.MIMEType != "image/jpeg" || format != "jpeg" || config.Width != 40 {
+		t.Errorf("expected a JPEG image that is 40 pixels wide, got %s %+v (%v)", attachment.MIMEType, config, err)
+	}
+
+	// Images that are too large are made smaller, until they fit
+	noisy, _ := loadImage(testImage(400, 400, true))
+	attachment, err = normalizeImage(noisy, ImageOptions{}, 20000)
+	if err != nil || attachment.MIMEType != "image/jpeg" || len(attachment.Data) > 20000 {
+		t.Errorf("expected a JPEG image of at most 20000 bytes, got %s of %d bytes (%v)", attachment.MIMEType, len(attachment.Data), err)
+	}
+	if _, err := normalizeImage(noisy, ImageOptions{Format: ImagePNG}, 100); err == nil {
+		t.Error("expected an error for an image that can not be made small enough")
+	}
+
+	// GIF images are sent as PNG
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, testImage(10, 10, false), nil); err != nil {
+		t.Fatal(err)
+	}
+	if attachment, err = normalizeImage(buf.Bytes(), ImageOptions{}, 0); err != nil || attachment.MIMEType != "image/png" {
+		t.Errorf("expected a GIF image to be converted to PNG, got %s (%v)", attachment.MIMEType, err)
+	}
+	if _, err := png.Decode(bytes.NewReader(attachment.Data)); err != nil {
+		t.Error(err)
+	}
+
+	// Images with too many pixels are rejected from the header, before they are decoded
+	buf.Reset()
+	if err := png.Encode(&buf, testImage(1, 1, false)); err != nil {
+		t.Fatal(err)
+	}
+	bomb := buf.Bytes()
+	binary.BigEndian.PutUint32(bomb[16:], 100_000)
+	binary.BigEndian.PutUint32(bomb[20:], 100_000)
+	binary.BigEndian.PutUint32(bomb[29:], crc32.ChecksumIEEE(bomb[12:29]))
+	if _, err := normalizeImage(bomb, ImageOptions{}, 0); err == nil || !strings.Contains(err.Error(), "100000x100000") {
+		t.Errorf("expected an error for an image of 100000x100000 pixels, got %v", err)
+	}
+}
+
+func TestLoadImage(t *testing.T) {
+	for _, source := range []any{42, []byte{}, "no-such-file.png", nil, image.NewUniform(color.Black), image.NewRGBA(image.Rectangle{})} {
+		if _, err := loadImage(source); err == nil {
+			t.Errorf("expected an error for %#v", source)
+		}
+	}
+	if _, err := normalizeImage([]byte("not an image"), ImageOptions{}, 0); err == nil {
+		t.Error("expected an error for data that is not an image")
+	}
+}
@@ -0,0 +1,88 @@
+// Package resp reads and writes values in the Redis protocol (RESP), for simpleflash.RedisKV
+// and the Redis server in simpleflashtest
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Error is an error reply, like "ERR unknown command"
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Read reads a value: nil, a string, an int64, a []byte or an []any. Error replies are returned as an Error.
+func Read(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid RESP line %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, Error(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]any, n)
+		for i := range values {
+			if values[i], err = Read(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("invalid RESP type %q", kind)
+}
+
+// Write writes a value: nil, a string, an Error, an int64, a []byte or an []any of these
+func Write(w *bufio.Writer, value any) error {
+	switch value := value.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case string:
+		w.WriteString("+" + value + "\r\n")
+	case Error:
+		w.WriteString("-" + string(value) + "\r\n")
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", value)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n", len(value))
+		w.Write(value)
+		w.WriteString("\r\n")
+	case []any:
+		fmt.Fprintf(w, "*%d\r\n", len(value))
+		for _, v := range value {
+			if err := Write(w, v); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported RESP value of type %T", value)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package simpleflash
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/allegro/bigcache/v3"
+)
+
+// ErrCacheMiss is returned by KV.Get and KV.TTL when there is no entry with the given key
+var ErrCacheMiss = errors.New("cache miss")
+
+// KV is a key-value store that is used as the cache of responses and embeddings.
+// It can be shared by several processes, like with RedisKV. Implementations must be safe for concurrent use.
+type KV interface {
+	// Get returns the value with the given key, or ErrCacheMiss
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores the value with the given key. It expires after ttl, or never if ttl is 0.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Delete removes the value with the given key, if there is one
+	Delete(ctx context.Context, key string) error
+	// TTL returns the time until the value with the given key expires, 0 if it does not expire, or ErrCacheMiss
+	TTL(ctx context.Context, key string) (time.Duration, error)
+}
+
+// MemoryKV is a KV that keeps the entries in memory, in a BigCache
+type MemoryKV struct {
+	cache *bigcache.BigCache
+}
+
+// NewMemoryKV creates a MemoryKV that keeps entries for at most the given lifetime,
+// and uses at most maxSize megabytes, or any amount of memory if maxSize is 0
+func NewMemoryKV(lifetime time.Duration, maxSize int) (*MemoryKV, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	config := bigcache.DefaultConfig(lifetime)
+	config.HardMaxCacheSize = maxSize
+	config.StatsEnabled = false
+	config.Verbose = false
+
+	cache, err := bigcache.New(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryKV{cache: cache}, nil
+}
+
+// NewMemoryKVFromBigCache creates a MemoryKV that keeps the entries in the given BigCache.
+// It helps code that set SimpleFlash.Cache to a *bigcache.BigCache before the cache became a KV:
+// use sf.Cache = simpleflash.NewMemoryKVFromBigCache(cache) instead of sf.Cache = cache.
+func NewMemoryKVFromBigCache(cache *bigcache.BigCache) *MemoryKV {
+	return &MemoryKV{cache: cache}
+}
+
+// BigCache returns the BigCache that the entries are kept in. The values in it start with the time they expire.
+func (m *MemoryKV) BigCache() *bigcache.BigCache {
+	return m.cache
+}
+
+// Get returns the value with the given key, or ErrCacheMiss
+func (m *MemoryKV) Get(_ context.Context, key string) ([]byte, error) {
+	value, expires, err := m.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !expires.IsZero() && !time.Now().Before(expires) {
+		_ = m.cache.Delete(key)
+		return nil, ErrCacheMiss
+	}
+	return value, nil
+}
+
+// Set stores the value with the given key. The lifetime of the MemoryKV is an upper bound for ttl.
+func (m *MemoryKV) Set(_ context.Context, key string, value []byte, ttl time.Duration) error {
+	// Each entry starts with the time it expires, in Unix nanoseconds, or 0
+	var expires int64
+	if ttl > 0 {
+		expires = time.Now().Add(ttl).UnixNano()
+	}
+	entry := binary.LittleEndian.AppendUint64(make([]byte, 0, 8+len(value)), uint64(expires))
+	return m.cache.Set(key, append(entry, value...))
+}
+
+// Delete removes the value with the given key, if there is one
+func (m *MemoryKV) Delete(_ context.Context, key string) error {
+	if err := m.cache.Delete(key); err != nil && !errors.Is(err, bigcache.ErrEntryNotFound) {
+		return err
+	}
+	return nil
+}
+
+// TTL returns the time until the value with the given key expires, 0 if it does not expire, or ErrCacheMiss
+func (m *MemoryKV) TTL(_ context.Context, key string) (time.Duration, error) {
+	_, expires, err := m.get(key)
+	if err != nil {
+		return 0, err
+	}
+	if expires.IsZero() {
+		return 0, nil
+	}
+	if ttl := time.Until(expires); ttl > 0 {
+		return ttl, nil
+	}
+	return 0, ErrCacheMiss
+}
+
+// Stats returns the number of entries and the hits, misses and collisions of the cache
+func (m *MemoryKV) Stats() CacheStats {
+	stats := m.cache.Stats()
+	return CacheStats{Entries: m.cache.Len(), Hits: stats.Hits, Misses: stats.Misses, Collisions: stats.Collisions}
+}
+
+// cacheStats returns the statistics of the given KV, if it can report them.
+// KVs that wrap another KV, like CompressedKV, report the statistics of the wrapped KV.
+func cacheStats(kv KV) (CacheStats, bool) {
+	for {
+		switch c := kv.(type) {
+		case interface{ Stats() CacheStats }:
+			return c.Stats(), true
+		case interface{ Unwrap() KV }:
+			kv = c.Unwrap()
+		default:
+			return CacheStats{}, false
+		}
+	}
+}
+
+// get returns the value with the given key, and when it expires
+func (m *MemoryKV) get(key string) ([]byte, time.Time, error) {
+	entry, err := m.cache.Get(key)
+	if errors.Is(err, bigcache.ErrEntryNotFound) {
+		return nil, time.Time{}, ErrCacheMiss
+	} else if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(entry) < 8 {
+		return nil, time.Time{}, ErrCacheMiss
+	}
+	var expires time.Time
+	if nanos := int64(binary.LittleEndian.Uint64(entry)); nanos != 0 {
+		expires = time.Unix(0, nanos)
+	}
+	return entry[8:], expires, nil
+}
+
+// DefaultCompressionThreshold is the size, in bytes, above which CompressedKV compresses values
+const DefaultCompressionThreshold = 1024
+
+// Headers of the values that are stored by CompressedKV
+const (
+	uncompressedValue byte = 0
+	gzipValue         byte = 1
+)
+
+// CompressedKV is a KV that compresses large values with gzip before they are stored in another KV
+type CompressedKV struct {
+	KV
+	Threshold int // values larger than this many bytes are compressed
+}
+
+// NewCompressedKV wraps the given KV, and compresses values larger than DefaultCompressionThreshold
+func NewCompressedKV(kv KV) *CompressedKV {
+	return &CompressedKV{KV: kv, Threshold: DefaultCompressionThreshold}
+}
+
+// Unwrap returns the KV that the compressed values are stored in
+func (c *CompressedKV) Unwrap() KV {
+	return c.KV
+}
+
+// Get returns the value with the given key, decompressed, or ErrCacheMiss
+func (c *CompressedKV) Get(ctx context.Context, key string) ([]byte, error) {
+	stored, err := c.KV.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(stored) == 0 {
+		return nil, ErrCacheMiss
+	}
+	switch stored[0] {
+	case uncompressedValue:
+		return stored[1:], nil
+	case gzipValue:
+		r, err := gzip.NewReader(bytes.NewReader(stored[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress cache entry: %v", err)
+		}
+		value, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress cache entry: %v", err)
+		}
+		return value, nil
+	}
+	return nil, fmt.Errorf("unknown cache entry header %d", stored[0])
+}
+
+// Set stores the value with the given key, compressed if it is larger than c.Threshold
+func (c *CompressedKV) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if len(value) <= c.Threshold {
+		return c.KV.Set(ctx, key, append([]byte{uncompressedValue}, value...), ttl)
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(gzipValue)
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(value); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.KV.Set(ctx, key, buf.Bytes(), ttl)
+}
@@ -0,0 +1,111 @@
+package simpleflash
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMemoryKV(t *testing.T) {
+	ctx := context.Background()
+	kv, err := NewMemoryKV(time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.Get(ctx, "missing"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected ErrCacheMiss, got %v", err)
+	}
+	kv.Set(ctx, "forever", []byte("a"), 0)
+	kv.Set(ctx, "short", []byte("b"), 20*time.Millisecond)
+	if ttl, err := kv.TTL(ctx, "forever"); err != nil || ttl != 0 {
+		t.Errorf("expected no expiry, got %v (%v)", ttl, err)
+	}
+	if ttl, err := kv.TTL(ctx, "short"); err != nil || ttl <= 0 || ttl > 20*time.Millisecond {
+		t.Errorf("expected a short ttl, got %v (%v)", ttl, err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := kv.Get(ctx, "short"); !errors.Is(err, ErrCacheMiss) {
+		t.Errorf("expected the entry to expire, got %v", err)
+	}
+	if value, err := kv.Get(ctx, "forever"); err != nil || string(value) != "a" {
+		t.Errorf("expected the entry, got %q (%v)", value, err)
+	}
+	if err := kv.Delete(ctx, "forever"); err != nil {
+		t.Error(err)
+	}
+	if err := kv.Delete(ctx, "forever"); err != nil {
+		t.Errorf("expected deleting a missing entry to succeed, got %v", err)
+	}
+	if stats := kv.Stats(); stats.Entries != 0 {
+		t.Errorf("expected no entries, got %d", stats.Entries)
+	}
+}
+
+func TestCompressedKV(t *testing.T) {
+	ctx := context.Background()
+	memory, err := NewMemoryKV(time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := NewCompressedKV(memory)
+	large := bytes.Repeat([]byte("moo "), 1000)
+	for key, value := range map[string][]byte{"small": []byte("moo"), "large": large} {
+		if err := kv.Set(ctx, key, value, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := kv.Get(ctx, key); err != nil || !bytes.Equal(got, value) {
+			t.Errorf("expected the value of %s, got %d bytes (%v)", key, len(got), err)
+		}
+	}
+	if stored, _ := memory.Get(ctx, "large"); len(stored) >= len(large)/10 {
+		t.Errorf("expected the large value to be compressed, got %d bytes", len(stored))
+	}
+	if ttl, err := kv.TTL(ctx, "large"); err != nil || ttl <= 0 {
+		t.Errorf("expected the ttl of the underlying store, got %v (%v)", ttl, err)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	memory, err := NewMemoryKV(time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory.Set(context.Background(), "key", []byte("value"), 0)
+	if stats, ok := cacheStats(NewCompressedKV(memory)); !ok || stats.Entries != 1 {
+		t.Errorf("expected the statistics of the wrapped cache, got %+v (%v)", stats, ok)
+	}
+	if _, ok := cacheStats(NewCompressedKV(NewRedisKV("localhost:0"))); ok {
+		t.Error("expected no statistics for a cache that can not report them")
+	}
+	if kv := NewMemoryKVFromBigCache(memory.BigCache()); kv.Stats().Entries != 1 {
+		t.Error("expected the MemoryKV to use the given BigCache")
+	}
+}
+
+func TestRedisKVTimeout(t *testing.T) {
+	// A server that accepts connections, but never replies
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	kv := NewRedisKV(listener.Addr().String())
+	kv.Timeout = 50 * time.Millisecond
+	defer kv.Close()
+	if _, err := kv.Get(context.Background(), "key"); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected the command to time out, got %v", err)
+	}
+}
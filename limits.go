@@ -0,0 +1,60 @@
+package simpleflash
+
+import (
+	"sort"
+	"strings"
+)
+
+// ModelLimits describes the size limits of a Gemini model.
+// A zero value means that the limit is unknown, and that it will not be checked.
+type ModelLimits struct {
+	ContextWindow int // maximum number of input tokens
+	MaxOutput     int // maximum number of output tokens
+	MaxInlineData int // maximum number of bytes of inline (base64) data per request
+}
+
+// DefaultModelLimits contains the known limits for the Gemini models, keyed by model name.
+// Versioned model names, like "gemini-1.5-flash-001", are matched by the longest prefix.
+var DefaultModelLimits = map[string]ModelLimits{
+	"gemini-1.0-pro":        {ContextWindow: 32760, MaxOutput: 8192},
+	"gemini-1.0-pro-vision": {ContextWindow: 16384, MaxOutput: 2048, MaxInlineData: 20 * 1024 * 1024},
+	"gemini-1.5-flash":      {ContextWindow: 1048576, MaxOutput: 8192, MaxInlineData: 20 * 1024 * 1024},
+	"gemini-1.5-pro":        {ContextWindow: 2097152, MaxOutput: 8192, MaxInlineData: 20 * 1024 * 1024},
+}
+
+// LimitsFor returns the limits for the given model name, and true if they are known.
+// The ModelLimits field of the SimpleFlash struct is consulted before DefaultModelLimits.
+func (sf *SimpleFlash) LimitsFor(modelName string) (ModelLimits, bool) {
+	if limits, ok := lookupModel(sf.ModelLimits, modelName); ok {
+		return limits, true
+	}
+	return lookupModel(DefaultModelLimits, modelName)
+}
+
+// lookupModel finds the entry for the given model name in a table keyed by model name, either by
+// an exact match or by the longest model name in the table that is a prefix of the given name.
+func lookupModel[T any](table map[string]T, modelName string) (T, bool) {
+	var zero T
+	if table == nil {
+		return zero, false
+	}
+	// Strip prefixes like "models/" or "publishers/google/models/"
+	if pos := strings.LastIndex(modelName, "/"); pos != -1 {
+		modelName = modelName[pos+1:]
+	}
+	if entry, ok := table[modelName]; ok {
+		return entry, true
+	}
+	names := make([]string, 0, len(table))
+	for name := range table {
+		names = append(names, name)
+	}
+	// Longest names first, so that "gemini-1.0-pro-vision" is preferred over "gemini-1.0-pro"
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) > len(names[j]) })
+	for _, name := range names {
+		if strings.HasPrefix(modelName, name+"-") || strings.HasPrefix(modelName, name+"@") {
+			return table[name], true
+		}
+	}
+	return zero, false
+}
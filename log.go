@@ -0,0 +1,111 @@
+package simpleflash
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+	"unicode/utf8"
+)
+
+// LogContent decides how much of the prompts and responses that are logged
+type LogContent int
+
+const (
+	// LogMetadata logs only metadata, like the model name, sizes, token usage and durations
+	LogMetadata LogContent = iota
+	// LogTruncated also logs the first logTruncateLength characters of prompts and responses
+	LogTruncated
+	// LogFull also logs the complete prompts and responses
+	LogFull
+)
+
+// logTruncateLength is the maximum number of characters of content that are logged with LogTruncated
+const logTruncateLength = 200
+
+// RedactFunc removes secrets or personal information from text, before it is logged
+type RedactFunc func(string) string
+
+// logEnabled checks if sf.Logger is set and enabled for the given level
+func (sf *SimpleFlash) logEnabled(level slog.Level) bool {
+	return sf.Logger != nil && sf.Logger.Enabled(context.Background(), level)
+}
+
+// logText prepares the given prompt or response for logging, according to sf.LogContent and sf.Redact
+func (sf *SimpleFlash) logText(s string) string {
+	if sf.Redact != nil {
+		s = sf.Redact(s)
+	}
+	if sf.LogContent == LogTruncated && utf8.RuneCountInString(s) > logTruncateLength {
+		return string([]rune(s)[:logTruncateLength]) + "..."
+	}
+	return s
+}
+
+// logRequest logs a request that is about to be sent
+func (ct *callTelemetry) logRequest(req Request) {
+	sf := ct.sf
+	if !sf.logEnabled(sf.LogLevel) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("model", ct.modelName),
+		slog.Int("prompt_length", len(req.Prompt)),
+	}
+	if req.Temperature != nil {
+		attrs = append(attrs, slog.Float64("temperature", *req.Temperature))
+	}
+	if req.System != "" {
+		attrs = append(attrs, slog.Int("system_length", len(req.System)))
+	}
+	if len(req.History) > 0 {
+		attrs = append(attrs, slog.Int("history_length", len(req.History)))
+	}
+	for i, attachment := range req.Attachments {
+		attrs = append(attrs, slog.Group(fmt.Sprintf("attachment_%d", i), slog.String("mime_type", attachment.MIMEType), slog.Int("size", len(attachment.Data))))
+	}
+	if sf.LogContent != LogMetadata {
+		attrs = append(attrs, slog.String("prompt", sf.logText(req.Prompt)))
+		if req.System != "" {
+			attrs = append(attrs, slog.String("system", sf.logText(req.System)))
+		}
+	}
+	sf.Logger.LogAttrs(context.Background(), sf.LogLevel, "simpleflash request", attrs...)
+}
+
+// logEnd logs the response or the error of a call
+func (ct *callTelemetry) logEnd(res *Response, err error) {
+	sf := ct.sf
+	level := sf.LogLevel
+	if err != nil {
+		level = slog.LevelError
+	}
+	if !sf.logEnabled(level) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("model", ct.modelName),
+		slog.String("call", ct.name),
+		slog.Duration("duration", time.Since(ct.start)),
+	}
+	if ct.cacheChecked {
+		attrs = append(attrs, slog.Bool("cache_hit", ct.cacheHit))
+	}
+	ct.mut.Lock()
+	if ct.usage != nil {
+		attrs = append(attrs, slog.Int("input_tokens", int(ct.usage.PromptTokenCount)), slog.Int("output_tokens", int(ct.usage.CandidatesTokenCount)))
+	}
+	ct.mut.Unlock()
+	if err != nil {
+		attrs = append(attrs, slog.String("error_type", errorType(err)), slog.String("error", sf.logText(err.Error())))
+		sf.Logger.LogAttrs(context.Background(), level, "simpleflash error", attrs...)
+		return
+	}
+	if res != nil {
+		attrs = append(attrs, slog.Int("response_length", len(res.Text)))
+		if sf.LogContent != LogMetadata {
+			attrs = append(attrs, slog.String("response", sf.logText(res.Text)))
+		}
+	}
+	sf.Logger.LogAttrs(context.Background(), level, "simpleflash response", attrs...)
+}
@@ -0,0 +1,56 @@
+package simpleflash
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogRequestAndResponse(t *testing.T) {
+	var buf bytes.Buffer
+	sf := &SimpleFlash{
+		Logger:     slog.New(slog.NewJSONHandler(&buf, nil)),
+		LogContent: LogFull,
+		Redact:     func(s string) string { return strings.ReplaceAll(s, "hunter2", "[REDACTED]") },
+	}
+
+	_, tel := sf.startCall(context.Background(), "QueryGemini", testModelName)
+	tel.logRequest(Request{Prompt: "the password is hunter2"})
+	tel.end(&Response{Text: "ok, hunter2"}, nil)
+
+	out := buf.String()
+	if strings.Contains(out, "hunter2") {
+		t.Errorf("expected the password to be redacted, got %s", out)
+	}
+	if !strings.Contains(out, "the password is [REDACTED]") || !strings.Contains(out, "ok, [REDACTED]") {
+		t.Errorf("expected the redacted prompt and response to be logged, got %s", out)
+	}
+}
+
+func TestLogContentLevels(t *testing.T) {
+	var buf bytes.Buffer
+	sf := &SimpleFlash{Logger: slog.New(slog.NewJSONHandler(&buf, nil))}
+	prompt := strings.Repeat("x", logTruncateLength*2)
+
+	_, tel := sf.startCall(context.Background(), "QueryGemini", testModelName)
+	tel.logRequest(Request{Prompt: prompt})
+	if strings.Contains(buf.String(), "xxx") {
+		t.Errorf("expected no content with LogMetadata, got %s", buf.String())
+	}
+
+	buf.Reset()
+	sf.LogContent = LogTruncated
+	tel.logRequest(Request{Prompt: prompt})
+	if !strings.Contains(buf.String(), strings.Repeat("x", logTruncateLength)+"...") || strings.Contains(buf.String(), prompt) {
+		t.Errorf("expected truncated content with LogTruncated, got %s", buf.String())
+	}
+
+	buf.Reset()
+	tel.end(nil, errors.New("failed"))
+	if !strings.Contains(buf.String(), `"level":"ERROR"`) {
+		t.Errorf("expected errors to be logged at the error level, got %s", buf.String())
+	}
+}
@@ -0,0 +1,79 @@
+package simpleflash
+
+import "sync"
+
+// Mode is the trade-off between reproducible and varied responses
+type Mode int
+
+const (
+	// ModeDefault uses the mode of the SimpleFlash, or the temperature of the request and the cache as configured
+	ModeDefault Mode = iota
+	// ModeDeterministic uses temperature 0 and only the most likely token at each step (top-k 1), and caches
+	// the response. The VertexAI API that is used does not support a seed, so responses are as reproducible
+	// as greedy decoding makes them, but not guaranteed to be identical.
+	ModeDeterministic
+	// ModeCreative uses the temperature of the request, or DefaultCreativeTemperature, and does not reuse
+	// responses from the cache, unless CreativeSamples is set, in which case that many different responses
+	// are cached and the requests rotate among them
+	ModeCreative
+)
+
+// DefaultCreativeTemperature is the temperature in ModeCreative, for requests that do not set one
+const DefaultCreativeTemperature = 1.0
+
+// maxRotations is how many prompts the sample rotation of ModeCreative keeps track of, before it starts over
+const maxRotations = 10000
+
+// rotationMut guards the sample rotation of every SimpleFlash
+var rotationMut sync.Mutex
+
+// String returns the name of the mode
+func (m Mode) String() string {
+	switch m {
+	case ModeDeterministic:
+		return "deterministic"
+	case ModeCreative:
+		return "creative"
+	}
+	return "default"
+}
+
+// applyMode returns the request with the settings of its mode, or the mode of sf
+func (sf *SimpleFlash) applyMode(req Request) Request {
+	if req.Mode == ModeDefault {
+		req.Mode = sf.Mode
+	}
+	switch req.Mode {
+	case ModeDeterministic:
+		temperature := 0.0
+		req.Temperature = &temperature
+	case ModeCreative:
+		if req.Temperature == nil {
+			temperature := DefaultCreativeTemperature
+			req.Temperature = &temperature
+		}
+		samples := sf.CreativeSamples
+		if req.CreativeSamples > 0 {
+			samples = req.CreativeSamples
+		}
+		if samples <= 0 {
+			req.NoCache = true
+		} else {
+			req.sample = sf.nextSample(cacheKeyFor(sf.modelFor(req), req), samples)
+		}
+	}
+	return req
+}
+
+// nextSample returns which of the cached samples of a request to use, from 1 to samples,
+// so that identical requests rotate among the samples in order
+func (sf *SimpleFlash) nextSample(key string, samples int) int {
+	rotationMut.Lock()
+	defer rotationMut.Unlock()
+	if sf.rotation == nil || len(sf.rotation) >= maxRotations {
+		sf.rotation = make(map[string]int)
+	}
+	n := sf.rotation[key]
+	sf.rotation[key] = n + 1
+	return 1 + n%samples
+}
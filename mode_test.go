@@ -0,0 +1,74 @@
+package simpleflash
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestDeterministicMode(t *testing.T) {
+	sf := replayFor(t, map[*Request]string{{Prompt: "Name a cow.", Mode: ModeDeterministic}: "Bessie."})
+	sf.Mode = ModeDeterministic
+	if err := sf.InitCache(); err != nil {
+		t.Fatal(err)
+	}
+	// The temperature of the request is ignored, so both requests are the same
+	temperature := 0.9
+	for i, req := range []Request{{Prompt: "Name a cow."}, {Prompt: "Name a cow.", Temperature: &temperature}} {
+		res, err := sf.Generate(context.Background(), req)
+		if err != nil || res.Text != "Bessie." || res.Cached != (i > 0) {
+			t.Errorf("expected a cached response the second time, got %+v (%v)", res, err)
+		}
+	}
+	model := sf.configureModel(testModelName, sf.applyMode(Request{Prompt: "Name a cow."}))
+	if *model.Temperature != 0 || model.TopK == nil || *model.TopK != 1 {
+		t.Errorf("expected temperature 0 and top-k 1, got %v and %v", *model.Temperature, model.TopK)
+	}
+
+	if _, err := sf.Query(context.Background(), "Name a cow.", WithMode(ModeDeterministic), WithTemperature(1)); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("expected a temperature in deterministic mode to be invalid, got %v", err)
+	}
+}
+
+func TestCreativeMode(t *testing.T) {
+	// Without a temperature, DefaultCreativeTemperature is used, so the samples differ
+	temperature := DefaultCreativeTemperature
+	cow := Request{Prompt: "Name a cow.", Temperature: &temperature}
+	sf := replayResponses(t, replayedResponse{cow, []string{"Bessie."}}, replayedResponse{cow, []string{"Daisy."}}, replayedResponse{cow, []string{"Buttercup."}}, replayedResponse{cow, []string{"Clarabelle."}})
+	sf.Mode = ModeCreative
+	if err := sf.InitCache(); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		res, err := sf.Generate(context.Background(), Request{Prompt: "Name a cow."})
+		if err != nil || res.Cached {
+			t.Fatalf("expected a new response every time, got %+v (%v)", res, err)
+		}
+		seen[res.Text] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("expected different responses, got %v", seen)
+	}
+
+	// With samples, that many responses are fetched, and then the requests rotate among them
+	sf.CreativeSamples = 2
+	calls := sf.Costs.Total().Calls
+	var texts []string
+	for i := 0; i < 6; i++ {
+		res, err := sf.Generate(context.Background(), Request{Prompt: "Name a cow."})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Cached != (i >= 2) {
+			t.Errorf("expected only the first 2 responses to be fetched, got %+v", res)
+		}
+		texts = append(texts, res.Text)
+	}
+	if n := sf.Costs.Total().Calls - calls; n != 2 {
+		t.Errorf("expected 2 calls, got %d", n)
+	}
+	if texts[0] == texts[1] || texts[0] != texts[2] || texts[1] != texts[3] || texts[0] != texts[4] || texts[1] != texts[5] {
+		t.Errorf("expected the requests to rotate among 2 different samples, got %q", texts)
+	}
+}
@@ -0,0 +1,480 @@
+package simpleflash
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// OpenAIHandler is an http.Handler that serves the OpenAI chat completions, completions and models
+// endpoints, backed by a SimpleFlash. All clients share the cache, cost tracker, spend limit and
+// MaxConcurrent limit of the handler. Failed calls to Gemini are not retried by the handler, but are
+// answered with status 429 or 5xx, which OpenAI clients retry.
+//
+// Model names that do not contain "gemini", like "gpt-4o", are replaced with the default model.
+type OpenAIHandler struct {
+	MaxConcurrent int // how many completions are generated at the same time, for all clients, no limit if 0
+	sf            *SimpleFlash
+	mux           *http.ServeMux
+	active        atomic.Int64
+}
+
+// NewOpenAIHandler creates a new OpenAIHandler for the given SimpleFlash
+func NewOpenAIHandler(sf *SimpleFlash) *OpenAIHandler {
+	h := &OpenAIHandler{sf: sf, mux: http.NewServeMux()}
+	h.mux.HandleFunc("POST /v1/chat/completions", h.chatCompletions)
+	h.mux.HandleFunc("POST /v1/completions", h.completions)
+	h.mux.HandleFunc("GET /v1/models", h.models)
+	return h
+}
+
+// ServeHTTP implements http.Handler. Completions beyond MaxConcurrent are answered with status 429.
+func (h *OpenAIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && h.MaxConcurrent > 0 {
+		defer h.active.Add(-1)
+		if h.active.Add(1) > int64(h.MaxConcurrent) {
+			w.Header().Set("Retry-After", "1")
+			writeJSON(w, http.StatusTooManyRequests, map[string]any{"error": map[string]any{
+				"message": fmt.Sprintf("more than %d completions at the same time", h.MaxConcurrent),
+				"type":    "rate_limit_exceeded",
+				"code":    "rate_limit_exceeded",
+			}})
+			return
+		}
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+// openAIMessage is a message in a chat completion request. The content is either a string or a list of parts.
+type openAIMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+// openAIContentPart is a part of the content of a message
+type openAIContentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageURL *struct {
+		URL string `json:"url"`
+	} `json:"image_url,omitempty"`
+}
+
+type openAIChatRequest struct {
+	Model       string          `json:"model"`
+	Messages    []openAIMessage `json:"messages"`
+	Temperature *float64        `json:"temperature"`
+	MaxTokens   int             `json:"max_tokens"`
+	Stop        json.RawMessage `json:"stop"`
+	Stream      bool            `json:"stream"`
+	N           int             `json:"n"`
+}
+
+type openAICompletionRequest struct {
+	Model       string          `json:"model"`
+	Prompt      json.RawMessage `json:"prompt"`
+	Temperature *float64        `json:"temperature"`
+	MaxTokens   int             `json:"max_tokens"`
+	Stop        json.RawMessage `json:"stop"`
+	Stream      bool            `json:"stream"`
+	N           int             `json:"n"`
+}
+
+type openAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type openAIChoice struct {
+	Index        int              `json:"index"`
+	Message      *openAIReplyText `json:"message,omitempty"`
+	Delta        *openAIReplyText `json:"delta,omitempty"`
+	Text         *string          `json:"text,omitempty"`
+	FinishReason *string          `json:"finish_reason"`
+}
+
+type openAIReplyText struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type openAIResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   *openAIUsage   `json:"usage,omitempty"`
+}
+
+// badRequestError is an error in the request from an HTTP client
+type badRequestError struct {
+	message string
+}
+
+func (e *badRequestError) Error() string {
+	return e.message
+}
+
+func badRequest(format string, args ...any) error {
+	return &badRequestError{message: fmt.Sprintf(format, args...)}
+}
+
+func (h *OpenAIHandler) chatCompletions(w http.ResponseWriter, r *http.Request) {
+	var body openAIChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeOpenAIError(w, requestError(err))
+		return
+	}
+	req, err := h.chatRequest(body)
+	if err != nil {
+		writeOpenAIError(w, err)
+		return
+	}
+	if body.N > 1 {
+		writeOpenAIError(w, badRequest("n > 1 is not supported"))
+		return
+	}
+	h.respond(w, r.Context(), req, body.Stream, "chat.completion", "chatcmpl-")
+}
+
+func (h *OpenAIHandler) completions(w http.ResponseWriter, r *http.Request) {
+	var body openAICompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeOpenAIError(w, requestError(err))
+		return
+	}
+	prompts, err := stringOrList(body.Prompt)
+	if err != nil || len(prompts) != 1 {
+		writeOpenAIError(w, badRequest("prompt must be a string or a list with one string"))
+		return
+	}
+	stop, err := stringOrList(body.Stop)
+	if err != nil {
+		writeOpenAIError(w, badRequest("stop must be a string or a list of strings"))
+		return
+	}
+	if body.N > 1 {
+		writeOpenAIError(w, badRequest("n > 1 is not supported"))
+		return
+	}
+	req := Request{
+		Prompt:          prompts[0],
+		Model:           h.modelName(body.Model),
+		Temperature:     body.Temperature,
+		MaxOutputTokens: body.MaxTokens,
+		StopSequences:   stop,
+	}
+	h.respond(w, r.Context(), req, body.Stream, "text_completion", "cmpl-")
+}
+
+func (h *OpenAIHandler) models(w http.ResponseWriter, r *http.Request) {
+	names := map[string]bool{h.sf.ModelName: true, h.sf.MultiModalModelName: true}
+	for name := range DefaultModelLimits {
+		names[name] = true
+	}
+	for name := range h.sf.ModelLimits {
+		names[name] = true
+	}
+	type model struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		Created int64  `json:"created"`
+		OwnedBy string `json:"owned_by"`
+	}
+	list := struct {
+		Object string  `json:"object"`
+		Data   []model `json:"data"`
+	}{Object: "list", Data: []model{}}
+	for name := range names {
+		if name != "" {
+			list.Data = append(list.Data, model{ID: name, Object: "model", OwnedBy: "google"})
+		}
+	}
+	sort.Slice(list.Data, func(i, j int) bool { return list.Data[i].ID < list.Data[j].ID })
+	writeJSON(w, http.StatusOK, list)
+}
+
+// modelName returns the Gemini model to use for the given model name from the client
+func (h *OpenAIHandler) modelName(name string) string {
+	if !strings.Contains(name, "gemini") {
+		return ""
+	}
+	return name
+}
+
+// chatRequest translates a chat completion request to a Request
+func (h *OpenAIHandler) chatRequest(body openAIChatRequest) (Request, error) {
+	stop, err := stringOrList(body.Stop)
+	if err != nil {
+		return Request{}, badRequest("stop must be a string or a list of strings")
+	}
+	req := Request{
+		Model:           h.modelName(body.Model),
+		Temperature:     body.Temperature,
+		MaxOutputTokens: body.MaxTokens,
+		StopSequences:   stop,
+	}
+	var systems []string
+	var messages []Message
+	for i, m := range body.Messages {
+		text, attachments, err := messageContent(m.Content)
+		if err != nil {
+			return Request{}, badRequest("message %d: %v", i, err)
+		}
+		switch m.Role {
+		case "system", "developer":
+			systems = append(systems, text)
+		case "user":
+			messages = append(messages, Message{Role: RoleUser, Text: text, Attachments: attachments})
+		case "assistant":
+			messages = append(messages, Message{Role: RoleModel, Text: text})
+		default:
+			return Request{}, badRequest("message %d: the role %q is not supported", i, m.Role)
+		}
+	}
+	if len(messages) == 0 || messages[len(messages)-1].Role != RoleUser {
+		return Request{}, badRequest("the last message must be from the user")
+	}
+	last := messages[len(messages)-1]
+	req.Prompt = last.Text
+	req.Attachments = last.Attachments
+	req.History = messages[:len(messages)-1]
+	req.System = strings.Join(systems, "\n\n")
+	return req, nil
+}
+
+// messageContent returns the text and the attachments of the content of a message,
+// which is either a string or a list of text and image parts
+func messageContent(raw json.RawMessage) (string, []Attachment, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil, nil
+	}
+	var parts []openAIContentPart
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", nil, errors.New("the content must be a string or a list of parts")
+	}
+	var texts []string
+	var attachments []Attachment
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "image_url":
+			if part.ImageURL == nil {
+				return "", nil, errors.New("image_url part without an URL")
+			}
+			attachment, err := dataURLAttachment(part.ImageURL.URL)
+			if err != nil {
+				return "", nil, err
+			}
+			attachments = append(attachments, attachment)
+		default:
+			return "", nil, fmt.Errorf("the content part type %q is not supported", part.Type)
+		}
+	}
+	return strings.Join(texts, "\n"), attachments, nil
+}
+
+// dataURLAttachment decodes a base64 data URL, like "data:image/png;base64,...", to an Attachment
+func dataURLAttachment(url string) (Attachment, error) {
+	rest, ok := strings.CutPrefix(url, "data:")
+	if !ok {
+		return Attachment{}, errors.New("only base64 data URLs are supported for images")
+	}
+	header, data, ok := strings.Cut(rest, ",")
+	mimeType, isBase64 := strings.CutSuffix(header, ";base64")
+	if !ok || !isBase64 {
+		return Attachment{}, errors.New("only base64 data URLs are supported for images")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return Attachment{}, fmt.Errorf("invalid base64 data: %v", err)
+	}
+	return Attachment{MIMEType: mimeType, Data: decoded}, nil
+}
+
+// stringOrList decodes a JSON value that is either a string or a list of strings
+func stringOrList(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return []string{s}, nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// respond generates the response for the request and writes it, either as JSON or as server-sent events
+func (h *OpenAIHandler) respond(w http.ResponseWriter, ctx context.Context, req Request, stream bool, object, idPrefix string) {
+	id := idPrefix + randomID()
+	created := time.Now().Unix()
+	model := h.sf.modelFor(req)
+	chat := object == "chat.completion"
+
+	if !stream {
+		res, err := h.sf.Generate(ctx, req)
+		if err != nil {
+			writeOpenAIError(w, err)
+			return
+		}
+		finishReason := openAIFinishReason(res.FinishReason)
+		choice := openAIChoice{FinishReason: &finishReason}
+		if chat {
+			choice.Message = &openAIReplyText{Role: "assistant", Content: res.Text}
+		} else {
+			choice.Text = &res.Text
+		}
+		writeJSON(w, http.StatusOK, openAIResponse{
+			ID:      id,
+			Object:  object,
+			Created: created,
+			Model:   res.Model,
+			Choices: []openAIChoice{choice},
+			Usage:   &openAIUsage{PromptTokens: res.InputTokens, CompletionTokens: res.OutputTokens, TotalTokens: res.InputTokens + res.OutputTokens},
+		})
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	started := false
+	event := func(choice openAIChoice) {
+		if !started {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		streamObject := object
+		if chat {
+			streamObject = "chat.completion.chunk"
+		}
+		data, _ := json.Marshal(openAIResponse{ID: id, Object: streamObject, Created: created, Model: model, Choices: []openAIChoice{choice}})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	textChoice := func(text string) openAIChoice {
+		if chat {
+			return openAIChoice{Delta: &openAIReplyText{Content: text}}
+		}
+		return openAIChoice{Text: &text}
+	}
+	// The first event is held back until there is a response, so that errors before that get their status code
+	begin := func() {
+		if !started && chat {
+			event(openAIChoice{Delta: &openAIReplyText{Role: "assistant"}})
+		}
+	}
+	res, err := h.sf.GenerateStream(ctx, req, func(chunk string) {
+		begin()
+		event(textChoice(chunk))
+	})
+	if err != nil {
+		if !started {
+			writeOpenAIError(w, err)
+			return
+		}
+		// The status has already been sent, so report the error as an event
+		data, _ := json.Marshal(map[string]any{"error": openAIErrorBody(err)})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	} else {
+		begin()
+		finishReason := openAIFinishReason(res.FinishReason)
+		final := textChoice("")
+		final.FinishReason = &finishReason
+		event(final)
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// openAIFinishReason translates a Gemini finish reason to an OpenAI finish reason
+func openAIFinishReason(reason string) string {
+	switch reason {
+	case "FinishReasonMaxTokens":
+		return "length"
+	case "FinishReasonSafety", "FinishReasonBlocklist", "FinishReasonProhibitedContent", "FinishReasonSpii", "FinishReasonRecitation":
+		return "content_filter"
+	}
+	return "stop"
+}
+
+// httpErrorStatus returns the HTTP status code, and the OpenAI error type and code, for the given error
+func httpErrorStatus(err error) (int, string, string) {
+	var requestErr *badRequestError
+	if errors.As(err, &requestErr) {
+		return http.StatusBadRequest, "invalid_request_error", ""
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge, "invalid_request_error", "request_too_large"
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusTooManyRequests || status.Code(err) == codes.ResourceExhausted {
+		return http.StatusTooManyRequests, "rate_limit_exceeded", "rate_limit_exceeded"
+	}
+	switch errorType(err) {
+	case "budget_exceeded":
+		return http.StatusTooManyRequests, "insufficient_quota", "insufficient_quota"
+	case "prompt_too_large", "inline_data_too_large", "output_too_large":
+		return http.StatusBadRequest, "invalid_request_error", "context_length_exceeded"
+	case "blocked":
+		return http.StatusBadRequest, "invalid_request_error", "content_filter"
+	case "invalid_argument":
+		return http.StatusBadRequest, "invalid_request_error", ""
+	case "timeout":
+		return http.StatusGatewayTimeout, "timeout", ""
+	}
+	return http.StatusBadGateway, "api_error", ""
+}
+
+func openAIErrorBody(err error) map[string]any {
+	_, errType, code := httpErrorStatus(err)
+	body := map[string]any{"message": err.Error(), "type": errType}
+	if code != "" {
+		body["code"] = code
+	}
+	return body
+}
+
+func writeOpenAIError(w http.ResponseWriter, err error) {
+	status, _, _ := httpErrorStatus(err)
+	writeJSON(w, status, map[string]any{"error": openAIErrorBody(err)})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// randomID returns a random hexadecimal string, for use in response IDs
+func randomID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,246 @@
+package simpleflash
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// replayFor creates a replaying SimpleFlash that answers each of the given requests with the given text
+func replayFor(t *testing.T, answers map[*Request]string) *SimpleFlash {
+	t.Helper()
+	var responses []replayedResponse
+	for req, text := range answers {
+		responses = append(responses, replayedResponse{*req, []string{text}})
+	}
+	return replayResponses(t, responses...)
+}
+
+// replayedResponse is a request and the candidates of its response, for replayResponses
+type replayedResponse struct {
+	req        Request
+	candidates []string
+}
+
+// replayResponses returns a SimpleFlash that replays the given responses. Identical requests get their responses in order.
+func replayResponses(t *testing.T, responses ...replayedResponse) *SimpleFlash {
+	t.Helper()
+	client, err := genai.NewClient(context.Background(), "test-project", testLocation, option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sf := &SimpleFlash{ModelName: testModelName, MultiModalModelName: testMultiModalModelName, Client: client}
+	var interactions []Interaction
+	for _, response := range responses {
+		req := response.req
+		model := sf.configureModel(sf.modelFor(req), req)
+		if req.Candidates > 1 {
+			model.SetCandidateCount(int32(req.Candidates))
+		}
+		recorded, err := newRecordedRequest("generateContent", model, historyContents(req.History), messageParts(req.Prompt, req.Attachments))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var candidates []RecordedCandidate
+		for _, text := range response.candidates {
+			candidates = append(candidates, RecordedCandidate{Text: text, FinishReason: int32(genai.FinishReasonStop)})
+		}
+		interactions = append(interactions, Interaction{Request: recorded, Response: &RecordedResponse{
+			Candidates:   candidates,
+			InputTokens:  5,
+			OutputTokens: 7,
+		}})
+	}
+	replaying, err := NewReplay(writeFixture(t, interactions...), testModelName, testMultiModalModelName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return replaying
+}
+
+func TestOpenAIChatCompletion(t *testing.T) {
+	temperature := 0.0
+	sf := replayFor(t, map[*Request]string{{
+		Prompt:        "And now?",
+		System:        "Be brief.",
+		Temperature:   &temperature,
+		StopSequences: []string{"END"},
+		History:       []Message{{Role: RoleUser, Text: "Hi"}, {Role: RoleModel, Text: "Hello!"}},
+	}: "Still here."})
+	server := httptest.NewServer(NewOpenAIHandler(sf))
+	defer server.Close()
+
+	body := `{"model": "gpt-4o", "temperature": 0, "stop": "END", "messages": [
+		{"role": "system", "content": "Be brief."},
+		{"role": "user", "content": "Hi"},
+		{"role": "assistant", "content": "Hello!"},
+		{"role": "user", "content": [{"type": "text", "text": "And now?"}]}]}`
+	resp, err := http.Post(server.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	var completion openAIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		t.Fatal(err)
+	}
+	if len(completion.Choices) != 1 || completion.Choices[0].Message == nil || completion.Choices[0].Message.Content != "Still here." {
+		t.Fatalf("expected the recorded answer, got %+v", completion)
+	}
+	if reason := completion.Choices[0].FinishReason; reason == nil || *reason != "stop" {
+		t.Errorf("expected the finish reason stop, got %v", reason)
+	}
+	if completion.Model != testModelName || completion.Object != "chat.completion" || !strings.HasPrefix(completion.ID, "chatcmpl-") {
+		t.Errorf("unexpected response metadata: %+v", completion)
+	}
+	if completion.Usage == nil || completion.Usage.PromptTokens != 5 || completion.Usage.CompletionTokens != 7 || completion.Usage.TotalTokens != 12 {
+		t.Errorf("expected the recorded usage, got %+v", completion.Usage)
+	}
+}
+
+func TestOpenAIChatCompletionStream(t *testing.T) {
+	sf := replayFor(t, map[*Request]string{{Prompt: "Count to three"}: "1, 2, 3"})
+	server := httptest.NewServer(NewOpenAIHandler(sf))
+	defer server.Close()
+
+	body := `{"stream": true, "messages": [{"role": "user", "content": "Count to three"}]}`
+	resp, err := http.Post(server.URL+"/v1/chat/completions", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("expected server-sent events, got %q", contentType)
+	}
+	var (
+		text         strings.Builder
+		finishReason string
+		done         bool
+	)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			done = true
+			break
+		}
+		var chunk openAIResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		if chunk.Object != "chat.completion.chunk" || len(chunk.Choices) != 1 {
+			t.Fatalf("unexpected chunk %q", data)
+		}
+		if delta := chunk.Choices[0].Delta; delta != nil {
+			text.WriteString(delta.Content)
+		}
+		if reason := chunk.Choices[0].FinishReason; reason != nil {
+			finishReason = *reason
+		}
+	}
+	if !done || text.String() != "1, 2, 3" || finishReason != "stop" {
+		t.Errorf("expected the streamed answer, a finish reason and [DONE], got %q, %q and %v", text.String(), finishReason, done)
+	}
+}
+
+func TestOpenAICompletion(t *testing.T) {
+	maxTokens := 20
+	sf := replayFor(t, map[*Request]string{{Prompt: "Say hi", MaxOutputTokens: maxTokens}: "Hi"})
+	handler := NewOpenAIHandler(sf)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"prompt": ["Say hi"], "max_tokens": 20}`)))
+	var completion openAIResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &completion); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || len(completion.Choices) != 1 || completion.Choices[0].Text == nil || *completion.Choices[0].Text != "Hi" {
+		t.Errorf("expected the recorded answer, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestOpenAIErrors(t *testing.T) {
+	sf := replayFor(t, map[*Request]string{})
+	handler := NewOpenAIHandler(sf)
+
+	for body, status := range map[string]int{
+		`not json`:         http.StatusBadRequest,
+		`{"messages": []}`: http.StatusBadRequest,
+		`{"messages": [{"role": "tool", "content": "x"}, {"role": "user", "content": "y"}]}`:                                      http.StatusBadRequest,
+		`{"messages": [{"role": "user", "content": [{"type": "image_url", "image_url": {"url": "https://example.com/a.png"}}]}]}`: http.StatusBadRequest,
+		`{"max_tokens": 100000000, "messages": [{"role": "user", "content": "y"}]}`:                                               http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+		if rec.Code != status {
+			t.Errorf("expected status %d for %s, got %d: %s", status, body, rec.Code, rec.Body.String())
+		}
+	}
+
+	sf.Costs.SetLimit(0.000001)
+	sf.Costs.Record(testModelName, "", Usage{Calls: 1, Cost: 1})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages": [{"role": "user", "content": "y"}]}`)))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429 when the budget is exceeded, got %d", rec.Code)
+	}
+
+	// Errors before the first chunk of a stream keep their status code
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"stream": true, "messages": [{"role": "user", "content": "y"}]}`)))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected status 429 as JSON for a stream when the budget is exceeded, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Completions beyond MaxConcurrent are rejected, so that clients back off
+	handler.MaxConcurrent = 1
+	handler.active.Store(1)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"messages": [{"role": "user", "content": "y"}]}`)))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" || handler.active.Load() != 1 {
+		t.Errorf("expected status 429 with Retry-After beyond MaxConcurrent, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Rate limits of Gemini are passed on
+	for _, err := range []error{&googleapi.Error{Code: http.StatusTooManyRequests}, status.Error(codes.ResourceExhausted, "quota")} {
+		if code, _, _ := httpErrorStatus(fmt.Errorf("unable to generate contents: %w", err)); code != http.StatusTooManyRequests {
+			t.Errorf("expected status 429 for %v, got %d", err, code)
+		}
+	}
+}
+
+func TestDataURLAttachment(t *testing.T) {
+	attachment, err := dataURLAttachment("data:image/png;base64,aGVsbG8=")
+	if err != nil || attachment.MIMEType != "image/png" || string(attachment.Data) != "hello" {
+		t.Errorf("expected the decoded attachment, got %+v (%v)", attachment, err)
+	}
+	if _, err := dataURLAttachment("data:text/plain,hello"); err == nil {
+		t.Error("expected an error for a data URL that is not base64")
+	}
+}
+
+func TestOpenAIModels(t *testing.T) {
+	sf := replayFor(t, map[*Request]string{})
+	rec := httptest.NewRecorder()
+	NewOpenAIHandler(sf).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"id":"`+testModelName+`"`) {
+		t.Errorf("expected the default model to be listed, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,152 @@
+package simpleflash
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+)
+
+// maxPDFStreamSize is the maximum size of a decompressed content stream, so that a small PDF file
+// with a highly compressed stream can not exhaust the memory
+const maxPDFStreamSize = 32 << 20
+
+var (
+	pdfStreamPattern = regexp.MustCompile(`(?s)<<(.*?)>>\s*stream\r?\n`)
+	pdfTextPattern   = regexp.MustCompile(`(?s)BT(.*?)ET`)
+)
+
+// pdfText extracts the text from the given PDF file. This is a minimal extractor that only supports
+// uncompressed and FlateDecode content streams with literal strings in Tj, TJ, ' and " operators.
+// Text in fonts with custom encodings, hex strings and object streams is not extracted.
+func pdfText(data []byte) (string, error) {
+	if !bytes.HasPrefix(data, []byte("%PDF")) {
+		return "", errors.New("not a PDF file")
+	}
+	var sb strings.Builder
+	for _, loc := range pdfStreamPattern.FindAllSubmatchIndex(data, -1) {
+		dict := string(data[loc[2]:loc[3]])
+		start := loc[1]
+		end := bytes.Index(data[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		stream := data[start : start+end]
+		switch {
+		case strings.Contains(dict, "/FlateDecode"):
+			r, err := zlib.NewReader(bytes.NewReader(stream))
+			if err != nil {
+				continue
+			}
+			// A stream can have trailing bytes after the compressed data, so errors after some output are ignored
+			decoded, _ := io.ReadAll(io.LimitReader(r, maxPDFStreamSize+1))
+			if len(decoded) > maxPDFStreamSize {
+				return "", fmt.Errorf("a content stream in the PDF file is larger than %d bytes when decompressed", maxPDFStreamSize)
+			}
+			stream = decoded
+		case strings.Contains(dict, "/Filter"):
+			continue // other filters, like images, are not supported
+		}
+		for _, block := range pdfTextPattern.FindAllSubmatch(stream, -1) {
+			pdfTextBlock(&sb, block[1])
+			sb.WriteString("\n")
+		}
+	}
+	text := strings.TrimSpace(sb.String())
+	if text == "" {
+		return "", errors.New("no text found in the PDF file")
+	}
+	return text, nil
+}
+
+// pdfTextBlock writes the literal strings in a BT ... ET block of a content stream.
+// The Td, TD, T*, ' and " operators start a new line.
+func pdfTextBlock(sb *strings.Builder, block []byte) {
+	for i := 0; i < len(block); i++ {
+		switch c := block[i]; c {
+		case '(':
+			var s []byte
+			s, i = pdfLiteralString(block, i+1)
+			sb.WriteString(pdfDecodeString(s))
+		case '\'', '"':
+			sb.WriteString("\n")
+		case 'T':
+			if i+1 < len(block) && (block[i+1] == 'd' || block[i+1] == 'D' || block[i+1] == '*') {
+				sb.WriteString("\n")
+			}
+		}
+	}
+}
+
+// pdfDecodeString decodes a PDF string, which is UTF-16BE if it starts with a byte order mark,
+// and otherwise treated as Latin-1, which is close to PDFDocEncoding
+func pdfDecodeString(s []byte) string {
+	if len(s) >= 2 && s[0] == 0xfe && s[1] == 0xff {
+		units := make([]uint16, 0, len(s)/2)
+		for i := 2; i+1 < len(s); i += 2 {
+			units = append(units, uint16(s[i])<<8|uint16(s[i+1]))
+		}
+		return string(utf16.Decode(units))
+	}
+	runes := make([]rune, len(s))
+	for i, b := range s {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+// pdfLiteralString reads a literal string that starts at the given position, after the opening parenthesis.
+// It returns the string and the position of the closing parenthesis.
+func pdfLiteralString(data []byte, i int) ([]byte, int) {
+	var s []byte
+	depth := 0
+	for ; i < len(data); i++ {
+		switch c := data[i]; c {
+		case '\\':
+			i++
+			if i >= len(data) {
+				return s, i
+			}
+			switch e := data[i]; e {
+			case 'n':
+				s = append(s, '\n')
+			case 'r':
+				s = append(s, '\r')
+			case 't':
+				s = append(s, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// A line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					// An octal character code of up to three digits
+					n := 0
+					for j := 0; j < 3 && i < len(data) && data[i] >= '0' && data[i] <= '7'; j++ {
+						n = n*8 + int(data[i]-'0')
+						i++
+					}
+					i--
+					s = append(s, byte(n))
+				} else {
+					s = append(s, e)
+				}
+			}
+		case '(':
+			depth++
+			s = append(s, c)
+		case ')':
+			if depth == 0 {
+				return s, i
+			}
+			depth--
+			s = append(s, c)
+		default:
+			s = append(s, c)
+		}
+	}
+	return s, i
+}
@@ -0,0 +1,49 @@
+package simpleflash
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPDFText(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	fmt.Fprint(zw, "BT /F1 12 Tf 72 700 Td [(Compressed) -250 (text)] TJ ET")
+	zw.Close()
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n1 0 obj\n<< /Length 60 >>\nstream\nBT /F1 12 Tf 72 720 Td (Hello \\(PDF\\)) Tj 0 -14 Td (caf\\351) Tj ET\nendstream\nendobj\n")
+	fmt.Fprintf(&pdf, "2 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", compressed.Len())
+	pdf.Write(compressed.Bytes())
+	pdf.WriteString("\nendstream\nendobj\n%%EOF\n")
+
+	text, err := pdfText(pdf.Bytes())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for _, expected := range []string{"Hello (PDF)", "café", "Compressedtext"} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("expected %q in the extracted text, got %q", expected, text)
+		}
+	}
+	if _, err := pdfText([]byte("not a pdf")); err == nil {
+		t.Error("expected an error for a file that is not a PDF")
+	}
+}
+
+func TestPDFStreamSize(t *testing.T) {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(make([]byte, maxPDFStreamSize+1))
+	zw.Close()
+	var pdf bytes.Buffer
+	fmt.Fprintf(&pdf, "%%PDF-1.4\n1 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", compressed.Len())
+	pdf.Write(compressed.Bytes())
+	pdf.WriteString("\nendstream\nendobj\n%%EOF\n")
+
+	if _, err := pdfText(pdf.Bytes()); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("expected an error for a stream that decompresses beyond the limit, got %v", err)
+	}
+}
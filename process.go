@@ -0,0 +1,210 @@
+package simpleflash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Processor transforms or validates the text of a response. If it returns a *ValidationError,
+// Gemini is asked to try again with the message of the error, up to ValidationRetries times.
+// Other errors are returned as they are.
+type Processor func(text string) (string, error)
+
+// ValidationError is returned by a Processor when the response is not acceptable
+type ValidationError struct {
+	Message  string // tells Gemini what was wrong with the response
+	Text     string // the response that was rejected
+	Attempts int    // the number of responses that were rejected, set when all retries have been used
+}
+
+func (e *ValidationError) Error() string {
+	if e.Attempts > 0 {
+		return fmt.Sprintf("the response was rejected %d times: %s", e.Attempts, e.Message)
+	}
+	return "the response was rejected: " + e.Message
+}
+
+// invalid returns a *ValidationError for the given text
+func invalid(text, format string, args ...any) *ValidationError {
+	return &ValidationError{Message: fmt.Sprintf(format, args...), Text: text}
+}
+
+// retryPrompt is the prompt that is sent when a response is rejected by a Processor
+const retryPrompt = "Your answer was not accepted: %s\nPlease answer the original request again, and fix this."
+
+// postProcess applies the processors of sf and then of req to the response. If a processor rejects
+// the response, the request is sent again, with the rejected response and the reason in the history.
+func (sf *SimpleFlash) postProcess(ctx context.Context, req Request, res *Response, onChunk ChunkFunc) (*Response, error) {
+	processors := append(append([]Processor(nil), sf.Processors...), req.Processors...)
+	if len(processors) == 0 {
+		return res, nil
+	}
+	retries := sf.ValidationRetries
+	if req.ValidationRetries > 0 {
+		retries = req.ValidationRetries
+	}
+	for attempt := 0; ; attempt++ {
+		text, err := applyProcessors(processors, res.Text)
+		if err == nil {
+			processed := *res
+			processed.Text = text
+			return &processed, nil
+		}
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			return nil, err
+		}
+		if attempt >= retries {
+			validationErr.Attempts = attempt + 1
+			return nil, validationErr
+		}
+		retry := req
+		retry.History = append(append([]Message(nil), req.History...),
+			Message{Role: RoleUser, Text: req.Prompt, Attachments: req.Attachments},
+			Message{Role: RoleModel, Text: res.Text},
+		)
+		retry.Prompt = fmt.Sprintf(retryPrompt, validationErr.Message)
+		retry.Attachments = nil
+		retry.retry = attempt + 1
+		req = retry
+		if res, err = sf.generate(ctx, req, onChunk); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// applyProcessors applies the processors in order
+func applyProcessors(processors []Processor, text string) (string, error) {
+	for _, process := range processors {
+		var err error
+		if text, err = process(text); err != nil {
+			return "", err
+		}
+	}
+	return text, nil
+}
+
+// ExtractCodeBlock returns a Processor that replaces the response with the contents of the first fenced
+// code block with the given language, like "go" or "json". If language is empty, the first code block is used.
+func ExtractCodeBlock(language string) Processor {
+	return func(text string) (string, error) {
+		for _, block := range codeBlocks(text) {
+			if language == "" || strings.EqualFold(block.language, language) {
+				return block.code, nil
+			}
+		}
+		if language == "" {
+			return "", invalid(text, "the answer must contain a fenced code block")
+		}
+		return "", invalid(text, "the answer must contain a fenced code block that starts with ```%s", language)
+	}
+}
+
+// codeBlock is a fenced code block in Markdown
+type codeBlock struct {
+	language string
+	code     string
+}
+
+// codeBlocks returns the fenced code blocks in the given Markdown text. A block that is not closed
+// ends at the end of the text.
+func codeBlocks(text string) []codeBlock {
+	var (
+		blocks []codeBlock
+		fence  string // the opening fence of the current block, or "" outside of blocks
+		lang   string
+		code   []string
+	)
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if fence == "" {
+			if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+				info := strings.TrimLeft(trimmed, trimmed[:1])
+				fence = trimmed[:len(trimmed)-len(info)]
+				lang, code = "", nil
+				if fields := strings.Fields(info); len(fields) > 0 {
+					lang = fields[0]
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			blocks = append(blocks, codeBlock{language: lang, code: strings.Join(code, "\n")})
+			fence = ""
+			continue
+		}
+		code = append(code, line)
+	}
+	if fence != "" {
+		blocks = append(blocks, codeBlock{language: lang, code: strings.Join(code, "\n")})
+	}
+	return blocks
+}
+
+var (
+	markdownCodeFence  = regexp.MustCompile("(?m)^[ \t]*(```+|~~~+).*$\\n?")
+	markdownHeading    = regexp.MustCompile(`(?m)^[ \t]*#{1,6}[ \t]+`)
+	markdownListItem   = regexp.MustCompile(`(?m)^([ \t]*)(?:[*+-]|\d+[.)])[ \t]+`)
+	markdownQuote      = regexp.MustCompile(`(?m)^[ \t]*>[ \t]?`)
+	markdownRule       = regexp.MustCompile(`(?m)^[ \t]*([-*_][ \t]*){3,}$\n?`)
+	markdownImage      = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink       = regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`)
+	markdownEmphasis   = regexp.MustCompile(`(\*\*|\*|~~)(\S(?:.*?\S)?)(\*\*|\*|~~)`)
+	markdownUnderscore = regexp.MustCompile(`(^|\W)(__|_)(\S(?:.*?\S)?)(__|_)(\W|$)`) // not within words, like snake_case
+	markdownInlineCode = regexp.MustCompile("`([^`]*)`")
+)
+
+// StripMarkdown returns a Processor that removes Markdown formatting, like headings, emphasis, links,
+// list markers and code fences, and keeps the text
+func StripMarkdown() Processor {
+	return func(text string) (string, error) {
+		text = markdownCodeFence.ReplaceAllString(text, "")
+		text = markdownRule.ReplaceAllString(text, "")
+		text = markdownHeading.ReplaceAllString(text, "")
+		text = markdownQuote.ReplaceAllString(text, "")
+		text = markdownListItem.ReplaceAllString(text, "$1")
+		text = markdownImage.ReplaceAllString(text, "$1")
+		text = markdownLink.ReplaceAllString(text, "$1")
+		text = markdownInlineCode.ReplaceAllString(text, "$1")
+		for previous := ""; previous != text; {
+			previous = text
+			text = markdownEmphasis.ReplaceAllString(text, "$2")
+			text = markdownUnderscore.ReplaceAllString(text, "$1$3$5")
+		}
+		return strings.TrimSpace(text), nil
+	}
+}
+
+// MatchRegexp returns a Processor that rejects responses that do not match the given regular expression
+func MatchRegexp(pattern *regexp.Regexp) Processor {
+	return func(text string) (string, error) {
+		if !pattern.MatchString(text) {
+			return "", invalid(text, "the answer must match the regular expression %s", pattern)
+		}
+		return text, nil
+	}
+}
+
+// MaxLength returns a Processor that rejects responses that are longer than the given number of characters
+func MaxLength(n int) Processor {
+	return func(text string) (string, error) {
+		if length := utf8.RuneCountInString(text); length > n {
+			return "", invalid(text, "the answer must be at most %d characters long, but it was %d characters", n, length)
+		}
+		return text, nil
+	}
+}
+
+// MinLength returns a Processor that rejects responses that are shorter than the given number of characters
+func MinLength(n int) Processor {
+	return func(text string) (string, error) {
+		if length := utf8.RuneCountInString(text); length < n {
+			return "", invalid(text, "the answer must be at least %d characters long, but it was %d characters", n, length)
+		}
+		return text, nil
+	}
+}
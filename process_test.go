@@ -0,0 +1,86 @@
+package simpleflash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+func TestExtractCodeBlock(t *testing.T) {
+	text := "Here you go:\n\n```python\nprint(1)\n```\n\nAnd in Go:\n\n~~~go\nfmt.Println(1)\n\nfmt.Println(2)\n~~~\n"
+	if code, err := ExtractCodeBlock("go")(text); err != nil || code != "fmt.Println(1)\n\nfmt.Println(2)" {
+		t.Errorf("expected the Go code block, got %q (%v)", code, err)
+	}
+	if code, err := ExtractCodeBlock("")(text); err != nil || code != "print(1)" {
+		t.Errorf("expected the first code block, got %q (%v)", code, err)
+	}
+	if code, err := ExtractCodeBlock("json")("```json\n{\"a\": 1}"); err != nil || code != `{"a": 1}` {
+		t.Errorf("expected an unclosed code block to end at the end of the text, got %q (%v)", code, err)
+	}
+	var validationErr *ValidationError
+	if _, err := ExtractCodeBlock("rust")(text); !errors.As(err, &validationErr) {
+		t.Errorf("expected a *ValidationError, got %v", err)
+	}
+}
+
+func TestStripMarkdown(t *testing.T) {
+	text := "# Title\n\nSome **bold**, *italic* and `code` with a [link](https://example.com) and snake_case_name.\n\n* one\n* _two_\n\n> quoted\n\n---\n```\nblock\n```"
+	expected := "Title\n\nSome bold, italic and code with a link and snake_case_name.\n\none\ntwo\n\nquoted\n\nblock"
+	if got, _ := StripMarkdown()(text); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestValidators(t *testing.T) {
+	for _, tc := range []struct {
+		processor Processor
+		text      string
+		valid     bool
+	}{
+		{MatchRegexp(regexp.MustCompile(`^\d+$`)), "42", true},
+		{MatchRegexp(regexp.MustCompile(`^\d+$`)), "forty-two", false},
+		{MaxLength(3), "æøå", true},
+		{MaxLength(3), "abcd", false},
+		{MinLength(2), "a", false},
+	} {
+		_, err := tc.processor(tc.text)
+		if valid := err == nil; valid != tc.valid {
+			t.Errorf("expected valid=%v for %q, got %v", tc.valid, tc.text, err)
+		}
+	}
+}
+
+func TestGenerateRetriesRejectedResponses(t *testing.T) {
+	first := Request{Prompt: "Write a number"}
+	message := "the answer must match the regular expression ^\\d+$"
+	retry := Request{
+		Prompt:  fmt.Sprintf(retryPrompt, message),
+		History: []Message{{Role: RoleUser, Text: "Write a number"}, {Role: RoleModel, Text: "Sure! 7"}},
+	}
+	sf := replayFor(t, map[*Request]string{&first: "Sure! 7", &retry: "7"})
+	sf.Processors = []Processor{MatchRegexp(regexp.MustCompile(`^\d+$`))}
+
+	res, err := sf.Generate(context.Background(), Request{Prompt: "Write a number", ValidationRetries: 1})
+	if err != nil || res.Text != "7" {
+		t.Fatalf("expected the answer to the retry, got %v (%v)", res, err)
+	}
+
+	// Without retries, the validation error is returned
+	_, err = sf.Generate(context.Background(), Request{Prompt: "Write a number"})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || validationErr.Attempts != 1 || validationErr.Text != "Sure! 7" {
+		t.Errorf("expected a *ValidationError after 1 attempt, got %v", err)
+	}
+
+	// Processors of the request are applied after the ones of the SimpleFlash
+	res, err = sf.Generate(context.Background(), Request{
+		Prompt:            "Write a number",
+		ValidationRetries: 1,
+		Processors:        []Processor{func(text string) (string, error) { return "#" + text, nil }},
+	})
+	if err != nil || res.Text != "#7" {
+		t.Errorf("expected the processor of the request to be applied, got %v (%v)", res, err)
+	}
+}
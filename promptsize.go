@@ -0,0 +1,196 @@
+package simpleflash
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// PromptSizePolicy decides what happens to prompts that exceed the context window of the model
+type PromptSizePolicy int
+
+const (
+	// PromptReject makes the query fail with a *PromptTooLargeError
+	PromptReject PromptSizePolicy = iota
+	// PromptTruncateStart removes text from the start of the prompt
+	PromptTruncateStart
+	// PromptTruncateEnd removes text from the end of the prompt
+	PromptTruncateEnd
+	// PromptTruncateMiddle removes text from the middle of the prompt, keeping the start and the end
+	PromptTruncateMiddle
+	// PromptChunk splits the prompt into chunks, summarizes each chunk and then combines the summaries.
+	// The result is a summary of the prompt, not a direct response to it.
+	PromptChunk
+)
+
+// charsPerToken is the approximate number of characters per token, used by EstimateTokens
+const charsPerToken = 4
+
+// truncationMarker is inserted where text was removed by PromptTruncateMiddle
+const truncationMarker = "\n[...]\n"
+
+// PromptTooLargeError is returned when a prompt exceeds the context window of a model
+type PromptTooLargeError struct {
+	ModelName string
+	Tokens    int // the estimated number of tokens in the prompt
+	Limit     int // the context window of the model
+}
+
+func (e *PromptTooLargeError) Error() string {
+	return fmt.Sprintf("prompt is too large for %s: about %d tokens, but the limit is %d", e.ModelName, e.Tokens, e.Limit)
+}
+
+// OutputTooLargeError is returned when more output tokens are requested than a model can produce
+type OutputTooLargeError struct {
+	ModelName string
+	Tokens    int // the requested maximum number of output tokens
+	Limit     int // the maximum output of the model
+}
+
+func (e *OutputTooLargeError) Error() string {
+	return fmt.Sprintf("too many output tokens requested for %s: %d, but the limit is %d", e.ModelName, e.Tokens, e.Limit)
+}
+
+// InlineDataTooLargeError is returned when the given data exceeds the inline data limit of a model
+type InlineDataTooLargeError struct {
+	ModelName string
+	Size      int // the size of the decoded data, in bytes
+	Limit     int // the maximum inline data size of the model, in bytes
+}
+
+func (e *InlineDataTooLargeError) Error() string {
+	return fmt.Sprintf("inline data is too large for %s: %d bytes, but the limit is %d", e.ModelName, e.Size, e.Limit)
+}
+
+// EstimateTokens returns a rough estimate of the number of tokens in the given text,
+// without contacting the VertexAI API
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + charsPerToken - 1) / charsPerToken
+}
+
+// contextTokens returns the estimated number of tokens that are sent with the prompt of the request,
+// in the system instruction and the history
+func contextTokens(req Request) int {
+	tokens := EstimateTokens(req.System)
+	for _, msg := range req.History {
+		tokens += EstimateTokens(msg.Text)
+	}
+	return tokens
+}
+
+// guardPrompt checks the request against the limits of the given model and applies the policy. The system
+// instruction, the history and their attachments count towards the limits, but only the prompt is truncated or
+// chunked. The returned prompt may be truncated. If chunk is true, the prompt must be processed with summarizePrompt.
+func (sf *SimpleFlash) guardPrompt(policy PromptSizePolicy, modelName string, req Request) (string, bool, error) {
+	prompt := req.Prompt
+	limits, ok := sf.LimitsFor(modelName)
+	if !ok {
+		return prompt, false, nil
+	}
+	attachments := req.Attachments
+	for _, msg := range req.History {
+		attachments = append(attachments[:len(attachments):len(attachments)], msg.Attachments...)
+	}
+	if len(attachments) > 0 && limits.MaxInlineData > 0 {
+		if size := attachmentsSize(attachments); size > limits.MaxInlineData {
+			return "", false, &InlineDataTooLargeError{ModelName: modelName, Size: size, Limit: limits.MaxInlineData}
+		}
+	}
+	other := contextTokens(req)
+	tokens := EstimateTokens(prompt) + other
+	if limits.ContextWindow <= 0 || tokens <= limits.ContextWindow {
+		return prompt, false, nil
+	}
+	tooLarge := &PromptTooLargeError{ModelName: modelName, Tokens: tokens, Limit: limits.ContextWindow}
+	if other >= limits.ContextWindow {
+		return "", false, fmt.Errorf("the system instruction and the history leave no room for the prompt: %w", tooLarge)
+	}
+	switch policy {
+	case PromptTruncateStart, PromptTruncateEnd, PromptTruncateMiddle:
+		return truncatePrompt(prompt, limits.ContextWindow-other, policy), false, nil
+	case PromptChunk:
+		if len(req.Attachments) > 0 {
+			return "", false, fmt.Errorf("a prompt with data can not be chunked: %w", tooLarge)
+		}
+		return prompt, true, nil
+	}
+	return "", false, tooLarge
+}
+
+// truncatePrompt shortens the prompt so that it is estimated to fit within maxTokens
+func truncatePrompt(prompt string, maxTokens int, policy PromptSizePolicy) string {
+	runes := []rune(prompt)
+	maxRunes := maxTokens * charsPerToken
+	if len(runes) <= maxRunes {
+		return prompt
+	}
+	switch policy {
+	case PromptTruncateStart:
+		return string(runes[len(runes)-maxRunes:])
+	case PromptTruncateMiddle:
+		keep := maxRunes - utf8.RuneCountInString(truncationMarker)
+		if keep <= 0 {
+			return string(runes[:maxRunes])
+		}
+		head := keep / 2
+		tail := keep - head
+		return string(runes[:head]) + truncationMarker + string(runes[len(runes)-tail:])
+	}
+	return string(runes[:maxRunes])
+}
+
+// splitPrompt splits the prompt into chunks that are estimated to fit within maxTokens,
+// preferably at paragraph, line or word boundaries
+func splitPrompt(prompt string, maxTokens int) []string {
+	maxRunes := maxTokens * charsPerToken
+	if maxRunes <= 0 {
+		return []string{prompt}
+	}
+	var chunks []string
+	runes := []rune(prompt)
+	for len(runes) > maxRunes {
+		cut := maxRunes
+		window := string(runes[:maxRunes])
+		for _, sep := range []string{"\n\n", "\n", " "} {
+			if pos := strings.LastIndex(window, sep); pos > 0 {
+				// Only split at a boundary if it keeps at least half of the chunk
+				if n := utf8.RuneCountInString(window[:pos+len(sep)]); n >= maxRunes/2 {
+					cut = n
+					break
+				}
+			}
+		}
+		chunks = append(chunks, string(runes[:cut]))
+		runes = runes[cut:]
+	}
+	if len(runes) > 0 {
+		chunks = append(chunks, string(runes))
+	}
+	return chunks
+}
+
+// summarizePrompt summarizes a prompt that is too large for the model, for PromptChunk, like Summarize does
+// with SummaryMapReduce. The other settings of the request are used for every call.
+func (sf *SimpleFlash) summarizePrompt(ctx context.Context, modelName string, req Request) (*Response, error) {
+	limits, _ := sf.LimitsFor(modelName)
+	reject := PromptReject
+	req.Policy = &reject
+	// Leave room for the system instruction and the history, which are sent with every chunk
+	chunkTokens := max((limits.ContextWindow-contextTokens(req))*9/10, 1)
+	s := sf.newSummarizer(SummarizeOptions{Model: modelName, ChunkTokens: chunkTokens}, req, func(ctx context.Context, req Request) (*Response, error) {
+		return sf.generate(ctx, req, nil)
+	})
+	summary, err := s.run(ctx, req.Prompt)
+	if err != nil {
+		return nil, err
+	}
+	return &Response{
+		Text:         summary.Text,
+		Model:        modelName,
+		Cached:       summary.Cached == summary.Calls,
+		InputTokens:  s.inputTokens,
+		OutputTokens: s.outputTokens,
+		Cost:         summary.Cost,
+	}, nil
+}
@@ -0,0 +1,121 @@
+package simpleflash
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLimitsFor(t *testing.T) {
+	sf := &SimpleFlash{}
+
+	limits, ok := sf.LimitsFor("gemini-1.0-pro-vision-001")
+	if !ok {
+		t.Fatal("expected limits for gemini-1.0-pro-vision-001")
+	}
+	if limits != DefaultModelLimits["gemini-1.0-pro-vision"] {
+		t.Errorf("expected the gemini-1.0-pro-vision limits, got %+v", limits)
+	}
+
+	if _, ok := sf.LimitsFor("publishers/google/models/gemini-1.5-flash"); !ok {
+		t.Error("expected limits for a model name with a path prefix")
+	}
+
+	if _, ok := sf.LimitsFor("unknown-model"); ok {
+		t.Error("expected no limits for an unknown model")
+	}
+
+	sf.ModelLimits = map[string]ModelLimits{"gemini-1.5-flash": {ContextWindow: 10}}
+	if limits, _ := sf.LimitsFor("gemini-1.5-flash-001"); limits.ContextWindow != 10 {
+		t.Errorf("expected the overridden context window 10, got %d", limits.ContextWindow)
+	}
+}
+
+func TestGuardPrompt(t *testing.T) {
+	sf := &SimpleFlash{ModelLimits: map[string]ModelLimits{"tiny": {ContextWindow: 10, MaxInlineData: 3}}}
+	prompt := strings.Repeat("abcd", 20)
+
+	_, _, err := sf.guardPrompt(PromptReject, "tiny", Request{Prompt: prompt})
+	var tooLarge *PromptTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("expected a *PromptTooLargeError, got %v", err)
+	}
+	if tooLarge.Tokens != 20 || tooLarge.Limit != 10 {
+		t.Errorf("expected 20 tokens and a limit of 10, got %d and %d", tooLarge.Tokens, tooLarge.Limit)
+	}
+
+	truncated, chunk, err := sf.guardPrompt(PromptTruncateEnd, "tiny", Request{Prompt: prompt})
+	if err != nil || chunk {
+		t.Fatalf("expected truncation without error, got %v", err)
+	}
+	if EstimateTokens(truncated) > 10 {
+		t.Errorf("expected the truncated prompt to fit, got %d tokens", EstimateTokens(truncated))
+	}
+
+	if _, chunk, _ := sf.guardPrompt(PromptChunk, "tiny", Request{Prompt: prompt}); !chunk {
+		t.Error("expected the prompt to be chunked")
+	}
+
+	data := []Attachment{{MIMEType: "image/png", Data: []byte("123456")}}
+	_, _, err = sf.guardPrompt(PromptReject, "tiny", Request{Prompt: "hi", Attachments: data})
+	var dataTooLarge *InlineDataTooLargeError
+	if !errors.As(err, &dataTooLarge) {
+		t.Errorf("expected an *InlineDataTooLargeError, got %v", err)
+	}
+
+	if out, _, err := sf.guardPrompt(PromptReject, "unknown-model", Request{Prompt: prompt}); err != nil || out != prompt {
+		t.Errorf("expected prompts for unknown models to pass through, got %v", err)
+	}
+
+	// The system instruction and the history count too
+	chat := Request{Prompt: "hello", System: "Be brief.", History: []Message{{Role: RoleUser, Text: strings.Repeat("abcd", 5)}, {Role: RoleModel, Text: "ok"}}}
+	if _, _, err := sf.guardPrompt(PromptReject, "tiny", chat); !errors.As(err, &tooLarge) || tooLarge.Tokens != 11 {
+		t.Errorf("expected a *PromptTooLargeError for 11 tokens, got %v", err)
+	}
+	chat.Prompt = strings.Repeat("abcd", 4)
+	if truncated, _, err := sf.guardPrompt(PromptTruncateEnd, "tiny", chat); err != nil || EstimateTokens(truncated) != 1 {
+		t.Errorf("expected the prompt to be truncated to the 1 token that is left, got %q (%v)", truncated, err)
+	}
+	chat.System = strings.Repeat("abcd", 4)
+	if _, _, err := sf.guardPrompt(PromptTruncateEnd, "tiny", chat); !errors.As(err, &tooLarge) {
+		t.Errorf("expected a *PromptTooLargeError when there is no room for the prompt, got %v", err)
+	}
+	history := Request{Prompt: "hi", History: []Message{{Role: RoleUser, Text: "look", Attachments: data}}}
+	if _, _, err := sf.guardPrompt(PromptReject, "tiny", history); !errors.As(err, &dataTooLarge) {
+		t.Errorf("expected an *InlineDataTooLargeError for data in the history, got %v", err)
+	}
+}
+
+func TestTruncatePrompt(t *testing.T) {
+	prompt := "0123456789abcdefghijklmnopqrstuvwxyz"
+
+	if got := truncatePrompt(prompt, 2, PromptTruncateStart); got != "stuvwxyz" {
+		t.Errorf("expected the end to be kept, got %q", got)
+	}
+	if got := truncatePrompt(prompt, 2, PromptTruncateEnd); got != "01234567" {
+		t.Errorf("expected the start to be kept, got %q", got)
+	}
+	got := truncatePrompt(prompt, 5, PromptTruncateMiddle)
+	if !strings.HasPrefix(got, "012") || !strings.HasSuffix(got, "xyz") || !strings.Contains(got, truncationMarker) {
+		t.Errorf("expected the start and the end to be kept, got %q", got)
+	}
+	if got := truncatePrompt("short", 10, PromptTruncateEnd); got != "short" {
+		t.Errorf("expected a short prompt to be unchanged, got %q", got)
+	}
+}
+
+func TestSplitPrompt(t *testing.T) {
+	prompt := strings.Repeat("word ", 100)
+	chunks := splitPrompt(prompt, 10)
+	if strings.Join(chunks, "") != prompt {
+		t.Error("expected the chunks to add up to the prompt")
+	}
+	for i, chunk := range chunks {
+		if EstimateTokens(chunk) > 10 {
+			t.Errorf("chunk %d is too large: %d tokens", i, EstimateTokens(chunk))
+		}
+		if i < len(chunks)-1 && !strings.HasSuffix(chunk, " ") {
+			t.Errorf("expected chunk %d to end at a word boundary, got %q", i, chunk)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package simpleflash
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrInvalidOptions is returned by Query when the given options are inconsistent
+var ErrInvalidOptions = errors.New("invalid query options")
+
+// CachePolicy is how a call to Query uses the cache
+type CachePolicy int
+
+const (
+	CacheDefault CachePolicy = iota // read from and write to the cache, if sf.Cache is set
+	CacheSkip                       // neither read from nor write to the cache
+	CacheRefresh                    // do not read from the cache, but store the new response
+)
+
+// QueryOptions are the settings of a call to Query. The zero value uses the settings of the SimpleFlash.
+type QueryOptions struct {
+	Temperature *float64          // if nil, defaultTemperature is used
+	Attachments []Attachment      // optional data, like images
+	Model       string            // if empty, sf.ModelName is used, or sf.MultiModalModelName if there are attachments
+	System      string            // an optional system instruction
+	Cache       CachePolicy       // how the cache is used
+	Timeout     time.Duration     // if > 0, overrides sf.Timeout
+	Policy      *PromptSizePolicy // if nil, sf.PromptSizePolicy is used
+	Mode        Mode              // if ModeDefault, sf.Mode is used
+	Candidates  int               // if > 1, this many answers are generated, and Selector picks one. Not in ModeDeterministic or at temperature 0.
+	Selector    Selector          // picks the answer from the candidates, the first one if nil
+
+	problems         []string // problems found while applying the options, reported by Query
+	allowEmptyPrompt bool     // set by QueryGemini, which sends empty prompts as they are
+}
+
+// QueryOption changes the QueryOptions of a call to Query
+type QueryOption func(*QueryOptions)
+
+// WithTemperature sets the temperature, from 0 to 2
+func WithTemperature(temperature float64) QueryOption {
+	return func(o *QueryOptions) {
+		o.Temperature = &temperature
+	}
+}
+
+// WithAttachment attaches data, like an image, with the given MIME type
+func WithAttachment(mimeType string, data []byte) QueryOption {
+	return func(o *QueryOptions) {
+		o.Attachments = append(o.Attachments, Attachment{MIMEType: mimeType, Data: data})
+	}
+}
+
+// WithBase64Attachment attaches base64-encoded data, like an image, with the given MIME type
+func WithBase64Attachment(mimeType, base64Data string) QueryOption {
+	return func(o *QueryOptions) {
+		data, err := base64.StdEncoding.DecodeString(base64Data)
+		if err != nil {
+			o.problems = append(o.problems, fmt.Sprintf("failed to decode base64 data: %v", err))
+			return
+		}
+		o.Attachments = append(o.Attachments, Attachment{MIMEType: mimeType, Data: data})
+	}
+}
+
+// WithModel uses the given model instead of the default one
+func WithModel(modelName string) QueryOption {
+	return func(o *QueryOptions) {
+		o.Model = modelName
+	}
+}
+
+// WithSystem sets the system instruction
+func WithSystem(system string) QueryOption {
+	return func(o *QueryOptions) {
+		o.System = system
+	}
+}
+
+// WithCachePolicy sets how the cache is used
+func WithCachePolicy(policy CachePolicy) QueryOption {
+	return func(o *QueryOptions) {
+		o.Cache = policy
+	}
+}
+
+// WithTimeout sets the timeout of the call, instead of sf.Timeout
+func WithTimeout(timeout time.Duration) QueryOption {
+	return func(o *QueryOptions) {
+		o.Timeout = timeout
+	}
+}
+
+// WithPromptSizePolicy sets what to do if the prompt is too large for the model
+func WithPromptSizePolicy(policy PromptSizePolicy) QueryOption {
+	return func(o *QueryOptions) {
+		o.Policy = &policy
+	}
+}
+
+// WithMode sets the mode, like ModeDeterministic or ModeCreative
+func WithMode(mode Mode) QueryOption {
+	return func(o *QueryOptions) {
+		o.Mode = mode
+	}
+}
+
+// WithCandidates generates n answers, and uses the given selector, like MajorityVote, to pick one
+func WithCandidates(n int, selector Selector) QueryOption {
+	return func(o *QueryOptions) {
+		o.Candidates = n
+		o.Selector = selector
+	}
+}
+
+// Query sends a prompt to Gemini, with the given options, and returns the text of the response.
+// Inconsistent options result in an error that wraps ErrInvalidOptions, and nothing is sent.
+func (sf *SimpleFlash) Query(ctx context.Context, prompt string, options ...QueryOption) (string, error) {
+	var opts QueryOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	return sf.query(ctx, prompt, opts)
+}
+
+// query sends a prompt to Gemini with the given options, and returns the text of the response
+func (sf *SimpleFlash) query(ctx context.Context, prompt string, opts QueryOptions) (string, error) {
+	req, err := sf.queryRequest(prompt, opts)
+	if err != nil {
+		return "", err
+	}
+	res, err := sf.Generate(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	return res.Text, nil
+}
+
+// queryRequest validates the options and converts them to a Request
+func (sf *SimpleFlash) queryRequest(prompt string, opts QueryOptions) (Request, error) {
+	problems := opts.problems
+	if strings.TrimSpace(prompt) == "" && len(opts.Attachments) == 0 && !opts.allowEmptyPrompt {
+		problems = append(problems, "the prompt is empty and there are no attachments")
+	}
+	if t := opts.Temperature; t != nil && (*t < 0 || *t > 2) {
+		problems = append(problems, fmt.Sprintf("the temperature must be from 0 to 2, not %g", *t))
+	}
+	if t := opts.Temperature; t != nil && *t != 0 {
+		switch {
+		case opts.Mode == ModeDeterministic:
+			problems = append(problems, fmt.Sprintf("the temperature is %g, but deterministic mode uses temperature 0", *t))
+		case opts.Mode == ModeDefault && sf.Mode == ModeDeterministic:
+			problems = append(problems, fmt.Sprintf("the temperature is %g, but the SimpleFlash is in deterministic mode, which uses temperature 0", *t))
+		}
+	}
+	if opts.Mode < ModeDefault || opts.Mode > ModeCreative {
+		problems = append(problems, fmt.Sprintf("unknown mode %d", opts.Mode))
+	}
+	if opts.Candidates < 0 {
+		problems = append(problems, fmt.Sprintf("the number of candidates must not be negative, not %d", opts.Candidates))
+	} else if opts.Selector != nil && opts.Candidates < 2 {
+		problems = append(problems, "a selector is given, but less than 2 candidates are requested")
+	} else if opts.Candidates > 1 && (opts.Mode == ModeDeterministic || opts.Mode == ModeDefault && sf.Mode == ModeDeterministic) {
+		problems = append(problems, fmt.Sprintf("%d candidates are requested in deterministic mode, where they would all be the same", opts.Candidates))
+	} else if t := opts.Temperature; opts.Candidates > 1 && t != nil && *t == 0 {
+		problems = append(problems, fmt.Sprintf("%d candidates are requested at temperature 0, where they would all be the same", opts.Candidates))
+	}
+	for i, attachment := range opts.Attachments {
+		if attachment.MIMEType == "" {
+			problems = append(problems, fmt.Sprintf("attachment %d has no MIME type", i+1))
+		}
+		if len(attachment.Data) == 0 {
+			problems = append(problems, fmt.Sprintf("attachment %d is empty", i+1))
+		}
+	}
+	if len(opts.Attachments) > 0 && opts.Model == "" && sf.MultiModalModelName == "" {
+		problems = append(problems, "there are attachments, but no multimodal model is configured")
+	}
+	if opts.Timeout < 0 {
+		problems = append(problems, fmt.Sprintf("the timeout must not be negative, not %v", opts.Timeout))
+	}
+	switch opts.Cache {
+	case CacheDefault, CacheSkip:
+	case CacheRefresh:
+		if sf.Cache == nil {
+			problems = append(problems, "the cache should be refreshed, but the cache is not enabled")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown cache policy %d", opts.Cache))
+	}
+	if len(problems) > 0 {
+		return Request{}, fmt.Errorf("%w: %s", ErrInvalidOptions, strings.Join(problems, "; "))
+	}
+	return Request{
+		Prompt:       prompt,
+		Model:        opts.Model,
+		Temperature:  opts.Temperature,
+		System:       opts.System,
+		Attachments:  opts.Attachments,
+		Policy:       opts.Policy,
+		NoCache:      opts.Cache == CacheSkip,
+		RefreshCache: opts.Cache == CacheRefresh,
+		Timeout:      opts.Timeout,
+		Mode:         opts.Mode,
+		Candidates:   opts.Candidates,
+		Selector:     opts.Selector,
+	}, nil
+}
@@ -0,0 +1,73 @@
+package simpleflash
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	temperature := 0.0
+	sf := replayFor(t, map[*Request]string{
+		{Prompt: "What is this?", Temperature: &temperature, System: "Be brief.", Attachments: []Attachment{{MIMEType: "image/png", Data: []byte("png")}}}: "A picture.",
+	})
+	text, err := sf.Query(context.Background(), "What is this?",
+		WithTemperature(0),
+		WithSystem("Be brief."),
+		WithBase64Attachment("image/png", base64.StdEncoding.EncodeToString([]byte("png"))),
+		WithTimeout(time.Minute),
+	)
+	if err != nil || text != "A picture." {
+		t.Errorf("expected the recorded answer, got %q (%v)", text, err)
+	}
+}
+
+func TestQueryOptionsValidation(t *testing.T) {
+	sf := &SimpleFlash{ModelName: testModelName}
+	for _, tc := range []struct {
+		options []QueryOption
+		problem string
+	}{
+		{[]QueryOption{WithTemperature(3)}, "temperature"},
+		{[]QueryOption{WithBase64Attachment("image/png", "not base64!")}, "base64"},
+		{[]QueryOption{WithBase64Attachment("", "cG5n"), WithModel(testMultiModalModelName)}, "no MIME type"},
+		{[]QueryOption{WithAttachment("image/png", nil), WithModel(testMultiModalModelName)}, "is empty"},
+		{[]QueryOption{WithAttachment("image/png", []byte("png"))}, "no multimodal model"},
+		{[]QueryOption{WithCachePolicy(CacheRefresh)}, "cache is not enabled"},
+		{[]QueryOption{WithTimeout(-time.Second)}, "timeout"},
+		{[]QueryOption{WithCandidates(1, MajorityVote())}, "less than 2 candidates"},
+		{[]QueryOption{WithTemperature(1), WithMode(ModeDeterministic)}, "deterministic mode"},
+	} {
+		_, err := sf.Query(context.Background(), "x", tc.options...)
+		if !errors.Is(err, ErrInvalidOptions) || !strings.Contains(err.Error(), tc.problem) {
+			t.Errorf("expected an ErrInvalidOptions error about %q, got %v", tc.problem, err)
+		}
+	}
+
+	// QueryGemini no longer ignores data without a MIME type
+	data := "cG5n"
+	if _, err := sf.QueryGemini("x", nil, &data, nil); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("expected an ErrInvalidOptions error for data without a MIME type, got %v", err)
+	}
+
+	// Only Query rejects an empty prompt
+	if _, err := sf.Query(context.Background(), " "); !errors.Is(err, ErrInvalidOptions) {
+		t.Errorf("expected an ErrInvalidOptions error for an empty prompt, got %v", err)
+	}
+	if _, err := sf.queryRequest("", QueryOptions{allowEmptyPrompt: true}); err != nil {
+		t.Errorf("expected QueryGemini to send an empty prompt, got %v", err)
+	}
+
+	// The temperature is checked against the mode of the SimpleFlash too
+	sf.Mode = ModeDeterministic
+	if _, err := sf.Query(context.Background(), "x", WithTemperature(1)); !errors.Is(err, ErrInvalidOptions) || !strings.Contains(err.Error(), "deterministic mode") {
+		t.Errorf("expected an ErrInvalidOptions error for a temperature in deterministic mode, got %v", err)
+	}
+	temperature := 1.0
+	if _, err := sf.queryRequest("x", QueryOptions{Temperature: &temperature, Mode: ModeCreative}); err != nil {
+		t.Errorf("expected an explicit mode to override the mode of the SimpleFlash, got %v", err)
+	}
+}
@@ -0,0 +1,332 @@
+package simpleflash
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default chunk settings for a DocumentStore
+const (
+	DefaultChunkSize    = 1000 // characters
+	DefaultChunkOverlap = 100  // characters
+)
+
+// Chunk is a part of an ingested document, together with its embedding
+type Chunk struct {
+	Source    string    `json:"source"` // the path of the document
+	Index     int       `json:"index"`  // the position of the chunk in the document
+	Text      string    `json:"text"`
+	Embedding []float32 `json:"embedding"`
+}
+
+// ScoredChunk is a chunk that was found by a search, with its cosine similarity to the query
+type ScoredChunk struct {
+	Chunk
+	Score float64 `json:"score"`
+}
+
+// DocumentStore is a local vector index of document chunks, that is saved to a JSON file.
+// It is safe for concurrent use.
+type DocumentStore struct {
+	ChunkSize    int // the maximum number of characters in a chunk
+	ChunkOverlap int // the number of characters that are repeated at the start of the next chunk
+	mut          sync.RWMutex
+	path         string
+	model        string // the embedding model of the chunks
+	chunks       []Chunk
+}
+
+// documentStoreFile is the file format of a DocumentStore
+type documentStoreFile struct {
+	Model  string  `json:"model"`
+	Chunks []Chunk `json:"chunks"`
+}
+
+// Answer is the result of Ask
+type Answer struct {
+	Text     string        `json:"text"`
+	Sources  []ScoredChunk `json:"sources"` // the retrieved chunks, numbered from 1 in the prompt
+	Cited    []int         `json:"cited"`   // the numbers of the sources that are cited in the answer
+	Response *Response     `json:"response"`
+}
+
+// OpenDocumentStore opens the document store that is saved in the given file, or creates an empty one
+// if the file does not exist
+func OpenDocumentStore(path string) (*DocumentStore, error) {
+	ds := &DocumentStore{ChunkSize: DefaultChunkSize, ChunkOverlap: DefaultChunkOverlap, path: path}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ds, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the document store: %v", err)
+	}
+	var f documentStoreFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse the document store %s: %v", path, err)
+	}
+	ds.model, ds.chunks = f.Model, f.Chunks
+	return ds, nil
+}
+
+// Save writes the document store to its file
+func (ds *DocumentStore) Save() error {
+	ds.mut.RLock()
+	data, err := json.Marshal(documentStoreFile{Model: ds.model, Chunks: ds.chunks})
+	ds.mut.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode the document store: %v", err)
+	}
+	// Write to a temporary file first, so that the store is not lost if writing fails
+	tmp := ds.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write the document store: %v", err)
+	}
+	return os.Rename(tmp, ds.path)
+}
+
+// Len returns the number of chunks in the document store
+func (ds *DocumentStore) Len() int {
+	ds.mut.RLock()
+	defer ds.mut.RUnlock()
+	return len(ds.chunks)
+}
+
+// Sources returns the sorted paths of the documents in the document store
+func (ds *DocumentStore) Sources() []string {
+	ds.mut.RLock()
+	defer ds.mut.RUnlock()
+	seen := make(map[string]bool)
+	var sources []string
+	for _, chunk := range ds.chunks {
+		if !seen[chunk.Source] {
+			seen[chunk.Source] = true
+			sources = append(sources, chunk.Source)
+		}
+	}
+	sort.Strings(sources)
+	return sources
+}
+
+// Remove removes all chunks of the given document
+func (ds *DocumentStore) Remove(source string) {
+	ds.mut.Lock()
+	defer ds.mut.Unlock()
+	ds.chunks = removeSource(ds.chunks, source)
+}
+
+// Search returns the k chunks that are most similar to the given embedding, the most similar first.
+// No chunks are returned if k is 0 or negative.
+func (ds *DocumentStore) Search(embedding []float32, k int) []ScoredChunk {
+	if k <= 0 {
+		return nil
+	}
+	ds.mut.RLock()
+	defer ds.mut.RUnlock()
+	scored := make([]ScoredChunk, 0, len(ds.chunks))
+	for _, chunk := range ds.chunks {
+		scored = append(scored, ScoredChunk{Chunk: chunk, Score: CosineSimilarity(embedding, chunk.Embedding)})
+	}
+	sort.SliceStable(scored, func(i, j int) bool { return scored[i].Score > scored[j].Score })
+	if k < len(scored) {
+		scored = scored[:k]
+	}
+	return scored
+}
+
+// add replaces the chunks of a document with the given chunks
+func (ds *DocumentStore) add(modelName, source string, chunks []Chunk) error {
+	ds.mut.Lock()
+	defer ds.mut.Unlock()
+	if ds.model != "" && ds.model != modelName && len(ds.chunks) > 0 {
+		return fmt.Errorf("the document store contains embeddings from %s, not %s", ds.model, modelName)
+	}
+	ds.model = modelName
+	ds.chunks = append(removeSource(ds.chunks, source), chunks...)
+	return nil
+}
+
+// removeSource returns the chunks that are not from the given document
+func removeSource(chunks []Chunk, source string) []Chunk {
+	kept := chunks[:0:0]
+	for _, chunk := range chunks {
+		if chunk.Source != source {
+			kept = append(kept, chunk)
+		}
+	}
+	return kept
+}
+
+// Ingest reads the given text, Markdown or PDF files, splits them into chunks, embeds the chunks
+// and adds them to the document store, replacing earlier versions of the same files.
+// The document store is saved afterwards.
+func (sf *SimpleFlash) Ingest(ctx context.Context, ds *DocumentStore, paths ...string) error {
+	modelName := sf.EmbeddingModelName
+	if modelName == "" {
+		modelName = DefaultEmbeddingModelName
+	}
+	for _, path := range paths {
+		text, err := readDocument(path)
+		if err != nil {
+			return err
+		}
+		texts := ChunkText(text, ds.ChunkSize, ds.ChunkOverlap)
+		embeddings, err := sf.Embed(ctx, texts, EmbedOptions{Model: modelName, TaskType: TaskRetrievalDocument})
+		if err != nil {
+			return fmt.Errorf("failed to embed %s: %w", path, err)
+		}
+		chunks := make([]Chunk, len(texts))
+		for i, text := range texts {
+			chunks[i] = Chunk{Source: path, Index: i, Text: text, Embedding: embeddings[i]}
+		}
+		if err := ds.add(modelName, path, chunks); err != nil {
+			return err
+		}
+	}
+	return ds.Save()
+}
+
+// Ask answers the question with the k chunks of the document store that are most similar to it.
+// The answer cites the chunks it is based on, like [1].
+func (sf *SimpleFlash) Ask(ctx context.Context, question string, ds *DocumentStore, k int) (*Answer, error) {
+	if k <= 0 {
+		return nil, fmt.Errorf("the number of chunks to answer with must be at least 1, not %d", k)
+	}
+	modelName := sf.EmbeddingModelName
+	if modelName == "" {
+		modelName = DefaultEmbeddingModelName
+	}
+	ds.mut.RLock()
+	storeModel := ds.model
+	ds.mut.RUnlock()
+	if storeModel != "" && storeModel != modelName {
+		return nil, fmt.Errorf("the document store contains embeddings from %s, not %s", storeModel, modelName)
+	}
+
+	embeddings, err := sf.Embed(ctx, []string{question}, EmbedOptions{Model: modelName, TaskType: TaskRetrievalQuery})
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed the question: %w", err)
+	}
+	sources := ds.Search(embeddings[0], k)
+	res, err := sf.Generate(ctx, Request{Prompt: groundedPrompt(question, sources)})
+	if err != nil {
+		return nil, err
+	}
+	return &Answer{Text: res.Text, Sources: sources, Cited: citations(res.Text, len(sources)), Response: res}, nil
+}
+
+// groundedPrompt builds a prompt that asks for an answer that is based on the given sources, with citations
+func groundedPrompt(question string, sources []ScoredChunk) string {
+	var sb strings.Builder
+	sb.WriteString("Answer the question using only the sources below. ")
+	sb.WriteString("Cite the sources you use with their numbers in square brackets, like [1]. ")
+	sb.WriteString("If the sources do not contain the answer, say that you do not know.\n\nSources:\n")
+	for i, source := range sources {
+		fmt.Fprintf(&sb, "\n[%d] %s, part %d:\n%s\n", i+1, filepath.Base(source.Source), source.Index+1, source.Text)
+	}
+	fmt.Fprintf(&sb, "\nQuestion: %s\n", question)
+	return sb.String()
+}
+
+var citationPattern = regexp.MustCompile(`\[(\d+)\]`)
+
+// citations returns the sorted source numbers, from 1 to n, that are cited in the given text
+func citations(text string, n int) []int {
+	seen := make(map[int]bool)
+	var cited []int
+	for _, match := range citationPattern.FindAllStringSubmatch(text, -1) {
+		i, err := strconv.Atoi(match[1])
+		if err == nil && i >= 1 && i <= n && !seen[i] {
+			seen[i] = true
+			cited = append(cited, i)
+		}
+	}
+	sort.Ints(cited)
+	return cited
+}
+
+// readDocument returns the text of a text, Markdown or PDF file
+func readDocument(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read document: %v", err)
+	}
+	if strings.EqualFold(filepath.Ext(path), ".pdf") {
+		text, err := pdfText(data)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", path, err)
+		}
+		return text, nil
+	}
+	return string(data), nil
+}
+
+// ChunkText splits the text into chunks of at most size characters, preferably at paragraph, line or word
+// boundaries. Each chunk starts with up to overlap characters from the end of the previous chunk.
+func ChunkText(text string, size, overlap int) []string {
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	if overlap < 0 || overlap >= size {
+		overlap = 0
+	}
+	runes := []rune(strings.TrimSpace(text))
+	var chunks []string
+	for start := 0; start < len(runes); {
+		end := start + size
+		if end >= len(runes) {
+			chunks = append(chunks, string(runes[start:]))
+			break
+		}
+		// Prefer to end the chunk at a paragraph, line or word boundary in the second half of the chunk
+		if cut := boundary(runes[start+size/2 : end]); cut >= 0 {
+			end = start + size/2 + cut
+		}
+		chunks = append(chunks, strings.TrimSpace(string(runes[start:end])))
+		next := end - overlap
+		if next <= start {
+			next = end
+		}
+		start = next
+	}
+	return chunks
+}
+
+// boundary returns the position after the last paragraph break, newline or space in the given runes,
+// or -1 if there is none
+func boundary(runes []rune) int {
+	s := string(runes)
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		if i := strings.LastIndex(s, sep); i >= 0 {
+			return len([]rune(s[:i+len(sep)]))
+		}
+	}
+	return -1
+}
+
+// CosineSimilarity returns the cosine similarity of two vectors, or 0 if they have different lengths
+func CosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,130 @@
+package simpleflash
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChunkText(t *testing.T) {
+	if chunks := ChunkText("short text", 100, 10); len(chunks) != 1 || chunks[0] != "short text" {
+		t.Errorf("expected one chunk, got %q", chunks)
+	}
+	text := strings.Repeat("word ", 100) + "\n\n" + strings.Repeat("other ", 100)
+	chunks := ChunkText(text, 200, 20)
+	if len(chunks) < 5 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+	for _, chunk := range chunks {
+		if len([]rune(chunk)) > 200 {
+			t.Errorf("expected at most 200 characters, got %d", len([]rune(chunk)))
+		}
+		if strings.Contains(chunk, "wor ") || strings.HasSuffix(chunk, "wo") {
+			t.Errorf("expected chunks to end at word boundaries, got %q", chunk)
+		}
+	}
+}
+
+func TestDocumentStore(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"fruit.md":   "# Fruit\n\nApples are red or green. Bananas are yellow.",
+		"trains.txt": "Trains run on rails. Fast trains are called high-speed trains.",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sf := &SimpleFlash{Embedder: &FakeEmbedder{}, Timeout: time.Minute}
+	path := filepath.Join(dir, "store.json")
+	ds, err := OpenDocumentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sf.Ingest(context.Background(), ds, filepath.Join(dir, "fruit.md"), filepath.Join(dir, "trains.txt")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// Ingesting a file again replaces its chunks
+	if err := sf.Ingest(context.Background(), ds, filepath.Join(dir, "fruit.md")); err != nil {
+		t.Fatal(err)
+	}
+	if ds.Len() != 2 {
+		t.Errorf("expected 2 chunks, got %d", ds.Len())
+	}
+
+	reopened, err := OpenDocumentStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reopened.Sources(), ds.Sources()) || reopened.Len() != 2 {
+		t.Fatalf("expected the saved store to be loaded, got %v", reopened.Sources())
+	}
+	query, _ := sf.Embed(context.Background(), []string{"Which trains are fast?"}, EmbedOptions{})
+	results := reopened.Search(query[0], 1)
+	if len(results) != 1 || !strings.HasSuffix(results[0].Source, "trains.txt") || results[0].Score <= 0 {
+		t.Errorf("expected the trains document to be found, got %+v", results)
+	}
+
+	reopened.Remove(filepath.Join(dir, "trains.txt"))
+	if reopened.Len() != 1 {
+		t.Errorf("expected 1 chunk after removing a document, got %d", reopened.Len())
+	}
+
+	// The embedding model must match the one in the store
+	sf.EmbeddingModelName = "other-model"
+	if err := sf.Ingest(context.Background(), ds, filepath.Join(dir, "trains.txt")); err == nil {
+		t.Error("expected an error for a different embedding model")
+	}
+}
+
+func TestAsk(t *testing.T) {
+	dir := t.TempDir()
+	doc := filepath.Join(dir, "cows.txt")
+	if err := os.WriteFile(doc, []byte("Cows are black and white, or brown."), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fake := &FakeEmbedder{}
+	ds, err := OpenDocumentStore(filepath.Join(dir, "store.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&SimpleFlash{Embedder: fake, Timeout: time.Minute}).Ingest(context.Background(), ds, doc); err != nil {
+		t.Fatal(err)
+	}
+
+	question := "What color are cows?"
+	query, _ := fake.Embed(context.Background(), "", []string{question}, EmbedOptions{})
+	sources := ds.Search(query[0], 3)
+	sf := replayFor(t, map[*Request]string{{Prompt: groundedPrompt(question, sources)}: "Black and white, or brown [1]."})
+	sf.Embedder = fake
+
+	answer, err := sf.Ask(context.Background(), question, ds, 3)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if answer.Text != "Black and white, or brown [1]." || len(answer.Sources) != 1 || !reflect.DeepEqual(answer.Cited, []int{1}) {
+		t.Errorf("unexpected answer %+v", answer)
+	}
+	if !strings.Contains(groundedPrompt(question, sources), "[1] cows.txt, part 1:\nCows are black and white") {
+		t.Errorf("expected the sources to be numbered in the prompt, got %q", groundedPrompt(question, sources))
+	}
+
+	for _, k := range []int{0, -1} {
+		if results := ds.Search(query[0], k); len(results) != 0 {
+			t.Errorf("expected no chunks for k %d, got %d", k, len(results))
+		}
+		if _, err := sf.Ask(context.Background(), question, ds, k); err == nil {
+			t.Errorf("expected an error for k %d", k)
+		}
+	}
+}
+
+func TestCitations(t *testing.T) {
+	if got := citations("See [2], [1] and [2], but not [7] or [x].", 3); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("expected [1 2], got %v", got)
+	}
+}
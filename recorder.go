@@ -0,0 +1,477 @@
+package simpleflash
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/env"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RecorderMode decides if a Recorder records or replays requests
+type RecorderMode int
+
+const (
+	// RecordMode sends requests to VertexAI and saves the requests and responses to a fixture file
+	RecordMode RecorderMode = iota
+	// ReplayMode serves responses from a fixture file, without contacting VertexAI
+	ReplayMode
+)
+
+// Environment variables that enable recording or replaying, when a SimpleFlash is created with New.
+// The value is the path to the fixture file.
+const (
+	RecordEnv = "SIMPLEFLASH_RECORD"
+	ReplayEnv = "SIMPLEFLASH_REPLAY"
+)
+
+// RecordedPart is a text or data part of a recorded request
+type RecordedPart struct {
+	Text     string `json:"text,omitempty"`
+	MIMEType string `json:"mime_type,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+}
+
+// RecordedContent is an earlier turn of a conversation in a recorded request
+type RecordedContent struct {
+	Role  string         `json:"role"`
+	Parts []RecordedPart `json:"parts"`
+}
+
+// RecordedRequest is a request, as saved in a fixture file
+type RecordedRequest struct {
+	Kind    string            `json:"kind"` // "generateContent", "countTokens" or "embed"
+	Model   string            `json:"model"`
+	Config  json.RawMessage   `json:"config,omitempty"`
+	History []RecordedContent `json:"history,omitempty"`
+	Parts   []RecordedPart    `json:"parts"`
+}
+
+// RecordedCandidate is a candidate of a recorded response
+type RecordedCandidate struct {
+	Text         string `json:"text"`
+	FinishReason int32  `json:"finish_reason,omitempty"`
+}
+
+// RecordedResponse is a response, as saved in a fixture file
+type RecordedResponse struct {
+	Candidates   []RecordedCandidate `json:"candidates,omitempty"`
+	InputTokens  int                 `json:"input_tokens,omitempty"`
+	OutputTokens int                 `json:"output_tokens,omitempty"`
+	TotalTokens  int                 `json:"total_tokens,omitempty"`
+	Embeddings   [][]float32         `json:"embeddings,omitempty"`
+}
+
+// RecordedError is the type and the details of a recorded error, so that an error of the same type
+// can be returned when replaying, and errors.As and errors.Is work the same as when recording
+type RecordedError struct {
+	Kind               string             `json:"kind"`                           // "blocked", "api", "grpc", "timeout" or "canceled"
+	Code               int                `json:"code,omitempty"`                 // the HTTP status code of an API error, or the gRPC code
+	Message            string             `json:"message,omitempty"`              // the message of an API or gRPC error
+	Candidate          *RecordedCandidate `json:"candidate,omitempty"`            // the blocked candidate
+	BlockReason        int32              `json:"block_reason,omitempty"`         // why the prompt was blocked
+	BlockReasonMessage string             `json:"block_reason_message,omitempty"` // why the prompt was blocked
+	PromptBlocked      bool               `json:"prompt_blocked,omitempty"`       // true if the prompt was blocked
+}
+
+// Interaction is a request together with the response or the error it resulted in
+type Interaction struct {
+	Request      RecordedRequest   `json:"request"`
+	Response     *RecordedResponse `json:"response,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	ErrorDetails *RecordedError    `json:"error_details,omitempty"` // nil for errors of other types
+}
+
+// UnmatchedRequestError is returned in ReplayMode when a request is not found in the fixture file
+type UnmatchedRequestError struct {
+	Path    string
+	Request string // the request, as JSON
+}
+
+func (e *UnmatchedRequestError) Error() string {
+	return fmt.Sprintf("no recorded response in %s for request: %s", e.Path, e.Request)
+}
+
+// Recorder records requests and responses to a fixture file, or replays responses from it.
+// Each interaction is appended to the fixture file as a line of JSON when it is recorded.
+// Fixture files with a JSON array of interactions can also be replayed. It is safe for concurrent use.
+type Recorder struct {
+	mut          sync.Mutex
+	mode         RecorderMode
+	path         string
+	interactions []Interaction
+	served       map[string]int // the number of times each request has been replayed
+}
+
+// NewRecorder creates a new Recorder for the given fixture file.
+// In ReplayMode, the fixture file is read immediately. In RecordMode, the fixture file is truncated.
+func NewRecorder(mode RecorderMode, path string) (*Recorder, error) {
+	r := &Recorder{mode: mode, path: path, served: make(map[string]int)}
+	if mode == RecordMode {
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			return nil, fmt.Errorf("failed to create the fixture file: %v", err)
+		}
+		return r, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the fixture file: %v", err)
+	}
+	if r.interactions, err = parseFixture(data); err != nil {
+		return nil, fmt.Errorf("failed to parse the fixture file %s: %v", path, err)
+	}
+	return r, nil
+}
+
+// parseFixture parses a fixture file with a JSON array of interactions, or with one interaction per line
+func parseFixture(data []byte) ([]Interaction, error) {
+	var interactions []Interaction
+	if data = bytes.TrimSpace(data); bytes.HasPrefix(data, []byte("[")) {
+		err := json.Unmarshal(data, &interactions)
+		return interactions, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var interaction Interaction
+		if err := dec.Decode(&interaction); err == io.EOF {
+			return interactions, nil
+		} else if err != nil {
+			return nil, err
+		}
+		interactions = append(interactions, interaction)
+	}
+}
+
+// recorderFromEnv creates a Recorder if RecordEnv or ReplayEnv is set
+func recorderFromEnv() (*Recorder, error) {
+	if path := env.Str(ReplayEnv); path != "" {
+		return NewRecorder(ReplayMode, path)
+	}
+	if path := env.Str(RecordEnv); path != "" {
+		return NewRecorder(RecordMode, path)
+	}
+	return nil, nil
+}
+
+// Mode returns the mode of the Recorder
+func (r *Recorder) Mode() RecorderMode {
+	return r.mode
+}
+
+// Interactions returns a copy of the recorded or loaded interactions
+func (r *Recorder) Interactions() []Interaction {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return append([]Interaction(nil), r.interactions...)
+}
+
+// generateContent replays the response for the given request, or sends it and records the response.
+// When replaying, a response is passed to onChunk in one piece.
+func (r *Recorder) generateContent(model *genai.GenerativeModel, history []*genai.Content, parts []genai.Part, onChunk ChunkFunc, send func() (*genai.GenerateContentResponse, error)) (*genai.GenerateContentResponse, error) {
+	req, err := newRecordedRequest("generateContent", model, history, parts)
+	if err != nil {
+		return nil, err
+	}
+	if r.mode == ReplayMode {
+		interaction, err := r.replay(req)
+		if err != nil {
+			return nil, err
+		}
+		res := interaction.Response.toGenai()
+		if onChunk != nil {
+			if text, err := responseText(res); err == nil {
+				onChunk(text)
+			}
+		}
+		return res, nil
+	}
+	res, err := send()
+	interaction := Interaction{Request: req, Response: fromGenai(res)}
+	if err != nil {
+		interaction.Error = err.Error()
+		interaction.ErrorDetails = recordError(err)
+	}
+	if saveErr := r.record(interaction); saveErr != nil {
+		return nil, saveErr
+	}
+	return res, err
+}
+
+// countTokens replays the token count for the given text, or counts the tokens and records the count
+func (r *Recorder) countTokens(modelName, text string, count func() (int, error)) (int, error) {
+	req := RecordedRequest{Kind: "countTokens", Model: modelName, Parts: []RecordedPart{{Text: text}}}
+	if r.mode == ReplayMode {
+		interaction, err := r.replay(req)
+		if err != nil {
+			return 0, err
+		}
+		return interaction.Response.TotalTokens, nil
+	}
+	n, err := count()
+	interaction := Interaction{Request: req}
+	if err != nil {
+		interaction.Error = err.Error()
+		interaction.ErrorDetails = recordError(err)
+	} else {
+		interaction.Response = &RecordedResponse{TotalTokens: n}
+	}
+	if saveErr := r.record(interaction); saveErr != nil {
+		return 0, saveErr
+	}
+	return n, err
+}
+
+// embed replays the embeddings of the given texts, or computes the embeddings and records them
+func (r *Recorder) embed(modelName string, texts []string, opts EmbedOptions, embed func() ([][]float32, error)) ([][]float32, error) {
+	config, err := json.Marshal(struct {
+		TaskType   EmbedTaskType `json:"task_type,omitempty"`
+		Dimensions int           `json:"dimensions,omitempty"`
+	}{opts.TaskType, opts.Dimensions})
+	if err != nil {
+		return nil, err
+	}
+	req := RecordedRequest{Kind: "embed", Model: modelName, Config: config}
+	for _, text := range texts {
+		req.Parts = append(req.Parts, RecordedPart{Text: text})
+	}
+	if r.mode == ReplayMode {
+		interaction, err := r.replay(req)
+		if err != nil {
+			return nil, err
+		}
+		return interaction.Response.Embeddings, nil
+	}
+	embeddings, err := embed()
+	interaction := Interaction{Request: req}
+	if err != nil {
+		interaction.Error = err.Error()
+		interaction.ErrorDetails = recordError(err)
+	} else {
+		interaction.Response = &RecordedResponse{Embeddings: embeddings}
+	}
+	if saveErr := r.record(interaction); saveErr != nil {
+		return nil, saveErr
+	}
+	return embeddings, err
+}
+
+// replay finds the recorded interaction for the given request. If the same request was recorded
+// several times, the interactions are replayed in order, and the last one is repeated.
+func (r *Recorder) replay(req RecordedRequest) (Interaction, error) {
+	key, err := json.Marshal(req)
+	if err != nil {
+		return Interaction{}, err
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	var matches []Interaction
+	for _, interaction := range r.interactions {
+		if otherKey, err := json.Marshal(interaction.Request); err == nil && string(otherKey) == string(key) {
+			matches = append(matches, interaction)
+		}
+	}
+	if len(matches) == 0 {
+		return Interaction{}, &UnmatchedRequestError{Path: r.path, Request: string(key)}
+	}
+	i := r.served[string(key)]
+	if i >= len(matches) {
+		i = len(matches) - 1
+	}
+	r.served[string(key)]++
+	interaction := matches[i]
+	if interaction.Error != "" {
+		return Interaction{}, interaction.ErrorDetails.restore(interaction.Error)
+	}
+	if interaction.Response == nil {
+		interaction.Response = &RecordedResponse{}
+	}
+	return interaction, nil
+}
+
+// record adds the interaction, and appends it to the fixture file
+func (r *Recorder) record(interaction Interaction) error {
+	data, err := json.Marshal(interaction)
+	if err != nil {
+		return fmt.Errorf("failed to encode the interaction: %v", err)
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.interactions = append(r.interactions, interaction)
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open the fixture file: %v", err)
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write the fixture file: %v", err)
+	}
+	return f.Close()
+}
+
+// replayedError is a recorded error, with the message of the original error and an error of the same type
+type replayedError struct {
+	message string
+	err     error
+}
+
+func (e *replayedError) Error() string {
+	return e.message
+}
+
+func (e *replayedError) Unwrap() error {
+	return e.err
+}
+
+// recordError returns the type and the details of the given error, or nil if it is of another type
+func recordError(err error) *RecordedError {
+	var (
+		blockedErr *genai.BlockedError
+		apiErr     *googleapi.Error
+	)
+	switch {
+	case errors.As(err, &blockedErr):
+		recorded := &RecordedError{Kind: "blocked"}
+		if c := blockedErr.Candidate; c != nil {
+			recorded.Candidate = &RecordedCandidate{FinishReason: int32(c.FinishReason)}
+		}
+		if feedback := blockedErr.PromptFeedback; feedback != nil {
+			recorded.PromptBlocked = true
+			recorded.BlockReason = int32(feedback.BlockReason)
+			recorded.BlockReasonMessage = feedback.BlockReasonMessage
+		}
+		return recorded
+	case errors.As(err, &apiErr):
+		return &RecordedError{Kind: "api", Code: apiErr.Code, Message: apiErr.Message}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &RecordedError{Kind: "timeout"}
+	case errors.Is(err, context.Canceled):
+		return &RecordedError{Kind: "canceled"}
+	}
+	if s, ok := status.FromError(err); ok {
+		return &RecordedError{Kind: "grpc", Code: int(s.Code()), Message: s.Message()}
+	}
+	return nil
+}
+
+// restore returns an error with the given message, that wraps an error of the recorded type
+func (recorded *RecordedError) restore(message string) error {
+	if recorded == nil {
+		return errors.New(message)
+	}
+	var err error
+	switch recorded.Kind {
+	case "blocked":
+		blockedErr := &genai.BlockedError{}
+		if recorded.Candidate != nil {
+			blockedErr.Candidate = &genai.Candidate{FinishReason: genai.FinishReason(recorded.Candidate.FinishReason)}
+		}
+		if recorded.PromptBlocked {
+			blockedErr.PromptFeedback = &genai.PromptFeedback{BlockReason: genai.BlockedReason(recorded.BlockReason), BlockReasonMessage: recorded.BlockReasonMessage}
+		}
+		err = blockedErr
+	case "api":
+		err = &googleapi.Error{Code: recorded.Code, Message: recorded.Message}
+	case "grpc":
+		err = status.Error(codes.Code(recorded.Code), recorded.Message)
+	case "timeout":
+		err = context.DeadlineExceeded
+	case "canceled":
+		err = context.Canceled
+	default:
+		return errors.New(message)
+	}
+	return &replayedError{message: message, err: err}
+}
+
+// newRecordedRequest describes the given model configuration, history and parts as a RecordedRequest
+func newRecordedRequest(kind string, model *genai.GenerativeModel, history []*genai.Content, parts []genai.Part) (RecordedRequest, error) {
+	config, err := json.Marshal(struct {
+		GenerationConfig  genai.GenerationConfig `json:"generation_config"`
+		SystemInstruction *genai.Content         `json:"system_instruction,omitempty"`
+	}{model.GenerationConfig, model.SystemInstruction})
+	if err != nil {
+		return RecordedRequest{}, fmt.Errorf("failed to encode the request: %v", err)
+	}
+	req := RecordedRequest{Kind: kind, Model: model.Name(), Config: config}
+	for _, content := range history {
+		recordedParts, err := recordParts(content.Parts)
+		if err != nil {
+			return RecordedRequest{}, err
+		}
+		req.History = append(req.History, RecordedContent{Role: content.Role, Parts: recordedParts})
+	}
+	if req.Parts, err = recordParts(parts); err != nil {
+		return RecordedRequest{}, err
+	}
+	return req, nil
+}
+
+// recordParts converts the given genai parts to RecordedParts
+func recordParts(parts []genai.Part) ([]RecordedPart, error) {
+	var recorded []RecordedPart
+	for _, part := range parts {
+		switch p := part.(type) {
+		case genai.Text:
+			recorded = append(recorded, RecordedPart{Text: string(p)})
+		case genai.Blob:
+			recorded = append(recorded, RecordedPart{MIMEType: p.MIMEType, Data: p.Data})
+		case genai.FileData:
+			recorded = append(recorded, RecordedPart{MIMEType: p.MIMEType, Text: p.FileURI})
+		default:
+			return nil, fmt.Errorf("can not record a part of type %T", part)
+		}
+	}
+	return recorded, nil
+}
+
+// fromGenai converts a response from VertexAI to a RecordedResponse
+func fromGenai(res *genai.GenerateContentResponse) *RecordedResponse {
+	if res == nil {
+		return nil
+	}
+	recorded := &RecordedResponse{}
+	for _, candidate := range res.Candidates {
+		if candidate == nil {
+			continue
+		}
+		c := RecordedCandidate{FinishReason: int32(candidate.FinishReason)}
+		if candidate.Content != nil && len(candidate.Content.Parts) > 0 {
+			c.Text = fmt.Sprintf("%s", candidate.Content.Parts[0])
+		}
+		recorded.Candidates = append(recorded.Candidates, c)
+	}
+	if res.UsageMetadata != nil {
+		recorded.InputTokens = int(res.UsageMetadata.PromptTokenCount)
+		recorded.OutputTokens = int(res.UsageMetadata.CandidatesTokenCount)
+		recorded.TotalTokens = int(res.UsageMetadata.TotalTokenCount)
+	}
+	return recorded
+}
+
+// toGenai converts a RecordedResponse back to a response, as if it came from VertexAI
+func (recorded *RecordedResponse) toGenai() *genai.GenerateContentResponse {
+	res := &genai.GenerateContentResponse{
+		UsageMetadata: &genai.UsageMetadata{
+			PromptTokenCount:     int32(recorded.InputTokens),
+			CandidatesTokenCount: int32(recorded.OutputTokens),
+			TotalTokenCount:      int32(recorded.TotalTokens),
+		},
+	}
+	for i, c := range recorded.Candidates {
+		res.Candidates = append(res.Candidates, &genai.Candidate{
+			Index:        int32(i),
+			Content:      &genai.Content{Role: "model", Parts: []genai.Part{genai.Text(c.Text)}},
+			FinishReason: genai.FinishReason(c.FinishReason),
+		})
+	}
+	return res
+}
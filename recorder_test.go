@@ -0,0 +1,224 @@
+package simpleflash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// writeFixture records the given interactions to a fixture file in a temporary directory
+func writeFixture(t *testing.T, interactions ...Interaction) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fixture.json")
+	r, err := NewRecorder(RecordMode, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, interaction := range interactions {
+		if err := r.record(interaction); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(interactions) == 0 {
+		if err := os.WriteFile(path, []byte("[]"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestReplay(t *testing.T) {
+	client, err := genai.NewClient(context.Background(), "test-project", testLocation, option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := client.GenerativeModel(testModelName)
+	model.SetTemperature(defaultTemperature)
+	req, err := newRecordedRequest("generateContent", model, nil, []genai.Part{genai.Text("Test prompt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeFixture(t,
+		Interaction{Request: req, Response: &RecordedResponse{
+			Candidates:   []RecordedCandidate{{Text: " Black and white. ", FinishReason: int32(genai.FinishReasonStop)}},
+			InputTokens:  2,
+			OutputTokens: 3,
+		}},
+		Interaction{
+			Request:  RecordedRequest{Kind: "countTokens", Model: testModelName, Parts: []RecordedPart{{Text: "Test prompt"}}},
+			Response: &RecordedResponse{TotalTokens: 2},
+		},
+	)
+
+	sf, err := NewReplay(path, testModelName, testMultiModalModelName, false)
+	if err != nil {
+		t.Fatalf("could not create a replaying SimpleFlash: %v", err)
+	}
+
+	result, err := sf.QueryGemini("Test prompt", nil, nil, nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if result != "Black and white." {
+		t.Errorf("expected the recorded response, got %q", result)
+	}
+	if total := sf.Costs.Total(); total.InputTokens != 2 || total.OutputTokens != 3 {
+		t.Errorf("expected the recorded token usage, got %+v", total)
+	}
+
+	tokenCount, err := sf.CountTextTokens("Test prompt")
+	if err != nil || tokenCount != 2 {
+		t.Errorf("expected the recorded token count 2, got %d (%v)", tokenCount, err)
+	}
+
+	_, err = sf.QueryGemini("An unknown prompt", nil, nil, nil)
+	var unmatched *UnmatchedRequestError
+	if !errors.As(err, &unmatched) {
+		t.Errorf("expected an *UnmatchedRequestError, got %v", err)
+	}
+}
+
+func TestReplayRecordedError(t *testing.T) {
+	req := RecordedRequest{Kind: "countTokens", Model: testModelName, Parts: []RecordedPart{{Text: "x"}}}
+	path := writeFixture(t,
+		Interaction{Request: req, Error: "quota exceeded"},
+		Interaction{Request: req, Response: &RecordedResponse{TotalTokens: 1}},
+	)
+	r, err := NewRecorder(ReplayMode, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.countTokens(testModelName, "x", nil); err == nil || err.Error() != "quota exceeded" {
+		t.Errorf("expected the recorded error first, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if n, err := r.countTokens(testModelName, "x", nil); err != nil || n != 1 {
+			t.Errorf("expected the last interaction to be repeated, got %d (%v)", n, err)
+		}
+	}
+}
+
+func TestReplayStream(t *testing.T) {
+	client, err := genai.NewClient(context.Background(), "test-project", testLocation, option.WithoutAuthentication())
+	if err != nil {
+		t.Fatal(err)
+	}
+	model := client.GenerativeModel(testModelName)
+	model.SetTemperature(defaultTemperature)
+	history := historyContents([]Message{{Role: RoleUser, Text: "Hi"}, {Role: RoleModel, Text: "Hello!"}})
+	req, err := newRecordedRequest("generateContent", model, history, []genai.Part{genai.Text("How are you?")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeFixture(t, Interaction{Request: req, Response: &RecordedResponse{Candidates: []RecordedCandidate{{Text: "Fine."}}}})
+
+	sf, err := NewReplay(path, testModelName, testMultiModalModelName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var streamed strings.Builder
+	res, err := sf.GenerateStream(context.Background(), Request{
+		Prompt:  "How are you?",
+		History: []Message{{Role: RoleUser, Text: "Hi"}, {Role: RoleModel, Text: "Hello!"}},
+	}, func(chunk string) { streamed.WriteString(chunk) })
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if res.Text != "Fine." || streamed.String() != "Fine." {
+		t.Errorf("expected the recorded response to be returned and streamed, got %q and %q", res.Text, streamed.String())
+	}
+
+	// Without the history, the request does not match
+	if _, err := sf.Generate(context.Background(), Request{Prompt: "How are you?"}); err == nil {
+		t.Error("expected an error for a request without the recorded history")
+	}
+}
+
+func TestReplayTypedErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixture.json")
+	r, err := NewRecorder(RecordMode, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := map[string]error{
+		"blocked": fmt.Errorf("unable to generate contents: %w", &genai.BlockedError{PromptFeedback: &genai.PromptFeedback{BlockReason: genai.BlockedReasonSafety}}),
+		"grpc":    status.Error(codes.ResourceExhausted, "quota exceeded"),
+		"timeout": fmt.Errorf("failed: %w", context.DeadlineExceeded),
+		"untyped": errors.New("something else"),
+	}
+	for text, recordedErr := range recorded {
+		if _, err := r.countTokens(testModelName, text, func() (int, error) { return 0, recordedErr }); err != recordedErr {
+			t.Fatalf("expected the error to be returned while recording, got %v", err)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != len(recorded) {
+		t.Errorf("expected one line per interaction in the fixture file, got %d lines", lines)
+	}
+
+	r, err = NewRecorder(ReplayMode, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay := func(text string) error {
+		_, err := r.countTokens(testModelName, text, nil)
+		if err == nil || err.Error() != recorded[text].Error() {
+			t.Errorf("expected the recorded message %q, got %v", recorded[text], err)
+		}
+		return err
+	}
+	var blockedErr *genai.BlockedError
+	if err := replay("blocked"); !errors.As(err, &blockedErr) || blockedErr.PromptFeedback.BlockReason != genai.BlockedReasonSafety {
+		t.Errorf("expected a *genai.BlockedError for the prompt, got %#v", err)
+	}
+	if err := replay("grpc"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected the gRPC code to be kept, got %v", status.Code(err))
+	}
+	if err := replay("timeout"); !errors.Is(err, context.DeadlineExceeded) || errorType(err) != "timeout" {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	replay("untyped")
+}
+
+func TestRecordEmbeddings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixture.json")
+	r, err := NewRecorder(RecordMode, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	texts := []string{"the red apple", "trains are fast"}
+	opts := EmbedOptions{TaskType: TaskRetrievalDocument, Dimensions: 8}
+	recording := &SimpleFlash{Embedder: &FakeEmbedder{}, Recorder: r, Timeout: time.Minute}
+	recorded, err := recording.Embed(context.Background(), texts, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The embeddings are replayed without an Embedder
+	replaying, err := NewReplay(path, testModelName, testMultiModalModelName, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed, err := replaying.Embed(context.Background(), texts, opts)
+	if err != nil || !reflect.DeepEqual(replayed, recorded) {
+		t.Errorf("expected the recorded embeddings, got %v (%v)", replayed, err)
+	}
+	var unmatched *UnmatchedRequestError
+	if _, err := replaying.Embed(context.Background(), texts, EmbedOptions{}); !errors.As(err, &unmatched) {
+		t.Errorf("expected an *UnmatchedRequestError for other options, got %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+package simpleflash
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xyproto/simpleflash/internal/resp"
+)
+
+// maxIdleRedisConns is the number of connections that RedisKV keeps open for reuse
+const maxIdleRedisConns = 8
+
+// DefaultRedisTimeout is how long a Redis command may take, if RedisKV.Timeout is 0 and the context has no deadline
+const DefaultRedisTimeout = 5 * time.Second
+
+// RedisKV is a KV that stores the entries in Redis, or in another server that speaks the
+// Redis protocol (RESP), so that several processes can share the cache
+type RedisKV struct {
+	Addr        string        // like "localhost:6379"
+	Password    string        // sent with AUTH, if set
+	DB          int           // selected with SELECT, if not 0
+	Prefix      string        // added to every key, like "simpleflash:"
+	DialTimeout time.Duration // 5 seconds if 0
+	Timeout     time.Duration // the deadline of commands with a context without one, DefaultRedisTimeout if 0
+
+	mut  sync.Mutex
+	idle []*redisConn
+}
+
+// RedisError is an error reply from a Redis server
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a connection to a Redis server
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+// NewRedisKV creates a RedisKV for the Redis server at the given address
+func NewRedisKV(addr string) *RedisKV {
+	return &RedisKV{Addr: addr, Prefix: "simpleflash:"}
+}
+
+// Get returns the value with the given key, or ErrCacheMiss
+func (r *RedisKV) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := r.do(ctx, "GET", r.Prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrCacheMiss
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply to GET: %v", reply)
+	}
+	return value, nil
+}
+
+// Set stores the value with the given key. It expires after ttl, or never if ttl is 0.
+func (r *RedisKV) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	args := []any{"SET", r.Prefix + key, value}
+	if ttl > 0 {
+		args = append(args, "PX", max(ttl.Milliseconds(), 1))
+	}
+	_, err := r.do(ctx, args...)
+	return err
+}
+
+// Delete removes the value with the given key, if there is one
+func (r *RedisKV) Delete(ctx context.Context, key string) error {
+	_, err := r.do(ctx, "DEL", r.Prefix+key)
+	return err
+}
+
+// TTL returns the time until the value with the given key expires, 0 if it does not expire, or ErrCacheMiss
+func (r *RedisKV) TTL(ctx context.Context, key string) (time.Duration, error) {
+	reply, err := r.do(ctx, "PTTL", r.Prefix+key)
+	if err != nil {
+		return 0, err
+	}
+	ms, ok := reply.(int64)
+	switch {
+	case !ok:
+		return 0, fmt.Errorf("unexpected reply to PTTL: %v", reply)
+	case ms == -2:
+		return 0, ErrCacheMiss
+	case ms < 0:
+		return 0, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Close closes the idle connections
+func (r *RedisKV) Close() error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	var errs []error
+	for _, c := range r.idle {
+		errs = append(errs, c.conn.Close())
+	}
+	r.idle = nil
+	return errors.Join(errs...)
+}
+
+// do sends a command and returns the reply: nil, a string, an int64, a []byte or an []any
+func (r *RedisKV) do(ctx context.Context, args ...any) (any, error) {
+	c, err := r.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(ctx, r.timeout(), args...)
+	var redisErr RedisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// The connection may be in an unknown state
+		c.conn.Close()
+		return nil, err
+	}
+	r.release(c)
+	return reply, err
+}
+
+// conn returns an idle connection, or a new one
+func (r *RedisKV) conn(ctx context.Context) (*redisConn, error) {
+	r.mut.Lock()
+	if n := len(r.idle); n > 0 {
+		c := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mut.Unlock()
+		return c, nil
+	}
+	r.mut.Unlock()
+
+	timeout := r.DialTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", r.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %v", err)
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	if r.Password != "" {
+		if _, err := c.do(ctx, r.timeout(), "AUTH", r.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if r.DB != 0 {
+		if _, err := c.do(ctx, r.timeout(), "SELECT", r.DB); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// timeout returns how long a command may take, if the context has no deadline
+func (r *RedisKV) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return DefaultRedisTimeout
+}
+
+// release returns the connection to the pool of idle connections
+func (r *RedisKV) release(c *redisConn) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if len(r.idle) >= maxIdleRedisConns {
+		c.conn.Close()
+		return
+	}
+	r.idle = append(r.idle, c)
+}
+
+// do sends a command on the connection and reads the reply. If ctx has no deadline, the
+// command must be done within the given timeout.
+func (c *redisConn) do(ctx context.Context, timeout time.Duration, args ...any) (any, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := c.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	command := make([]any, len(args))
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case []byte:
+			command[i] = arg
+		case string:
+			command[i] = []byte(arg)
+		case int:
+			command[i] = strconv.AppendInt(nil, int64(arg), 10)
+		case int64:
+			command[i] = strconv.AppendInt(nil, arg, 10)
+		default:
+			return nil, fmt.Errorf("unsupported argument type %T", arg)
+		}
+	}
+	if err := resp.Write(c.w, command); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	reply, err := resp.Read(c.r)
+	var errorReply resp.Error
+	if errors.As(err, &errorReply) {
+		return nil, RedisError(errorReply)
+	}
+	return reply, err
+}
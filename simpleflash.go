@@ -3,50 +3,114 @@ package simpleflash
 import (
 	"context"
 	"crypto/sha256"
-	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/vertexai/genai"
-	"github.com/allegro/bigcache/v3"
 	"github.com/xyproto/env"
 	"github.com/xyproto/multimodal"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
 )
 
+// defaultTemperature is the temperature that is used when no temperature is given
+const defaultTemperature = 0.0
+
 type SimpleFlash struct {
 	ModelName           string
 	MultiModalModelName string
 	ProjectLocation     string
 	ProjectID           string
 	Client              *genai.Client
-	Cache               *bigcache.BigCache
+	Cache               KV // caches responses and embeddings, if set. A *bigcache.BigCache can be wrapped with NewMemoryKVFromBigCache.
 	Timeout             time.Duration
+	PromptSizePolicy    PromptSizePolicy       // what to do with prompts that are too large for the model
+	ModelLimits         map[string]ModelLimits // overrides DefaultModelLimits, if set
+	Prices              map[string]Price       // overrides DefaultPrices, if set
+	Costs               *CostTracker           // token usage and cost, shared by copies made with WithTag
+	TracerProvider      trace.TracerProvider   // uses the global tracer provider, if nil
+	MeterProvider       metric.MeterProvider   // uses the global meter provider, if nil
+	Logger              *slog.Logger           // logs requests and responses, if set
+	LogLevel            slog.Level             // the level of request and response records, errors are logged at slog.LevelError
+	LogContent          LogContent             // how much of the prompts and responses to log
+	Redact              RedactFunc             // applied to prompts, responses and errors before they are logged
+	Recorder            *Recorder              // records or replays requests, if set
+	Coalescer           *Coalescer             // collapses identical concurrent requests into one call, if set
+	CacheTTL            time.Duration          // how long a cached response is fresh, DefaultCacheTTL if 0
+	StaleTTL            time.Duration          // how long an expired response is still served, while it is refreshed in the background
+	NegativeTTL         time.Duration          // how long blocked prompts and invalid requests are cached, not at all if 0
+	Mode                Mode                   // deterministic or creative responses, for requests that do not set a mode
+	CreativeSamples     int                    // how many different responses are cached in ModeCreative, none if 0
+	EmbeddingModelName  string                 // the model that is used by Embed
+	Embedder            Embedder               // computes embeddings for Embed, VertexAI by default
+	Processors          []Processor            // applied to every response, before the processors of the request
+	ValidationRetries   int                    // how many times to ask again when a Processor rejects a response
+	costTag             string
+	rotation            map[string]int // how many times each request was sent in ModeCreative with samples, guarded by rotationMut
 }
 
 func New(modelName, multiModalModelName, projectLocation, projectID string, cache bool) (*SimpleFlash, error) {
+	// Record or replay requests, if RecordEnv or ReplayEnv is set
+	recorder, err := recorderFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return newSimpleFlash(modelName, multiModalModelName, projectLocation, projectID, cache, recorder)
+}
+
+// NewReplay creates a SimpleFlash that serves all responses from the given fixture file,
+// which can be created by setting RecordEnv or by using a Recorder in RecordMode.
+// No credentials are needed, and VertexAI is never contacted.
+func NewReplay(fixturePath, modelName, multiModalModelName string, cache bool) (*SimpleFlash, error) {
+	recorder, err := NewRecorder(ReplayMode, fixturePath)
+	if err != nil {
+		return nil, err
+	}
+	return newSimpleFlash(modelName, multiModalModelName, "", "", cache, recorder)
+}
+
+func newSimpleFlash(modelName, multiModalModelName, projectLocation, projectID string, cache bool, recorder *Recorder) (*SimpleFlash, error) {
 	sf := &SimpleFlash{
 		ModelName:           env.Str("MODEL_NAME", modelName),
 		MultiModalModelName: env.Str("MULTI_MODAL_MODEL_NAME", multiModalModelName),
 		ProjectLocation:     env.Str("PROJECT_LOCATION", projectLocation),
 		ProjectID:           env.Str("PROJECT_ID", projectID),
 		Timeout:             3 * time.Minute,
+		Costs:               NewCostTracker(0),
+		Recorder:            recorder,
+		Coalescer:           NewCoalescer(),
+		EmbeddingModelName:  env.Str("EMBEDDING_MODEL_NAME", DefaultEmbeddingModelName),
 	}
 
-	// Initialize the genai client
+	// Initialize the genai client. When replaying, no credentials are needed.
 	ctx := context.Background()
-	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
-	if err != nil {
-		return nil, fmt.Errorf("Failed to obtain default credentials: %v", err)
+	clientOption := option.WithoutAuthentication()
+	if recorder == nil || recorder.Mode() != ReplayMode {
+		creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/cloud-platform")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to obtain default credentials: %v", err)
+		}
+		clientOption = option.WithCredentials(creds)
 	}
-	genaiClient, err := genai.NewClient(ctx, sf.ProjectID, sf.ProjectLocation, option.WithCredentials(creds))
+	genaiClient, err := genai.NewClient(ctx, sf.ProjectID, sf.ProjectLocation, clientOption)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create genai client: %v", err)
 	}
 	sf.Client = genaiClient
 
+	// When replaying, there is no Embedder, and the recorded embeddings are used instead.
+	// The prediction client of the Embedder is created by the first call to Embed.
+	if recorder == nil || recorder.Mode() != ReplayMode {
+		sf.Embedder = newVertexEmbedder(sf.ProjectID, sf.ProjectLocation, clientOption)
+	}
+
 	// Initialize cache if the cache parameter is true
 	if cache {
 		err := sf.InitCache()
@@ -58,17 +122,22 @@ func New(modelName, multiModalModelName, projectLocation, projectID string, cach
 	return sf, nil
 }
 
-// InitCache initializes the BigCache cache
-func (sf *SimpleFlash) InitCache() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	config := bigcache.DefaultConfig(24 * time.Hour)
-	config.HardMaxCacheSize = 256 // MB
-	config.StatsEnabled = false
-	config.Verbose = false
+// Close closes the genai client and the Embedder, if it can be closed. The cache is not closed.
+func (sf *SimpleFlash) Close() error {
+	var errs []error
+	if sf.Client != nil {
+		errs = append(errs, sf.Client.Close())
+	}
+	if closer, ok := sf.Embedder.(io.Closer); ok {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
 
-	cache, err := bigcache.New(ctx, config)
+// InitCache initializes an in-memory cache of up to 256 MB. Call it again after changing CacheTTL, StaleTTL or NegativeTTL.
+// To share the cache between processes, set sf.Cache to a RedisKV instead.
+func (sf *SimpleFlash) InitCache() error {
+	cache, err := NewMemoryKV(sf.cacheLifetime(), 256)
 	if err != nil {
 		return err
 	}
@@ -76,74 +145,395 @@ func (sf *SimpleFlash) InitCache() error {
 	return nil
 }
 
+// Attachment is data, like an image, that is sent together with a prompt
+type Attachment struct {
+	MIMEType string `json:"mime_type"`
+	Data     []byte `json:"data"`
+}
+
+// Request is a query to Gemini, for use with Generate
+type Request struct {
+	Prompt            string
+	Model             string            // if empty, sf.ModelName is used, or sf.MultiModalModelName if there are attachments
+	Temperature       *float64          // if nil, defaultTemperature is used, or DefaultCandidateTemperature for several candidates
+	System            string            // an optional system instruction
+	Attachments       []Attachment      // optional data, like images
+	History           []Message         // optional earlier turns of a conversation
+	MaxOutputTokens   int               // if 0, the default of the model is used
+	StopSequences     []string          // optional sequences that stop the generation
+	ResponseSchema    *genai.Schema     // if set, the response is JSON that matches the schema
+	Policy            *PromptSizePolicy // if nil, sf.PromptSizePolicy is used
+	NoCache           bool              // if true, the cache is neither read from nor written to
+	RefreshCache      bool              // if true, the cache is not read from, but the response is stored
+	Timeout           time.Duration     // if > 0, overrides sf.Timeout
+	Processors        []Processor       // applied to the response, after sf.Processors
+	ValidationRetries int               // if > 0, overrides sf.ValidationRetries
+	Mode              Mode              // if ModeDefault, sf.Mode is used
+	CreativeSamples   int               // if > 0, overrides sf.CreativeSamples
+	Candidates        int               // if > 1, this many answers are generated, and Selector picks one. Not in ModeDeterministic or at temperature 0.
+	Selector          Selector          // picks the answer from the candidates, the first one if nil
+	sample            int               // which of the cached samples to use, in ModeCreative
+	retry             int               // how many responses to the request were rejected before, for telemetry
+	attachmentDigest  string            // identifies the attachments in the cache key instead of their data, if set
+}
+
+// Response is the result of a query to Gemini
+type Response struct {
+	Text         string     `json:"text"`
+	Model        string     `json:"model"`
+	Cached       bool       `json:"cached"`
+	FinishReason string     `json:"finish_reason,omitempty"`
+	InputTokens  int        `json:"input_tokens,omitempty"`
+	OutputTokens int        `json:"output_tokens,omitempty"`
+	Cost         float64    `json:"cost,omitempty"`       // in USD, 0 if the response was shared
+	Shared       bool       `json:"shared,omitempty"`     // true if the response of an identical concurrent request was used
+	Stale        bool       `json:"stale,omitempty"`      // true if the cached response is expired, and is being refreshed
+	CachedAt     *time.Time `json:"cached_at,omitempty"`  // when the cached response was received
+	Candidates   []string   `json:"candidates,omitempty"` // all answers, if several were requested and the response is not cached
+}
+
 // QueryGemini processes a prompt with optional temperature, base64-encoded data, and MIME type for the data.
+// Prompts that are too large for the model are handled according to sf.PromptSizePolicy.
+// Query takes the same settings, and more, as options.
 func (sf *SimpleFlash) QueryGemini(prompt string, temperature *float64, base64Data, dataMimeType *string) (string, error) {
-	modelName := sf.ModelName
+	return sf.QueryGeminiWithPolicy(sf.PromptSizePolicy, prompt, temperature, base64Data, dataMimeType)
+}
+
+// QueryGeminiWithPolicy is like QueryGemini, but uses the given policy for prompts that are too large for the model.
+// Data without a MIME type, or a MIME type without data, is an error. Unlike Query, an empty prompt is sent as it is.
+func (sf *SimpleFlash) QueryGeminiWithPolicy(policy PromptSizePolicy, prompt string, temperature *float64, base64Data, dataMimeType *string) (string, error) {
+	opts := QueryOptions{Policy: &policy, Temperature: temperature, allowEmptyPrompt: true}
+	if base64Data != nil || dataMimeType != nil {
+		var data, mimeType string
+		if base64Data != nil {
+			data = *base64Data
+		}
+		if dataMimeType != nil {
+			mimeType = *dataMimeType
+		}
+		WithBase64Attachment(mimeType, data)(&opts)
+	}
+	return sf.query(context.Background(), prompt, opts)
+}
+
+// Generate sends the given request to Gemini, or returns a cached response, and returns the response with metadata
+func (sf *SimpleFlash) Generate(ctx context.Context, req Request) (*Response, error) {
+	res, err := sf.generate(ctx, req, nil)
+	if err != nil {
+		return nil, err
+	}
+	return sf.postProcess(ctx, req, res, nil)
+}
+
+// generate sends the given request to Gemini, or returns a cached response. The response is streamed if onChunk is not nil.
+func (sf *SimpleFlash) generate(ctx context.Context, req Request, onChunk ChunkFunc) (res *Response, err error) {
+	req = sf.applyMode(req)
+	if req.Candidates > 1 {
+		switch {
+		case req.Mode == ModeDeterministic:
+			return nil, fmt.Errorf("%d candidates are requested in deterministic mode, where they would all be the same", req.Candidates)
+		case req.Temperature == nil:
+			temperature := DefaultCandidateTemperature
+			req.Temperature = &temperature
+		case *req.Temperature == 0:
+			return nil, fmt.Errorf("%d candidates are requested at temperature 0, where they would all be the same", req.Candidates)
+		}
+	}
+	modelName := sf.modelFor(req)
+
+	// Trace the call and record metrics
+	ctx, tel := sf.startCall(ctx, "QueryGemini", modelName)
+	defer func() { tel.end(res, err) }()
+	tel.retries(req.retry)
 
-	// Generate a unique cache key based on prompt and optionally on temperature, base64Data, and dataMimeType
-	cacheKeyComponents := prompt
-	if temperature != nil {
-		cacheKeyComponents += fmt.Sprintf("%f", *temperature)
+	// Check the prompt and data against the limits of the model before sending anything
+	policy := sf.PromptSizePolicy
+	if req.Policy != nil {
+		policy = *req.Policy
+	}
+	prompt, chunk, err := sf.guardPrompt(policy, modelName, req)
+	if err != nil {
+		return nil, err
 	}
-	if base64Data != nil {
-		cacheKeyComponents += *base64Data
-		modelName = sf.MultiModalModelName
+	if limits, ok := sf.LimitsFor(modelName); ok && limits.MaxOutput > 0 && req.MaxOutputTokens > limits.MaxOutput {
+		return nil, &OutputTooLargeError{ModelName: modelName, Tokens: req.MaxOutputTokens, Limit: limits.MaxOutput}
 	}
-	if dataMimeType != nil {
-		cacheKeyComponents += *dataMimeType
+	if chunk {
+		return sf.summarizePrompt(ctx, modelName, req)
 	}
-	cacheKey := fmt.Sprintf("%x", sha256.Sum256([]byte(cacheKeyComponents)))
+	req.Prompt = prompt
 
 	// Check cache for existing entry
-	if sf.Cache != nil {
-		if entry, err := sf.Cache.Get(cacheKey); err == nil {
-			return string(entry), nil
+	cacheKey := cacheKeyFor(modelName, req)
+	useCache := sf.Cache != nil && !req.NoCache
+	if useCache && !req.RefreshCache {
+		if entry, stale, ok := sf.loadEntry(ctx, cacheKey); ok {
+			tel.cacheLookup(true)
+			if res, err = entry.response(); err != nil {
+				return nil, err
+			}
+			if stale {
+				res.Stale = true
+				sf.revalidate(ctx, modelName, cacheKey, req)
+			}
+			if onChunk != nil {
+				onChunk(res.Text)
+			}
+			return res, nil
 		}
+		tel.cacheLookup(false)
 	}
 
-	// Initialize the multimodal instance, using the provided temperature if available
-	mm := multimodal.New(modelName, 0.0) // Default temperature
-	mm.SetTimeout(sf.Timeout)
-	if temperature != nil {
-		mm = multimodal.New(modelName, float32(*temperature))
-	}
-	mm.AddText(prompt)
+	tel.logRequest(req)
 
-	// If base64Data and dataMimeType are provided, decode the data and add it to the multimodal instance
-	if base64Data != nil && dataMimeType != nil {
-		data, err := base64.StdEncoding.DecodeString(*base64Data)
+	// Identical concurrent requests share one call to Gemini. Streamed requests are not shared.
+	if sf.Coalescer != nil && useCache && !req.RefreshCache && onChunk == nil {
+		var leader bool
+		res, leader, err = sf.Coalescer.Do(ctx, cacheKey, func(ctx context.Context) (*Response, error) {
+			return sf.call(ctx, tel, modelName, cacheKey, useCache, req, nil)
+		})
 		if err != nil {
-			return "", fmt.Errorf("failed to decode base64 data: %v", err)
+			return nil, err
+		}
+		if !leader {
+			tel.coalesced()
 		}
-		mm.AddData(*dataMimeType, data)
+		return res, nil
 	}
+	return sf.call(ctx, tel, modelName, cacheKey, useCache, req, onChunk)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), sf.Timeout)
+// call sends the request to Gemini, records the usage and stores the response in the cache, if useCache is true
+func (sf *SimpleFlash) call(ctx context.Context, tel *callTelemetry, modelName, cacheKey string, useCache bool, req Request, onChunk ChunkFunc) (*Response, error) {
+	// Stop here if the spend limit has been reached, or reserve the estimated cost until the usage is recorded
+	estimate, err := sf.reserveBudget(modelName, req)
+	if err != nil {
+		return nil, err
+	}
+	if sf.Costs != nil {
+		defer sf.Costs.Settle(estimate)
+	}
+
+	model := sf.configureModel(modelName, req)
+	parts := messageParts(req.Prompt, req.Attachments)
+
+	timeout := sf.Timeout
+	if req.Timeout > 0 {
+		timeout = req.Timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	// Submit the multimodal query and process the result
-	result, err := mm.SubmitToClient(ctx, sf.Client)
+	// Submit the query, record the token usage and process the result
+	var (
+		texts        []string
+		finishReason string
+		usage        Usage
+	)
+	history := historyContents(req.History)
+	if req.Candidates > 1 {
+		texts, finishReason, usage, err = sf.submitCandidates(ctx, tel, modelName, req, history, parts, req.Candidates)
+	} else {
+		texts, finishReason, usage, err = sf.submit(ctx, tel, modelName, model, history, parts, onChunk)
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to process response: %v", err)
+		if useCache {
+			sf.storeFailure(ctx, cacheKey, modelName, err)
+		}
+		return nil, fmt.Errorf("failed to process response: %w", err)
+	}
+	res := &Response{
+		Text:         texts[0],
+		Model:        modelName,
+		FinishReason: finishReason,
+		InputTokens:  usage.InputTokens,
+		OutputTokens: usage.OutputTokens,
+		Cost:         usage.Cost,
+	}
+	if req.Candidates > 1 {
+		res.Candidates = texts
+		if req.Selector != nil {
+			if i := req.Selector(texts); i >= 0 && i < len(texts) {
+				res.Text = texts[i]
+			}
+		}
+		if onChunk != nil {
+			onChunk(res.Text)
+		}
 	}
-
-	result = strings.TrimSpace(result)
 
 	// Store the new result in the cache
-	if sf.Cache != nil {
-		_ = sf.Cache.Set(cacheKey, []byte(result))
+	if useCache {
+		sf.storeEntry(ctx, cacheKey, CacheEntry{
+			Text:         res.Text,
+			Model:        modelName,
+			Created:      time.Now(),
+			FinishReason: res.FinishReason,
+			InputTokens:  res.InputTokens,
+			OutputTokens: res.OutputTokens,
+		})
+	}
+
+	return res, nil
+}
+
+// configureModel creates a model with the generation settings of the given request
+func (sf *SimpleFlash) configureModel(modelName string, req Request) *genai.GenerativeModel {
+	model := sf.Client.GenerativeModel(modelName)
+	model.SetTemperature(defaultTemperature)
+	if req.Temperature != nil {
+		model.SetTemperature(float32(*req.Temperature))
+	}
+	if req.MaxOutputTokens > 0 {
+		model.SetMaxOutputTokens(int32(req.MaxOutputTokens))
+	}
+	if len(req.StopSequences) > 0 {
+		model.StopSequences = req.StopSequences
+	}
+	if req.ResponseSchema != nil {
+		model.ResponseMIMEType = "application/json"
+		model.ResponseSchema = req.ResponseSchema
+	}
+	if req.Mode == ModeDeterministic {
+		model.SetTemperature(0)
+		model.SetTopK(1)
+	}
+	if req.System != "" {
+		model.SystemInstruction = &genai.Content{Parts: []genai.Part{genai.Text(req.System)}}
+	}
+	return model
+}
+
+// modelFor returns the name of the model that should be used for the given request
+func (sf *SimpleFlash) modelFor(req Request) string {
+	switch {
+	case req.Model != "":
+		return req.Model
+	case len(req.Attachments) > 0:
+		return sf.MultiModalModelName
+	}
+	return sf.ModelName
+}
+
+// cacheKeyFor generates a unique cache key based on the model name and the request
+func cacheKeyFor(modelName string, req Request) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", modelName, req.Prompt, req.System)
+	if req.Temperature != nil {
+		fmt.Fprintf(h, "%f", *req.Temperature)
+	}
+	fmt.Fprintf(h, "\x00%d\x00%q", req.MaxOutputTokens, req.StopSequences)
+	if req.Candidates > 1 {
+		fmt.Fprintf(h, "\x00candidates\x00%d", req.Candidates)
+	}
+	if req.ResponseSchema != nil {
+		schema, _ := json.Marshal(req.ResponseSchema)
+		fmt.Fprintf(h, "\x00schema\x00%s", schema)
+	}
+	if req.Mode == ModeDeterministic || req.sample > 0 {
+		fmt.Fprintf(h, "\x00%s\x00%d", req.Mode, req.sample)
+	}
+	if req.attachmentDigest != "" {
+		fmt.Fprintf(h, "\x00attachments\x00%s", req.attachmentDigest)
+	} else {
+		for _, attachment := range req.Attachments {
+			fmt.Fprintf(h, "\x00%s\x00", attachment.MIMEType)
+			h.Write(attachment.Data)
+		}
+	}
+	for _, msg := range req.History {
+		fmt.Fprintf(h, "\x00%s\x00%s", msg.Role, msg.Text)
+		for _, attachment := range msg.Attachments {
+			fmt.Fprintf(h, "\x00%s\x00", attachment.MIMEType)
+			h.Write(attachment.Data)
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// generateContent sends the history and the parts to the model, or replays the response if sf.Recorder is in ReplayMode
+func (sf *SimpleFlash) generateContent(ctx context.Context, model *genai.GenerativeModel, history []*genai.Content, parts []genai.Part, onChunk ChunkFunc) (*genai.GenerateContentResponse, error) {
+	if sf.Recorder != nil {
+		return sf.Recorder.generateContent(model, history, parts, onChunk, func() (*genai.GenerateContentResponse, error) {
+			return send(ctx, model, history, parts, onChunk)
+		})
+	}
+	return send(ctx, model, history, parts, onChunk)
+}
+
+// countTokens counts the tokens in the given text, or replays the count if sf.Recorder is in ReplayMode
+func (sf *SimpleFlash) countTokens(ctx context.Context, modelName, text string) (int, error) {
+	count := func() (int, error) {
+		mm := multimodal.New(modelName, 0.0)
+		mm.SetTimeout(sf.Timeout)
+		return mm.CountTextTokensWithClient(ctx, sf.Client, text)
+	}
+	if sf.Recorder != nil {
+		return sf.Recorder.countTokens(modelName, text, count)
+	}
+	return count()
+}
+
+// attachmentsSize returns the total size of the given attachments, in bytes
+func attachmentsSize(attachments []Attachment) int {
+	size := 0
+	for _, attachment := range attachments {
+		size += len(attachment.Data)
 	}
+	return size
+}
 
-	return result, nil
+// responseText returns the trimmed text of the first part of the first candidate in the response
+func responseText(res *genai.GenerateContentResponse) (string, error) {
+	if res == nil || len(res.Candidates) == 0 || res.Candidates[0] == nil ||
+		res.Candidates[0].Content == nil || len(res.Candidates[0].Content.Parts) == 0 {
+		return "", errors.New("empty response from model")
+	}
+	return strings.TrimSpace(fmt.Sprintf("%s", res.Candidates[0].Content.Parts[0])), nil
 }
 
 // CountTextTokens tries to count the number of tokens in the given prompt, using the VertexAI API
-func (sf *SimpleFlash) CountTextTokens(prompt string) (int, error) {
-	mm := multimodal.New(sf.ModelName, 0.0)
-	mm.SetTimeout(sf.Timeout)
+func (sf *SimpleFlash) CountTextTokens(prompt string) (count int, err error) {
+	ctx, tel := sf.startCall(context.Background(), "CountTextTokens", sf.ModelName)
+	defer func() { tel.end(nil, err) }()
 
-	ctx, cancel := context.WithTimeout(context.Background(), sf.Timeout)
+	ctx, cancel := context.WithTimeout(ctx, sf.Timeout)
 	defer cancel()
 
-	return mm.CountTextTokensWithClient(ctx, sf.Client, prompt)
+	count, err = sf.countTokens(ctx, sf.ModelName, prompt)
+	if err == nil {
+		tel.promptTokens(count)
+	}
+	return count, err
+}
+
+// CountRequestTokens tries to count the number of tokens in the system instruction, the history and the prompt
+// of the given request, with the model that would answer it
+func (sf *SimpleFlash) CountRequestTokens(req Request) (count int, err error) {
+	modelName := sf.modelFor(req)
+	ctx, tel := sf.startCall(context.Background(), "CountRequestTokens", modelName)
+	defer func() { tel.end(nil, err) }()
+
+	ctx, cancel := context.WithTimeout(ctx, sf.Timeout)
+	defer cancel()
+
+	texts := []string{req.System}
+	for _, msg := range req.History {
+		texts = append(texts, msg.Text)
+	}
+	var sb strings.Builder
+	for _, text := range append(texts, req.Prompt) {
+		if text != "" {
+			sb.WriteString(text)
+			sb.WriteString("\n")
+		}
+	}
+	if sb.Len() == 0 {
+		return 0, nil
+	}
+	count, err = sf.countTokens(ctx, modelName, sb.String())
+	if err == nil {
+		tel.promptTokens(count)
+	}
+	return count, err
 }
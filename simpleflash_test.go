@@ -1,8 +1,6 @@
 package simpleflash
 
 import (
-	"fmt"
-	"os"
 	"testing"
 	"time"
 
@@ -15,17 +13,16 @@ const (
 	testLocation            = "europe-west4"
 )
 
-func TestMain(m *testing.M) {
+// requireProjectID skips tests that need access to VertexAI when PROJECT_ID is not set
+func requireProjectID(t *testing.T) {
+	t.Helper()
 	if env.No("PROJECT_ID") {
-		fmt.Fprintln(os.Stderr, "PROJECT_ID environment variable is not set. Skipping tests.")
-		os.Exit(0)
+		t.Skip("PROJECT_ID environment variable is not set. Skipping test.")
 	}
-
-	// Run the tests
-	os.Exit(m.Run())
 }
 
 func TestNewSimpleFlash(t *testing.T) {
+	requireProjectID(t)
 	sf, err := New(testModelName, testMultiModalModelName, testLocation, env.Str("PROJECT_ID"), false)
 	if err != nil {
 		t.Errorf("could not create a new SimpleFlash: %v", err)
@@ -49,6 +46,7 @@ func TestNewSimpleFlash(t *testing.T) {
 }
 
 func TestSetTimeout(t *testing.T) {
+	requireProjectID(t)
 	sf, err := New(testModelName, testMultiModalModelName, testLocation, env.Str("PROJECT_ID"), false)
 	if err != nil {
 		t.Errorf("could not create a new SimpleFlash: %v", err)
@@ -62,6 +60,7 @@ func TestSetTimeout(t *testing.T) {
 }
 
 func TestQueryGemini(t *testing.T) {
+	requireProjectID(t)
 	sf, err := New(testModelName, testMultiModalModelName, testLocation, env.Str("PROJECT_ID"), true)
 	if err != nil {
 		t.Errorf("could not create a new SimpleFlash: %v", err)
@@ -81,6 +80,7 @@ func TestQueryGemini(t *testing.T) {
 }
 
 func TestCountTextTokens(t *testing.T) {
+	requireProjectID(t)
 	sf, err := New(testModelName, testMultiModalModelName, testLocation, env.Str("PROJECT_ID"), false)
 	if err != nil {
 		t.Errorf("could not create a new SimpleFlash: %v", err)
@@ -0,0 +1,236 @@
+package simpleflashtest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xyproto/simpleflash/internal/resp"
+)
+
+// RedisServer is a local server that speaks enough of the Redis protocol (RESP) for simpleflash.RedisKV:
+// PING, AUTH, SELECT, GET, SET with EX or PX, DEL, EXISTS, TTL, PTTL, DBSIZE and FLUSHALL.
+// It is safe for concurrent use.
+type RedisServer struct {
+	Addr string
+
+	password string
+	listener net.Listener
+	wg       sync.WaitGroup
+	mut      sync.Mutex
+	data     map[string]redisEntry
+	conns    map[net.Conn]bool
+	commands int
+}
+
+// redisEntry is a value in a RedisServer
+type redisEntry struct {
+	value   []byte
+	expires time.Time // zero if the value does not expire
+}
+
+// NewRedisServer starts a new RedisServer on a local port. If password is not empty,
+// clients must send it with AUTH. Call Close when done.
+func NewRedisServer(password string) (*RedisServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &RedisServer{
+		Addr:     listener.Addr().String(),
+		password: password,
+		listener: listener,
+		data:     make(map[string]redisEntry),
+		conns:    make(map[net.Conn]bool),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Close stops the server and closes all connections
+func (s *RedisServer) Close() {
+	s.listener.Close()
+	s.mut.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mut.Unlock()
+	s.wg.Wait()
+}
+
+// Len returns the number of keys that have not expired
+func (s *RedisServer) Len() int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	n := 0
+	for key := range s.data {
+		if _, ok := s.get(key); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// Commands returns the number of commands that have been received
+func (s *RedisServer) Commands() int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.commands
+}
+
+func (s *RedisServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mut.Lock()
+		s.conns[conn] = true
+		s.mut.Unlock()
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+// handle reads commands from the connection and writes the replies, until the connection is closed
+func (s *RedisServer) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mut.Lock()
+		delete(s.conns, conn)
+		s.mut.Unlock()
+		conn.Close()
+	}()
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	authenticated := s.password == ""
+	for {
+		command, err := resp.Read(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				resp.Write(w, resp.Error("ERR "+err.Error()))
+				w.Flush()
+			}
+			return
+		}
+		args, ok := command.([]any)
+		if !ok || len(args) == 0 {
+			resp.Write(w, resp.Error("ERR expected an array of bulk strings"))
+		} else {
+			name := strings.ToUpper(argString(args[0]))
+			switch {
+			case name == "AUTH":
+				if len(args) == 2 && argString(args[1]) == s.password {
+					authenticated = true
+					resp.Write(w, "OK")
+				} else {
+					resp.Write(w, resp.Error("WRONGPASS invalid password"))
+				}
+			case !authenticated:
+				resp.Write(w, resp.Error("NOAUTH Authentication required."))
+			default:
+				resp.Write(w, s.execute(name, args[1:]))
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// execute runs a command and returns the reply
+func (s *RedisServer) execute(name string, args []any) any {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.commands++
+	wrongArgs := resp.Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+	switch name {
+	case "PING":
+		return "PONG"
+	case "SELECT":
+		return "OK"
+	case "GET":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		if entry, ok := s.get(argString(args[0])); ok {
+			return entry.value
+		}
+		return nil
+	case "SET":
+		if len(args) != 2 && len(args) != 4 {
+			return wrongArgs
+		}
+		entry := redisEntry{value: []byte(argString(args[1]))}
+		if len(args) == 4 {
+			n, err := strconv.ParseInt(argString(args[3]), 10, 64)
+			if err != nil || n <= 0 {
+				return resp.Error("ERR invalid expire time in 'set' command")
+			}
+			switch strings.ToUpper(argString(args[2])) {
+			case "EX":
+				entry.expires = time.Now().Add(time.Duration(n) * time.Second)
+			case "PX":
+				entry.expires = time.Now().Add(time.Duration(n) * time.Millisecond)
+			default:
+				return resp.Error("ERR syntax error")
+			}
+		}
+		s.data[argString(args[0])] = entry
+		return "OK"
+	case "DEL", "EXISTS":
+		n := int64(0)
+		for _, arg := range args {
+			if _, ok := s.get(argString(arg)); ok {
+				n++
+				if name == "DEL" {
+					delete(s.data, argString(arg))
+				}
+			}
+		}
+		return n
+	case "TTL", "PTTL":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		entry, ok := s.get(argString(args[0]))
+		switch {
+		case !ok:
+			return int64(-2)
+		case entry.expires.IsZero():
+			return int64(-1)
+		case name == "TTL":
+			return int64(time.Until(entry.expires).Seconds())
+		}
+		return time.Until(entry.expires).Milliseconds()
+	case "DBSIZE":
+		return int64(len(s.data))
+	case "FLUSHALL":
+		s.data = make(map[string]redisEntry)
+		return "OK"
+	}
+	return resp.Error(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(name)))
+}
+
+// get returns the entry with the given key, and removes it if it has expired
+func (s *RedisServer) get(key string) (redisEntry, bool) {
+	entry, ok := s.data[key]
+	if ok && !entry.expires.IsZero() && !time.Now().Before(entry.expires) {
+		delete(s.data, key)
+		return redisEntry{}, false
+	}
+	return entry, ok
+}
+
+// argString returns a bulk string argument as a string
+func argString(arg any) string {
+	data, _ := arg.([]byte)
+	return string(data)
+}
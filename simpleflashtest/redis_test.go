@@ -0,0 +1,91 @@
+package simpleflashtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xyproto/simpleflash"
+)
+
+func newTestRedis(t *testing.T, password string) *RedisServer {
+	t.Helper()
+	rs, err := NewRedisServer(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(rs.Close)
+	return rs
+}
+
+func TestRedisKV(t *testing.T) {
+	rs := newTestRedis(t, "secret")
+	ctx := context.Background()
+
+	kv := simpleflash.NewRedisKV(rs.Addr)
+	defer kv.Close()
+	if _, err := kv.Get(ctx, "key"); err == nil || !strings.Contains(err.Error(), "NOAUTH") {
+		t.Errorf("expected an authentication error, got %v", err)
+	}
+	kv.Password = "secret"
+	kv.Close() // so that the next command uses a new connection, which is authenticated
+
+	if _, err := kv.Get(ctx, "key"); !errors.Is(err, simpleflash.ErrCacheMiss) {
+		t.Errorf("expected ErrCacheMiss, got %v", err)
+	}
+	value := []byte("binary\r\n\x00value")
+	if err := kv.Set(ctx, "key", value, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := kv.Get(ctx, "key"); err != nil || !bytes.Equal(got, value) {
+		t.Errorf("expected the value, got %q (%v)", got, err)
+	}
+	if ttl, err := kv.TTL(ctx, "key"); err != nil || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("expected a ttl of up to a minute, got %v (%v)", ttl, err)
+	}
+	kv.Set(ctx, "forever", value, 0)
+	if ttl, err := kv.TTL(ctx, "forever"); err != nil || ttl != 0 {
+		t.Errorf("expected no expiry, got %v (%v)", ttl, err)
+	}
+	if err := kv.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.TTL(ctx, "key"); !errors.Is(err, simpleflash.ErrCacheMiss) {
+		t.Errorf("expected ErrCacheMiss after deleting, got %v", err)
+	}
+	if _, err := (&simpleflash.RedisKV{Addr: rs.Addr, Password: "wrong"}).Get(ctx, "key"); err == nil {
+		t.Error("expected an error for the wrong password")
+	}
+}
+
+func TestSharedCache(t *testing.T) {
+	rs := newTestRedis(t, "")
+	s := NewServer()
+	defer s.Close()
+	s.Enqueue(Reply{Text: strings.Repeat("Moo. ", 500)})
+
+	// Two replicas share one cache, and large responses are compressed
+	var replicas []*simpleflash.SimpleFlash
+	for i := 0; i < 2; i++ {
+		sf, err := s.SimpleFlash("gemini-1.5-flash", "gemini-1.0-pro-vision", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sf.Cache = simpleflash.NewCompressedKV(simpleflash.NewRedisKV(rs.Addr))
+		replicas = append(replicas, sf)
+	}
+	for _, sf := range replicas {
+		if res, err := sf.Generate(context.Background(), simpleflash.Request{Prompt: "What do cows say?"}); err != nil || !strings.HasPrefix(res.Text, "Moo.") {
+			t.Fatalf("unexpected response %v (%v)", res, err)
+		}
+	}
+	if n := len(s.Requests()); n != 1 {
+		t.Errorf("expected the second replica to use the cached response, got %d requests", n)
+	}
+	if rs.Len() != 1 {
+		t.Errorf("expected 1 key in redis, got %d", rs.Len())
+	}
+}
@@ -0,0 +1,372 @@
+// Package simpleflashtest provides a local server that speaks the VertexAI generateContent,
+// streamGenerateContent and countTokens REST protocol, for testing code that uses simpleflash
+// without contacting VertexAI.
+package simpleflashtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/aiplatform/apiv1beta1/aiplatformpb"
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/simpleflash"
+	"google.golang.org/api/option"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Reply is a scripted reply to a request
+type Reply struct {
+	Text         string        // the text of the response
+	Chunks       []string      // if set, the text is streamed in these chunks, instead of in one piece
+	Candidates   []string      // if set, each text is returned as a candidate, instead of Text
+	FinishReason string        // like "STOP", "MAX_TOKENS" or "SAFETY", the default is "STOP"
+	InputTokens  int           // the prompt token count in the usage metadata
+	OutputTokens int           // the candidates token count in the usage metadata
+	TokenCount   int           // the reply to countTokens, the default is the number of words in the request
+	Status       int           // if set, an error with this HTTP status code is returned, like 429 or 500
+	Message      string        // the message of the error
+	Blocked      bool          // if true, the prompt is blocked by the safety filters
+	Latency      time.Duration // how long to wait before replying, in addition to Server.Latency
+}
+
+// Request is a request that was received by the Server
+type Request struct {
+	Method          string // "generateContent", "streamGenerateContent" or "countTokens"
+	Model           string // the model name, without the "projects/.../models/" prefix
+	Contents        []Content
+	System          string
+	Temperature     *float32
+	MaxOutputTokens int
+	StopSequences   []string
+	CandidateCount  int
+	Header          http.Header
+}
+
+// Content is a turn of the conversation in a Request
+type Content struct {
+	Role  string
+	Texts []string
+	Blobs []simpleflash.Attachment
+}
+
+// Prompt returns the text of the last turn of the request
+func (r Request) Prompt() string {
+	if len(r.Contents) == 0 {
+		return ""
+	}
+	return strings.Join(r.Contents[len(r.Contents)-1].Texts, "\n")
+}
+
+// Server is a local VertexAI server with scripted replies. It is safe for concurrent use.
+type Server struct {
+	URL string
+
+	// Respond is called for requests when there are no queued replies, if set.
+	// Otherwise, the reply is "OK".
+	Respond func(Request) Reply
+
+	// Latency is added before every reply
+	Latency time.Duration
+
+	server   *httptest.Server
+	mut      sync.Mutex
+	queue    []Reply
+	requests []Request
+}
+
+// NewServer starts a new Server. Call Close when done.
+func NewServer() *Server {
+	s := &Server{}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close shuts down the server
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Enqueue adds replies that are used for the next requests, in order
+func (s *Server) Enqueue(replies ...Reply) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.queue = append(s.queue, replies...)
+}
+
+// Requests returns the requests that have been received so far
+func (s *Server) Requests() []Request {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// LastRequest returns the last request that was received, if any
+func (s *Server) LastRequest() (Request, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if len(s.requests) == 0 {
+		return Request{}, false
+	}
+	return s.requests[len(s.requests)-1], true
+}
+
+// Reset forgets the received requests and the queued replies
+func (s *Server) Reset() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.queue, s.requests = nil, nil
+}
+
+// Client returns a genai client that sends its requests to the server, without credentials
+func (s *Server) Client(ctx context.Context) (*genai.Client, error) {
+	return genai.NewClient(ctx, "test-project", "test-location", genai.WithREST(), option.WithEndpoint(s.URL), option.WithoutAuthentication())
+}
+
+// SimpleFlash returns a SimpleFlash that sends its requests to the server
+func (s *Server) SimpleFlash(modelName, multiModalModelName string, cache bool) (*simpleflash.SimpleFlash, error) {
+	client, err := s.Client(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	sf := &simpleflash.SimpleFlash{
+		ModelName:           modelName,
+		MultiModalModelName: multiModalModelName,
+		ProjectLocation:     "test-location",
+		ProjectID:           "test-project",
+		Client:              client,
+		Timeout:             time.Minute,
+		Costs:               simpleflash.NewCostTracker(0),
+		Coalescer:           simpleflash.NewCoalescer(),
+	}
+	if cache {
+		if err := sf.InitCache(); err != nil {
+			return nil, err
+		}
+	}
+	return sf, nil
+}
+
+// next returns the reply for the given request, and records the request
+func (s *Server) next(req Request) Reply {
+	s.mut.Lock()
+	s.requests = append(s.requests, req)
+	if len(s.queue) > 0 {
+		reply := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mut.Unlock()
+		return reply
+	}
+	respond := s.Respond
+	s.mut.Unlock()
+	if respond != nil {
+		return respond(req)
+	}
+	return Reply{Text: "OK"}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path, method, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1beta1/"), ":")
+	if r.Method != http.MethodPost || !ok {
+		writeError(w, http.StatusNotFound, "not found: "+r.URL.Path)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	unmarshal := protojson.UnmarshalOptions{DiscardUnknown: true}
+
+	req := Request{Method: method, Model: path[strings.LastIndex(path, "/")+1:], Header: r.Header.Clone()}
+	switch method {
+	case "generateContent", "streamGenerateContent":
+		var pbReq aiplatformpb.GenerateContentRequest
+		if err := unmarshal.Unmarshal(body, &pbReq); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req.Contents = contents(pbReq.Contents)
+		if system := pbReq.SystemInstruction; system != nil {
+			for _, part := range system.Parts {
+				req.System += part.GetText()
+			}
+		}
+		if config := pbReq.GenerationConfig; config != nil {
+			req.Temperature = config.Temperature
+			req.MaxOutputTokens = int(config.GetMaxOutputTokens())
+			req.StopSequences = config.StopSequences
+			req.CandidateCount = int(config.GetCandidateCount())
+		}
+	case "countTokens":
+		var pbReq aiplatformpb.CountTokensRequest
+		if err := unmarshal.Unmarshal(body, &pbReq); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		req.Contents = contents(pbReq.Contents)
+		if req.Model = pbReq.Model; req.Model == "" {
+			req.Model = pbReq.Endpoint
+		}
+		req.Model = req.Model[strings.LastIndex(req.Model, "/")+1:]
+	default:
+		writeError(w, http.StatusNotFound, "unknown method: "+method)
+		return
+	}
+
+	reply := s.next(req)
+	select {
+	case <-time.After(s.Latency + reply.Latency):
+	case <-r.Context().Done():
+		return
+	}
+	if reply.Status != 0 {
+		writeError(w, reply.Status, reply.Message)
+		return
+	}
+
+	switch method {
+	case "countTokens":
+		count := reply.TokenCount
+		if count == 0 {
+			for _, content := range req.Contents {
+				for _, text := range content.Texts {
+					count += len(strings.Fields(text))
+				}
+			}
+		}
+		writeProto(w, &aiplatformpb.CountTokensResponse{TotalTokens: int32(count)})
+	case "generateContent":
+		writeProto(w, response(reply, reply.Text, true))
+	case "streamGenerateContent":
+		chunks := reply.Chunks
+		if len(chunks) == 0 {
+			chunks = []string{reply.Text}
+		}
+		// The REST protocol streams the responses as the elements of a JSON array
+		w.Header().Set("Content-Type", "application/json")
+		flusher, _ := w.(http.Flusher)
+		io.WriteString(w, "[")
+		for i, chunk := range chunks {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			data, _ := protojson.Marshal(response(reply, chunk, i == len(chunks)-1))
+			w.Write(data)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		io.WriteString(w, "]")
+	}
+}
+
+// contents converts the contents of a request
+func contents(pbContents []*aiplatformpb.Content) []Content {
+	var converted []Content
+	for _, pbContent := range pbContents {
+		content := Content{Role: pbContent.Role}
+		for _, part := range pbContent.Parts {
+			switch {
+			case part.GetInlineData() != nil:
+				content.Blobs = append(content.Blobs, simpleflash.Attachment{MIMEType: part.GetInlineData().MimeType, Data: part.GetInlineData().Data})
+			default:
+				content.Texts = append(content.Texts, part.GetText())
+			}
+		}
+		converted = append(converted, content)
+	}
+	return converted
+}
+
+// response builds a response with the given text. The finish reason and usage are only added to the last chunk.
+func response(reply Reply, text string, last bool) *aiplatformpb.GenerateContentResponse {
+	if reply.Blocked {
+		return &aiplatformpb.GenerateContentResponse{PromptFeedback: &aiplatformpb.GenerateContentResponse_PromptFeedback{
+			BlockReason:        aiplatformpb.GenerateContentResponse_PromptFeedback_SAFETY,
+			BlockReasonMessage: "blocked by simpleflashtest",
+		}}
+	}
+	texts := []string{text}
+	if len(reply.Candidates) > 0 {
+		texts = reply.Candidates
+	}
+	res := &aiplatformpb.GenerateContentResponse{}
+	for i, text := range texts {
+		res.Candidates = append(res.Candidates, &aiplatformpb.Candidate{
+			Index:   int32(i),
+			Content: &aiplatformpb.Content{Role: "model", Parts: []*aiplatformpb.Part{{Data: &aiplatformpb.Part_Text{Text: text}}}},
+		})
+	}
+	if last {
+		finishReason := reply.FinishReason
+		if finishReason == "" {
+			finishReason = "STOP"
+		}
+		for _, candidate := range res.Candidates {
+			candidate.FinishReason = aiplatformpb.Candidate_FinishReason(aiplatformpb.Candidate_FinishReason_value[finishReason])
+		}
+		res.UsageMetadata = &aiplatformpb.GenerateContentResponse_UsageMetadata{
+			PromptTokenCount:     int32(reply.InputTokens),
+			CandidatesTokenCount: int32(reply.OutputTokens),
+			TotalTokenCount:      int32(reply.InputTokens + reply.OutputTokens),
+		}
+	}
+	return res
+}
+
+// writeProto writes a protobuf message as JSON
+func writeProto(w http.ResponseWriter, m proto.Message) {
+	data, err := protojson.Marshal(m)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// writeError writes an error in the format of Google APIs
+func writeError(w http.ResponseWriter, status int, message string) {
+	if message == "" {
+		message = http.StatusText(status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{
+		"code":    status,
+		"message": message,
+		"status":  statusName(status),
+	}})
+}
+
+// statusName returns the Google API status name for an HTTP status code
+func statusName(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case http.StatusInternalServerError:
+		return "INTERNAL"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	}
+	return fmt.Sprintf("HTTP_%d", status)
+}
@@ -0,0 +1,485 @@
+package simpleflashtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"github.com/xyproto/simpleflash"
+)
+
+func newTestSimpleFlash(t *testing.T, cache bool) (*Server, *simpleflash.SimpleFlash) {
+	t.Helper()
+	s := NewServer()
+	t.Cleanup(s.Close)
+	sf, err := s.SimpleFlash("gemini-1.5-flash", "gemini-1.0-pro-vision", cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, sf
+}
+
+func TestGenerate(t *testing.T) {
+	s, sf := newTestSimpleFlash(t, true)
+	s.Enqueue(Reply{Text: " Black and white. ", InputTokens: 10, OutputTokens: 4})
+
+	temperature := 0.2
+	res, err := sf.Generate(context.Background(), simpleflash.Request{
+		Prompt:        "What color are cows?",
+		System:        "Be brief.",
+		Temperature:   &temperature,
+		StopSequences: []string{"END"},
+		History:       []simpleflash.Message{{Role: simpleflash.RoleUser, Text: "Hi"}, {Role: simpleflash.RoleModel, Text: "Hello!"}},
+		Attachments:   []simpleflash.Attachment{{MIMEType: "image/png", Data: []byte("png")}},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if res.Text != "Black and white." || res.InputTokens != 10 || res.OutputTokens != 4 || res.FinishReason != "FinishReasonStop" {
+		t.Errorf("unexpected response %+v", res)
+	}
+
+	req, ok := s.LastRequest()
+	if !ok {
+		t.Fatal("expected a request")
+	}
+	if req.Method != "generateContent" || req.Model != "gemini-1.0-pro-vision" || req.System != "Be brief." {
+		t.Errorf("unexpected request %+v", req)
+	}
+	if req.Temperature == nil || *req.Temperature != 0.2 || len(req.StopSequences) != 1 {
+		t.Errorf("expected the generation config to be sent, got %+v", req)
+	}
+	if len(req.Contents) != 3 || req.Contents[1].Role != "model" || req.Prompt() != "What color are cows?" || len(req.Contents[2].Blobs) != 1 {
+		t.Errorf("expected the history, the prompt and the attachment to be sent, got %+v", req.Contents)
+	}
+
+	// The second identical request is served from the cache
+	if _, err := sf.Generate(context.Background(), simpleflash.Request{Prompt: "What color are cows?", System: "Be brief.", Temperature: &temperature, StopSequences: []string{"END"},
+		History:     []simpleflash.Message{{Role: simpleflash.RoleUser, Text: "Hi"}, {Role: simpleflash.RoleModel, Text: "Hello!"}},
+		Attachments: []simpleflash.Attachment{{MIMEType: "image/png", Data: []byte("png")}},
+	}); err != nil || len(s.Requests()) != 1 {
+		t.Errorf("expected a cached response, got %d requests (%v)", len(s.Requests()), err)
+	}
+}
+
+// streamsEndCleanly checks if encoding/json lets gax find the closing ']' of a REST stream after a
+// failed Decode, which is not the case when encoding/json is built with GOEXPERIMENT=jsonv2
+func streamsEndCleanly() bool {
+	dec := json.NewDecoder(strings.NewReader("[{}]"))
+	var raw json.RawMessage
+	dec.Token()
+	dec.Decode(&raw)
+	if dec.Decode(&raw) == nil {
+		return false
+	}
+	token, _ := dec.Token()
+	return token == json.Delim(']')
+}
+
+func TestGenerateStream(t *testing.T) {
+	if !streamsEndCleanly() {
+		t.Skip("the REST stream reader of gax can not detect the end of the stream with this encoding/json, try GOEXPERIMENT=nojsonv2")
+	}
+	s, sf := newTestSimpleFlash(t, false)
+	s.Enqueue(Reply{Chunks: []string{"One, ", "two, ", "three."}, InputTokens: 3, OutputTokens: 5})
+
+	var chunks []string
+	res, err := sf.GenerateStream(context.Background(), simpleflash.Request{
+		Prompt:  "Count",
+		History: []simpleflash.Message{{Role: simpleflash.RoleUser, Text: "Hi"}, {Role: simpleflash.RoleModel, Text: "Hello!"}},
+	}, func(chunk string) { chunks = append(chunks, chunk) })
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if strings.Join(chunks, "|") != "One, |two, |three." || res.Text != "One, two, three." {
+		t.Errorf("expected the chunks to be streamed, got %q and %q", chunks, res.Text)
+	}
+	if req, _ := s.LastRequest(); req.Method != "streamGenerateContent" {
+		t.Errorf("expected a streaming request, got %s", req.Method)
+	}
+}
+
+func TestCountTokens(t *testing.T) {
+	s, sf := newTestSimpleFlash(t, false)
+	if count, err := sf.CountTextTokens("one two three"); err != nil || count != 3 {
+		t.Errorf("expected the number of words by default, got %d (%v)", count, err)
+	}
+	s.Enqueue(Reply{TokenCount: 42})
+	if count, err := sf.CountTextTokens("x"); err != nil || count != 42 {
+		t.Errorf("expected the scripted count, got %d (%v)", count, err)
+	}
+
+	// The system instruction and the history are counted with the model of the request
+	count, err := sf.CountRequestTokens(simpleflash.Request{
+		Model:   "gemini-1.5-pro",
+		System:  "Be brief.",
+		History: []simpleflash.Message{{Role: simpleflash.RoleUser, Text: "Hi"}, {Role: simpleflash.RoleModel, Text: "Hello there!"}},
+	})
+	if err != nil || count != 5 {
+		t.Errorf("expected the words of the system instruction and the history to be counted, got %d (%v)", count, err)
+	}
+	if req, _ := s.LastRequest(); req.Method != "countTokens" || req.Model != "gemini-1.5-pro" {
+		t.Errorf("expected the tokens to be counted with the model of the request, got %s with %s", req.Method, req.Model)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	s, sf := newTestSimpleFlash(t, false)
+
+	s.Enqueue(Reply{Status: 429, Message: "quota exceeded"})
+	if _, err := sf.Generate(context.Background(), simpleflash.Request{Prompt: "x"}); err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Errorf("expected the 429 error, got %v", err)
+	}
+
+	s.Enqueue(Reply{Blocked: true})
+	var blocked *genai.BlockedError
+	if _, err := sf.Generate(context.Background(), simpleflash.Request{Prompt: "x"}); !errors.As(err, &blocked) {
+		t.Errorf("expected a *genai.BlockedError, got %v", err)
+	}
+
+	s.Respond = func(req Request) Reply { return Reply{Text: "late", Latency: time.Second} }
+	sf.Timeout = 50 * time.Millisecond
+	if _, err := sf.Generate(context.Background(), simpleflash.Request{Prompt: "x"}); !errors.Is(err, context.DeadlineExceeded) && (err == nil || !strings.Contains(err.Error(), "deadline")) {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	s, sf := newTestSimpleFlash(t, true)
+	s.Latency = 100 * time.Millisecond
+	s.Respond = func(req Request) Reply { return Reply{Text: "Moo."} }
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res, err := sf.Generate(context.Background(), simpleflash.Request{Prompt: "What do cows say?"}); err != nil || res.Text != "Moo." {
+				t.Errorf("unexpected response %v (%v)", res, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(s.Requests()); n != 1 {
+		t.Errorf("expected identical concurrent requests to be sent once, got %d requests", n)
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	s, sf := newTestSimpleFlash(t, true)
+	sf.NegativeTTL = time.Minute
+
+	s.Enqueue(Reply{Blocked: true}, Reply{Status: 400, Message: "bad request"}, Reply{Status: 500})
+	for _, prompt := range []string{"blocked", "invalid", "internal"} {
+		for i := 0; i < 2; i++ {
+			sf.Generate(context.Background(), simpleflash.Request{Prompt: prompt})
+		}
+	}
+	// Blocked prompts and invalid requests are sent once, other failures are retried
+	if n := len(s.Requests()); n != 4 {
+		t.Errorf("expected 4 requests, got %d", n)
+	}
+	var cachedErr *simpleflash.CachedError
+	if _, err := sf.Generate(context.Background(), simpleflash.Request{Prompt: "blocked"}); !errors.As(err, &cachedErr) || cachedErr.Type != "blocked" {
+		t.Errorf("expected a cached blocked error, got %v", err)
+	}
+	if _, err := sf.Generate(context.Background(), simpleflash.Request{Prompt: "invalid"}); !errors.As(err, &cachedErr) || cachedErr.Type != "invalid_argument" {
+		t.Errorf("expected a cached invalid argument error, got %v", err)
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	s, sf := newTestSimpleFlash(t, true)
+	s.Enqueue(Reply{Candidates: []string{"Lyon.", "Paris.", " paris ", "Nice"}})
+
+	req := simpleflash.Request{Prompt: "What is the capital of France?", Candidates: 4, Selector: simpleflash.MajorityVote()}
+	res, err := sf.Generate(context.Background(), req)
+	if err != nil || res.Text != "Paris." || len(res.Candidates) != 4 {
+		t.Fatalf("expected the majority answer and all candidates, got %+v (%v)", res, err)
+	}
+	if last, _ := s.LastRequest(); last.CandidateCount != 4 {
+		t.Errorf("expected 4 candidates to be requested, got %d", last.CandidateCount)
+	}
+	// The winning answer is cached
+	if res, err := sf.Generate(context.Background(), req); err != nil || res.Text != "Paris." || !res.Cached {
+		t.Errorf("expected the cached winner, got %+v (%v)", res, err)
+	}
+}
+
+func TestCandidatesFallback(t *testing.T) {
+	s, sf := newTestSimpleFlash(t, false)
+	answers := make(chan string, 3)
+	answers <- "Red"
+	answers <- "Blue"
+	answers <- "Red."
+	s.Respond = func(req Request) Reply {
+		if req.CandidateCount > 1 {
+			return Reply{Status: 400, Message: "candidate_count is not supported"}
+		}
+		return Reply{Text: <-answers, InputTokens: 1, OutputTokens: 1}
+	}
+
+	// When the model does not support several candidates, the request is sent several times
+	res, err := sf.Generate(context.Background(), simpleflash.Request{Prompt: "Pick a color", Candidates: 3, Selector: simpleflash.MajorityVote()})
+	if err != nil || strings.TrimSuffix(res.Text, ".") != "Red" || len(res.Candidates) != 3 {
+		t.Fatalf("expected the majority answer of 3 samples, got %+v (%v)", res, err)
+	}
+	if n := len(s.Requests()); n != 4 {
+		t.Errorf("expected 1 failed request and 3 samples, got %d requests", n)
+	}
+	if res.InputTokens != 3 || sf.Costs.Total().Calls != 3 {
+		t.Errorf("expected the usage of the samples to be added up, got %d input tokens and %d calls", res.InputTokens, sf.Costs.Total().Calls)
+	}
+}
+
+func TestClassifySamples(t *testing.T) {
+	s, sf := newTestSimpleFlash(t, false)
+	s.Enqueue(Reply{Candidates: []string{
+		`{"label": "bug", "confidence": 0.9}`,
+		`{"label": "question", "confidence": 0.8}`,
+		`{"label": "Question", "confidence": 0.6}`,
+		`{"label": "question", "confidence": 0.7}`,
+	}})
+	c, err := sf.Classify(context.Background(), "How do I install it?", []string{"bug", "question"}, simpleflash.ClassifyOptions{Samples: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Label != "question" || c.Confidence != 0.75 || c.Votes["question"] != 3 || c.Votes["bug"] != 1 {
+		t.Errorf("expected 3 of 4 votes for question, got %+v", c)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	s, sf := newTestSimpleFlash(t, true)
+	s.Respond = func(req Request) Reply {
+		prompt := req.Prompt()
+		switch {
+		case strings.HasPrefix(prompt, "Combine"):
+			return Reply{Text: "summary of " + strings.Join(strings.Fields(prompt[strings.Index(prompt, "Summaries:"):])[1:], " ")}
+		case strings.HasPrefix(prompt, "The following text"):
+			return Reply{Text: strings.Fields(prompt[strings.Index(prompt, "Text:"):])[1]}
+		}
+		return Reply{Status: 400, Message: "unexpected prompt"}
+	}
+	document := "alpha " + strings.Repeat("a", 60) + "\n\nbeta " + strings.Repeat("b", 60) + "\n\ngamma " + strings.Repeat("c", 60)
+
+	var (
+		mut      sync.Mutex
+		progress []simpleflash.SummarizeProgress
+	)
+	opts := simpleflash.SummarizeOptions{ChunkTokens: 20, Progress: func(p simpleflash.SummarizeProgress) {
+		mut.Lock()
+		defer mut.Unlock()
+		progress = append(progress, p)
+	}}
+	summary, err := sf.Summarize(context.Background(), strings.NewReader(document), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Text != "summary of alpha beta gamma" || summary.Chunks != 3 || summary.Calls != 4 || summary.Cached != 0 {
+		t.Errorf("expected the combined summaries of 3 chunks in 4 calls, got %+v", summary)
+	}
+	if len(progress) != 4 || progress[2] != (simpleflash.SummarizeProgress{Stage: simpleflash.StageMap, Done: 3, Total: 3}) ||
+		progress[3] != (simpleflash.SummarizeProgress{Stage: simpleflash.StageReduce, Done: 1, Total: 1}) {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+
+	// The summaries are cached
+	opts.Progress = nil
+	if summary, err = sf.Summarize(context.Background(), strings.NewReader(document), opts); err != nil || summary.Cached != 4 {
+		t.Errorf("expected 4 cached calls, got %+v (%v)", summary, err)
+	}
+}
+
+func TestPromptChunk(t *testing.T) {
+	s, sf := newTestSimpleFlash(t, false)
+	var (
+		mut     sync.Mutex
+		systems []string
+	)
+	s.Respond = func(req Request) Reply {
+		mut.Lock()
+		systems = append(systems, req.System)
+		mut.Unlock()
+		prompt := req.Prompt()
+		switch {
+		case strings.HasPrefix(prompt, "Combine"):
+			return Reply{Text: "summary of " + strings.Join(strings.Fields(prompt[strings.Index(prompt, "Summaries:"):])[1:], " ")}
+		case strings.HasPrefix(prompt, "The following text"):
+			return Reply{Text: strings.Fields(prompt[strings.Index(prompt, "Text:"):])[1]}
+		}
+		return Reply{Status: 400, Message: "unexpected prompt"}
+	}
+	sf.ModelLimits = map[string]simpleflash.ModelLimits{sf.ModelName: {ContextWindow: 110}}
+	sf.PromptSizePolicy = simpleflash.PromptChunk
+	document := "alpha " + strings.Repeat("a", 200) + "\n\nbeta " + strings.Repeat("b", 200) + "\n\ngamma " + strings.Repeat("c", 200)
+
+	// The prompt is summarized like Summarize does, with the settings of the request
+	res, err := sf.Generate(context.Background(), simpleflash.Request{Prompt: document, System: "Be brief."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Text != "summary of alpha beta gamma" {
+		t.Errorf("expected the combined summaries of the chunks, got %q", res.Text)
+	}
+	if len(systems) != 4 || slices.ContainsFunc(systems, func(system string) bool { return system != "Be brief." }) {
+		t.Errorf("expected the system instruction in 4 calls, got %q", systems)
+	}
+}
+
+func TestSummarizeRefine(t *testing.T) {
+	s, sf := newTestSimpleFlash(t, false)
+	s.Respond = func(req Request) Reply {
+		prompt := req.Prompt()
+		if strings.HasPrefix(prompt, "Here is a summary") {
+			summary := strings.TrimSpace(prompt[len("Here is a summary of the first parts of a document:"):strings.Index(prompt, "Refine")])
+			return Reply{Text: summary + " " + strings.Fields(prompt[strings.Index(prompt, "Next part:"):])[2]}
+		}
+		return Reply{Text: strings.Fields(prompt[strings.Index(prompt, "Text:"):])[1]}
+	}
+	document := "one " + strings.Repeat("x", 60) + "\n\ntwo " + strings.Repeat("y", 60) + "\n\nthree " + strings.Repeat("z", 60)
+	summary, err := sf.Summarize(context.Background(), strings.NewReader(document), simpleflash.SummarizeOptions{Strategy: simpleflash.SummaryRefine, ChunkTokens: 20, Instructions: "Be brief."})
+	if err != nil || summary.Text != "one two three" || summary.Calls != 3 {
+		t.Fatalf("expected the summary to be refined in order, got %+v (%v)", summary, err)
+	}
+	if !strings.Contains(s.Requests()[2].Prompt(), "Be brief.") {
+		t.Error("expected the instructions in every prompt")
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	s, sf := newTestSimpleFlash(t, false)
+	var (
+		mut     sync.Mutex
+		dropped bool
+	)
+	s.Respond = func(req Request) Reply {
+		prompt := req.Prompt()
+		if strings.HasPrefix(prompt, "Your answer was not accepted") {
+			prompt = req.Contents[0].Texts[0]
+		}
+		var items []struct {
+			ID   string `json:"id"`
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal([]byte(prompt[strings.Index(prompt, "Items:")+len("Items:"):]), &items); err != nil {
+			return Reply{Status: 400, Message: err.Error()}
+		}
+		for i := range items {
+			items[i].Text = "de:" + items[i].Text
+		}
+		mut.Lock()
+		defer mut.Unlock()
+		if len(items) == 1 && !dropped {
+			// Leave out the only item the first time
+			dropped = true
+			return Reply{Text: "[]"}
+		}
+		data, _ := json.Marshal(items)
+		return Reply{Text: string(data)}
+	}
+
+	texts := []string{"Hello {name}", "", "Open SimpleFlash", "Hello {name}", "%d files"}
+	translations, err := sf.Translate(context.Background(), texts, "German", simpleflash.TranslateOptions{BatchSize: 2, DoNotTranslate: []string{"SimpleFlash"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"de:Hello {name}", "", "de:Open SimpleFlash", "de:Hello {name}", "de:%d files"}
+	if strings.Join(translations, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected %q, got %q", expected, translations)
+	}
+	if n := len(s.Requests()); n != 3 {
+		t.Errorf("expected 2 batches and 1 retry, got %d requests", n)
+	}
+}
+
+func TestImages(t *testing.T) {
+	s, sf := newTestSimpleFlash(t, true)
+	img := image.NewGray(image.Rect(0, 0, 3000, 1500))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	s.Enqueue(Reply{Text: "A gray pattern."})
+	description, err := sf.DescribeImage(context.Background(), img, simpleflash.ImageOptions{})
+	if err != nil || description != "A gray pattern." {
+		t.Fatalf("expected the description, got %q (%v)", description, err)
+	}
+	last, _ := s.LastRequest()
+	blobs := last.Contents[0].Blobs
+	if last.Model != "gemini-1.0-pro-vision" || len(blobs) != 1 || blobs[0].MIMEType != "image/png" {
+		t.Fatalf("expected a PNG image to be sent to the multimodal model, got %+v", last)
+	}
+	if config, err := png.DecodeConfig(bytes.NewReader(blobs[0].Data)); err != nil || config.Width != 2048 || config.Height != 1024 {
+		t.Errorf("expected the image to be scaled down to 2048x1024, got %+v (%v)", config, err)
+	}
+
+	// The description is cached by the content of the image, also when it is given as a file
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "pattern.png")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if description, err := sf.DescribeImage(context.Background(), path, simpleflash.ImageOptions{}); err != nil || description != "A gray pattern." || len(s.Requests()) != 1 {
+		t.Errorf("expected the cached description, got %q after %d requests (%v)", description, len(s.Requests()), err)
+	}
+
+	s.Enqueue(Reply{Text: "| a | b |\n|---|---|"})
+	text, err := sf.ExtractTextFromImage(context.Background(), buf.Bytes(), simpleflash.ImageOptions{Layout: simpleflash.LayoutMarkdown, Instructions: "It is a table."})
+	if last, _ := s.LastRequest(); err != nil || text != "| a | b |\n|---|---|" || !strings.Contains(last.Prompt(), "Markdown") || !strings.Contains(last.Prompt(), "It is a table.") {
+		t.Errorf("expected the text as Markdown, got %q for %q (%v)", text, last.Prompt(), err)
+	}
+
+	other := image.NewUniform(color.Black)
+	small := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	for i := range small.Pix {
+		small.Pix[i] = 255
+	}
+	s.Enqueue(Reply{Text: `{"similar": false, "similarity": 1.5, "differences": ["white, not a pattern"], "summary": "Different."}`})
+	comparison, err := sf.CompareImages(context.Background(), img, small, simpleflash.ImageOptions{})
+	if err != nil || comparison.Similar || comparison.Similarity != 1 || len(comparison.Differences) != 1 {
+		t.Errorf("unexpected comparison %+v (%v)", comparison, err)
+	}
+	if last, _ := s.LastRequest(); len(last.Contents[0].Blobs) != 2 {
+		t.Errorf("expected both images to be sent, got %d", len(last.Contents[0].Blobs))
+	}
+	if _, err := sf.CompareImages(context.Background(), img, other, simpleflash.ImageOptions{}); err == nil {
+		t.Error("expected an error for an image with unlimited bounds")
+	}
+}
+
+func TestImagesAreCoalesced(t *testing.T) {
+	s, sf := newTestSimpleFlash(t, true)
+	sf.Coalescer = simpleflash.NewCoalescer()
+	s.Enqueue(Reply{Text: "A black square.", Latency: 200 * time.Millisecond})
+	img := image.NewGray(image.Rect(0, 0, 10, 10))
+
+	// Identical concurrent questions about an image share one call, like other requests
+	var wg sync.WaitGroup
+	descriptions := make([]string, 3)
+	for i := range descriptions {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			descriptions[i], _ = sf.DescribeImage(context.Background(), img, simpleflash.ImageOptions{})
+		}(i)
+	}
+	wg.Wait()
+	if n := len(s.Requests()); n != 1 || strings.Join(descriptions, "|") != "A black square.|A black square.|A black square." {
+		t.Errorf("expected 3 descriptions from 1 request, got %q from %d requests", descriptions, n)
+	}
+}
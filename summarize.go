@@ -0,0 +1,305 @@
+package simpleflash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// DefaultSummaryChunkTokens is the size of the chunks that Summarize splits a document into, if
+// SummarizeOptions.ChunkTokens is 0. Smaller chunks than the context window give more detailed summaries.
+const DefaultSummaryChunkTokens = 8000
+
+// SummaryStrategy is how Summarize combines the chunks of a document
+type SummaryStrategy int
+
+const (
+	// SummaryMapReduce summarizes the chunks at the same time, and then combines the summaries
+	SummaryMapReduce SummaryStrategy = iota
+	// SummaryRefine summarizes the first chunk, and then refines the summary with each of the next chunks, in order.
+	// This is slower, but the summary of each chunk is written with the context of the chunks before it.
+	SummaryRefine
+)
+
+// Stages of a summary, as reported to SummarizeOptions.Progress
+const (
+	StageMap    = "map"    // summarizing the chunks
+	StageReduce = "reduce" // combining the summaries
+	StageRefine = "refine" // refining the summary with the next chunk
+)
+
+// SummarizeProgress is reported after each call to Gemini by Summarize
+type SummarizeProgress struct {
+	Stage string // StageMap, StageReduce or StageRefine
+	Done  int    // the number of finished calls in this stage
+	Total int    // the number of calls in this stage
+}
+
+// SummarizeOptions are the settings of a call to Summarize
+type SummarizeOptions struct {
+	Strategy     SummaryStrategy
+	Instructions string                           // optional guidance, like "Focus on the decisions that were made"
+	Model        string                           // if empty, sf.ModelName is used
+	ChunkTokens  int                              // the maximum number of tokens per chunk, DefaultSummaryChunkTokens if 0
+	CountTokens  func(text string) (int, error)   // counts the tokens of a chunk, like sf.CountTextTokens. EstimateTokens is used if nil.
+	Concurrency  int                              // how many chunks are summarized at the same time, 4 if 0
+	Progress     func(progress SummarizeProgress) // called after each call to Gemini, one at a time
+}
+
+// Summary is the result of Summarize
+type Summary struct {
+	Text   string  `json:"text"`
+	Chunks int     `json:"chunks"` // the number of chunks the document was split into
+	Calls  int     `json:"calls"`  // the number of calls to Gemini, including cached ones
+	Cached int     `json:"cached"` // the number of calls that were answered from the cache
+	Cost   float64 `json:"cost"`   // in USD
+}
+
+// Prompts that are used by Summarize
+const (
+	summarizeDocumentPrompt = "Summarize the following document.\n%s\nDocument:\n%s"
+	summarizeChunkPrompt    = "The following text is a part of a larger document. Summarize it, keeping all details that may be needed to understand the document as a whole.\n%s\nText:\n%s"
+	summarizeCombinePrompt  = "Combine the following summaries of consecutive parts of a document into a single coherent summary.\n%s\nSummaries:\n\n%s"
+	summarizeRefinePrompt   = "Here is a summary of the first parts of a document:\n\n%s\n\nRefine the summary with the next part of the document, below, and keep the important details of both. Reply with only the new summary.\n%s\nNext part:\n%s"
+)
+
+// Summarize summarizes a document that may be larger than the context window of the model.
+// The document is split into chunks by tokens, and the chunks are summarized with the given strategy.
+// Every call goes through Generate, so the summaries of unchanged chunks are served from the cache.
+func (sf *SimpleFlash) Summarize(ctx context.Context, r io.Reader, opts SummarizeOptions) (*Summary, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the document: %v", err)
+	}
+	text := strings.TrimSpace(string(data))
+	if text == "" {
+		return nil, errors.New("the document is empty")
+	}
+	if opts.Strategy != SummaryMapReduce && opts.Strategy != SummaryRefine {
+		return nil, fmt.Errorf("unknown summary strategy %d", opts.Strategy)
+	}
+	return sf.newSummarizer(opts, Request{}, sf.Generate).run(ctx, text)
+}
+
+// summarizer holds the state of a call to Summarize
+type summarizer struct {
+	sf           *SimpleFlash
+	opts         SummarizeOptions
+	instructions string
+	base         Request                                                   // the settings of every call, apart from the prompt and the model
+	generate     func(ctx context.Context, req Request) (*Response, error) // sends each call
+	mut          sync.Mutex
+	summary      *Summary
+	inputTokens  int
+	outputTokens int
+}
+
+// newSummarizer returns a summarizer with the defaults of opts filled in
+func (sf *SimpleFlash) newSummarizer(opts SummarizeOptions, base Request, generate func(ctx context.Context, req Request) (*Response, error)) *summarizer {
+	s := &summarizer{sf: sf, opts: opts, base: base, generate: generate, summary: &Summary{}}
+	if s.opts.Model == "" {
+		s.opts.Model = sf.ModelName
+	}
+	if s.opts.ChunkTokens <= 0 {
+		s.opts.ChunkTokens = DefaultSummaryChunkTokens
+		// Leave room for the instructions and the summary in the prompt
+		if limits, ok := sf.LimitsFor(s.opts.Model); ok && limits.ContextWindow > 0 {
+			s.opts.ChunkTokens = min(s.opts.ChunkTokens, limits.ContextWindow*9/10)
+		}
+	}
+	if s.opts.CountTokens == nil {
+		s.opts.CountTokens = func(text string) (int, error) { return EstimateTokens(text), nil }
+	}
+	if s.opts.Concurrency <= 0 {
+		s.opts.Concurrency = 4
+	}
+	if s.instructions = strings.TrimSpace(opts.Instructions); s.instructions != "" {
+		s.instructions = "\n" + s.instructions + "\n"
+	}
+	return s
+}
+
+// run splits the text into chunks, and summarizes them with the strategy of opts
+func (s *summarizer) run(ctx context.Context, text string) (*Summary, error) {
+	chunks, err := s.split(text)
+	if err != nil {
+		return nil, err
+	}
+	s.summary.Chunks = len(chunks)
+	switch {
+	case len(chunks) == 1:
+		s.summary.Text, err = s.call(ctx, fmt.Sprintf(summarizeDocumentPrompt, s.instructions, chunks[0]))
+	case s.opts.Strategy == SummaryRefine:
+		s.summary.Text, err = s.refine(ctx, chunks)
+	default:
+		s.summary.Text, err = s.mapReduce(ctx, chunks)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.summary, nil
+}
+
+// split splits the text into chunks of at most opts.ChunkTokens tokens. The text is first split by
+// estimated tokens, and chunks that are still too large, according to opts.CountTokens, are split again.
+func (s *summarizer) split(text string) ([]string, error) {
+	var chunks []string
+	for _, chunk := range splitPrompt(text, s.opts.ChunkTokens) {
+		tokens, err := s.opts.CountTokens(chunk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count the tokens of a chunk: %w", err)
+		}
+		if tokens <= s.opts.ChunkTokens {
+			chunks = append(chunks, chunk)
+			continue
+		}
+		estimate := EstimateTokens(chunk)
+		if estimate < 2 {
+			return nil, fmt.Errorf("a chunk of %d tokens can not be split into chunks of %d tokens", tokens, s.opts.ChunkTokens)
+		}
+		// Split the chunk into smaller parts, in proportion to how much too large it is
+		parts := splitPrompt(chunk, max(estimate*s.opts.ChunkTokens/tokens, 1))
+		for _, part := range parts {
+			subchunks, err := s.split(part)
+			if err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, subchunks...)
+		}
+	}
+	return chunks, nil
+}
+
+// call sends a prompt and counts the call
+func (s *summarizer) call(ctx context.Context, prompt string) (string, error) {
+	req := s.base
+	req.Prompt, req.Model = prompt, s.opts.Model
+	res, err := s.generate(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.inputTokens += res.InputTokens
+	s.outputTokens += res.OutputTokens
+	s.summary.Calls++
+	if res.Cached {
+		s.summary.Cached++
+	}
+	s.summary.Cost += res.Cost
+	return res.Text, nil
+}
+
+// report reports the progress, if opts.Progress is set
+func (s *summarizer) report(stage string, done, total int) {
+	if s.opts.Progress != nil {
+		s.opts.Progress(SummarizeProgress{Stage: stage, Done: done, Total: total})
+	}
+}
+
+// refine summarizes the first chunk, and refines the summary with each of the next chunks
+func (s *summarizer) refine(ctx context.Context, chunks []string) (string, error) {
+	summary, err := s.call(ctx, fmt.Sprintf(summarizeChunkPrompt, s.instructions, chunks[0]))
+	if err != nil {
+		return "", fmt.Errorf("failed to summarize chunk 1 of %d: %w", len(chunks), err)
+	}
+	s.report(StageRefine, 1, len(chunks))
+	for i, chunk := range chunks[1:] {
+		if summary, err = s.call(ctx, fmt.Sprintf(summarizeRefinePrompt, summary, s.instructions, chunk)); err != nil {
+			return "", fmt.Errorf("failed to refine the summary with chunk %d of %d: %w", i+2, len(chunks), err)
+		}
+		s.report(StageRefine, i+2, len(chunks))
+	}
+	return summary, nil
+}
+
+// mapReduce summarizes the chunks at the same time, and combines the summaries. If the summaries
+// are too large to combine in one call, they are combined in groups, until one summary is left.
+func (s *summarizer) mapReduce(ctx context.Context, chunks []string) (string, error) {
+	summaries, err := s.each(ctx, StageMap, chunks, func(chunk string) string {
+		return fmt.Sprintf(summarizeChunkPrompt, s.instructions, chunk)
+	})
+	if err != nil {
+		return "", err
+	}
+	for len(summaries) > 1 {
+		groups, err := s.group(summaries)
+		if err != nil {
+			return "", err
+		}
+		if len(groups) == len(summaries) {
+			return "", errors.New("the summaries of the chunks are too large to be combined")
+		}
+		if summaries, err = s.each(ctx, StageReduce, groups, func(group string) string {
+			return fmt.Sprintf(summarizeCombinePrompt, s.instructions, group)
+		}); err != nil {
+			return "", err
+		}
+	}
+	return summaries[0], nil
+}
+
+// group joins consecutive summaries into groups of at most opts.ChunkTokens tokens
+func (s *summarizer) group(summaries []string) ([]string, error) {
+	var (
+		groups  []string
+		current []string
+		tokens  int
+	)
+	for _, summary := range summaries {
+		n, err := s.opts.CountTokens(summary)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count the tokens of a summary: %w", err)
+		}
+		if len(current) > 0 && tokens+n > s.opts.ChunkTokens {
+			groups = append(groups, strings.Join(current, "\n\n"))
+			current, tokens = nil, 0
+		}
+		current = append(current, summary)
+		tokens += n
+	}
+	return append(groups, strings.Join(current, "\n\n")), nil
+}
+
+// each sends a prompt for each of the texts, opts.Concurrency at a time, and returns the answers in order.
+// The first error cancels the calls that have not finished.
+func (s *summarizer) each(ctx context.Context, stage string, texts []string, prompt func(text string) string) ([]string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		mut      sync.Mutex
+		done     int
+		firstErr error
+		results  = make([]string, len(texts))
+		sem      = make(chan struct{}, s.opts.Concurrency)
+	)
+	for i, text := range texts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, text string) {
+			defer func() { <-sem; wg.Done() }()
+			answer, err := s.call(ctx, prompt(text))
+			mut.Lock()
+			defer mut.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed to summarize part %d of %d (%s): %w", i+1, len(texts), stage, err)
+					cancel()
+				}
+				return
+			}
+			results[i] = answer
+			done++
+			s.report(stage, done, len(texts))
+		}(i, text)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return results, nil
+}
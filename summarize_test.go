@@ -0,0 +1,36 @@
+package simpleflash
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSummarizeSplit(t *testing.T) {
+	text := strings.Repeat("word ", 400) // about 500 tokens by estimate, but 400 by counting words
+	s := &summarizer{opts: SummarizeOptions{ChunkTokens: 100}}
+
+	s.opts.CountTokens = func(text string) (int, error) { return EstimateTokens(text), nil }
+	chunks, err := s.split(text)
+	if err != nil || len(chunks) != 5 {
+		t.Fatalf("expected 5 chunks by estimate, got %d (%v)", len(chunks), err)
+	}
+
+	// A tokenizer that counts more tokens than the estimate makes the chunks smaller
+	s.opts.CountTokens = func(text string) (int, error) { return 2 * len(strings.Fields(text)), nil }
+	if chunks, err = s.split(text); err != nil || len(chunks) < 8 {
+		t.Fatalf("expected at least 8 chunks, got %d (%v)", len(chunks), err)
+	}
+	for _, chunk := range chunks {
+		if n, _ := s.opts.CountTokens(chunk); n > 100 {
+			t.Errorf("expected at most 100 tokens per chunk, got %d", n)
+		}
+	}
+	if strings.Join(strings.Fields(strings.Join(chunks, " ")), " ") != strings.TrimSpace(text) {
+		t.Error("expected the chunks to contain all of the text")
+	}
+
+	s.opts.CountTokens = func(text string) (int, error) { return 1000, nil }
+	if _, err := s.split(text); err == nil {
+		t.Error("expected an error for chunks that can not be made small enough")
+	}
+}
@@ -0,0 +1,214 @@
+package simpleflash
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/vertexai/genai"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName is the name of the tracer and meter used by SimpleFlash
+const instrumentationName = "github.com/xyproto/simpleflash"
+
+// instruments contains the OpenTelemetry metric instruments used by SimpleFlash
+type instruments struct {
+	duration      metric.Float64Histogram
+	inputTokens   metric.Int64Counter
+	outputTokens  metric.Int64Counter
+	cacheRequests metric.Int64Counter
+	errors        metric.Int64Counter
+}
+
+// callTelemetry is the span, the metrics and the log records of a single call to QueryGemini or CountTextTokens
+type callTelemetry struct {
+	sf           *SimpleFlash
+	ctx          context.Context // the context of the call for the metrics, without its cancellation, so that canceled calls are recorded too
+	name         string
+	modelName    string
+	span         trace.Span
+	start        time.Time
+	model        attribute.KeyValue
+	inst         instruments
+	cacheChecked bool
+	cacheHit     bool
+	mut          sync.Mutex           // protects usage, since several requests can be sent for one call
+	usage        *genai.UsageMetadata // the sum of the usage of the responses
+}
+
+// instrumentsCache holds the instruments of each meter provider, so they are only created once per provider
+var instrumentsCache = struct {
+	mut sync.Mutex
+	m   map[metric.MeterProvider]instruments
+}{m: make(map[metric.MeterProvider]instruments)}
+
+// instrumentsFor returns the metric instruments of the given meter provider, and creates them the first time.
+// Providers that can not be used as map keys get new instruments every time.
+func instrumentsFor(mp metric.MeterProvider) instruments {
+	if !reflect.TypeOf(mp).Comparable() {
+		return newInstruments(mp)
+	}
+	instrumentsCache.mut.Lock()
+	defer instrumentsCache.mut.Unlock()
+	inst, ok := instrumentsCache.m[mp]
+	if !ok {
+		inst = newInstruments(mp)
+		instrumentsCache.m[mp] = inst
+	}
+	return inst
+}
+
+// newInstruments creates the metric instruments, using the given meter provider.
+// Instruments that can not be created are replaced with no-op instruments.
+func newInstruments(mp metric.MeterProvider) instruments {
+	meter := mp.Meter(instrumentationName)
+	fallback := noop.Meter{}
+	var inst instruments
+	var err error
+	if inst.duration, err = meter.Float64Histogram("simpleflash.call.duration", metric.WithUnit("s"), metric.WithDescription("Duration of calls to Gemini")); err != nil {
+		inst.duration, _ = fallback.Float64Histogram("")
+	}
+	if inst.inputTokens, err = meter.Int64Counter("simpleflash.tokens.input", metric.WithUnit("{token}"), metric.WithDescription("Number of input tokens sent to Gemini")); err != nil {
+		inst.inputTokens, _ = fallback.Int64Counter("")
+	}
+	if inst.outputTokens, err = meter.Int64Counter("simpleflash.tokens.output", metric.WithUnit("{token}"), metric.WithDescription("Number of output tokens received from Gemini")); err != nil {
+		inst.outputTokens, _ = fallback.Int64Counter("")
+	}
+	if inst.cacheRequests, err = meter.Int64Counter("simpleflash.cache.requests", metric.WithDescription("Number of cache lookups, by hit or miss")); err != nil {
+		inst.cacheRequests, _ = fallback.Int64Counter("")
+	}
+	if inst.errors, err = meter.Int64Counter("simpleflash.errors", metric.WithDescription("Number of failed calls, by error type")); err != nil {
+		inst.errors, _ = fallback.Int64Counter("")
+	}
+	return inst
+}
+
+// startCall starts a span for a call to Gemini, using the configured or the global providers
+func (sf *SimpleFlash) startCall(ctx context.Context, name, modelName string) (context.Context, *callTelemetry) {
+	tp := sf.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	mp := sf.MeterProvider
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+	model := attribute.String("gen_ai.request.model", modelName)
+	ctx, span := tp.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(model))
+	return ctx, &callTelemetry{
+		sf:        sf,
+		ctx:       context.WithoutCancel(ctx),
+		name:      name,
+		modelName: modelName,
+		span:      span,
+		start:     time.Now(),
+		model:     model,
+		inst:      instrumentsFor(mp),
+	}
+}
+
+// cacheLookup records if the cache lookup was a hit or a miss
+func (ct *callTelemetry) cacheLookup(hit bool) {
+	ct.cacheChecked = true
+	ct.cacheHit = hit
+	ct.span.SetAttributes(attribute.Bool("simpleflash.cache.hit", hit))
+	ct.inst.cacheRequests.Add(ct.ctx, 1, metric.WithAttributes(ct.model, attribute.Bool("hit", hit)))
+}
+
+// retries records how many responses to the request were rejected by a Processor before this call
+func (ct *callTelemetry) retries(n int) {
+	ct.span.SetAttributes(attribute.Int("simpleflash.retries", n))
+}
+
+// coalesced records that the response of an identical concurrent request was used
+func (ct *callTelemetry) coalesced() {
+	ct.span.SetAttributes(attribute.Bool("simpleflash.coalesced", true))
+}
+
+// response records the token usage and finish reason of the given response
+func (ct *callTelemetry) response(res *genai.GenerateContentResponse) {
+	if res == nil {
+		return
+	}
+	if res.UsageMetadata != nil {
+		ct.mut.Lock()
+		if ct.usage == nil {
+			ct.usage = &genai.UsageMetadata{}
+		}
+		ct.usage.PromptTokenCount += res.UsageMetadata.PromptTokenCount
+		ct.usage.CandidatesTokenCount += res.UsageMetadata.CandidatesTokenCount
+		ct.usage.TotalTokenCount += res.UsageMetadata.TotalTokenCount
+		total := *ct.usage
+		ct.mut.Unlock()
+		ct.span.SetAttributes(
+			attribute.Int("gen_ai.usage.input_tokens", int(total.PromptTokenCount)),
+			attribute.Int("gen_ai.usage.output_tokens", int(total.CandidatesTokenCount)),
+		)
+		ct.inst.inputTokens.Add(ct.ctx, int64(res.UsageMetadata.PromptTokenCount), metric.WithAttributes(ct.model))
+		ct.inst.outputTokens.Add(ct.ctx, int64(res.UsageMetadata.CandidatesTokenCount), metric.WithAttributes(ct.model))
+	}
+	if len(res.Candidates) > 0 && res.Candidates[0] != nil {
+		ct.span.SetAttributes(attribute.String("gen_ai.response.finish_reason", res.Candidates[0].FinishReason.String()))
+	}
+}
+
+// promptTokens records the number of tokens in the prompt, as counted by CountTextTokens
+func (ct *callTelemetry) promptTokens(n int) {
+	ct.mut.Lock()
+	ct.usage = &genai.UsageMetadata{PromptTokenCount: int32(n)}
+	ct.mut.Unlock()
+	ct.span.SetAttributes(attribute.Int("gen_ai.usage.input_tokens", n))
+}
+
+// end records the duration and the outcome of the call, logs the result and ends the span
+func (ct *callTelemetry) end(res *Response, err error) {
+	ct.logEnd(res, err)
+	ct.inst.duration.Record(ct.ctx, time.Since(ct.start).Seconds(), metric.WithAttributes(ct.model))
+	if err != nil {
+		errType := errorType(err)
+		ct.span.RecordError(err)
+		ct.span.SetStatus(codes.Error, err.Error())
+		ct.span.SetAttributes(attribute.String("error.type", errType))
+		ct.inst.errors.Add(ct.ctx, 1, metric.WithAttributes(ct.model, attribute.String("error.type", errType)))
+	}
+	ct.span.End()
+}
+
+// errorType classifies the given error, for use in metrics and logs
+func errorType(err error) string {
+	var (
+		budgetErr  *BudgetExceededError
+		promptErr  *PromptTooLargeError
+		dataErr    *InlineDataTooLargeError
+		outputErr  *OutputTooLargeError
+		blockedErr *genai.BlockedError
+		cachedErr  *CachedError
+	)
+	switch {
+	case errors.As(err, &cachedErr):
+		return cachedErr.Type
+	case errors.As(err, &budgetErr):
+		return "budget_exceeded"
+	case errors.As(err, &promptErr):
+		return "prompt_too_large"
+	case errors.As(err, &dataErr):
+		return "inline_data_too_large"
+	case errors.As(err, &outputErr):
+		return "output_too_large"
+	case errors.As(err, &blockedErr):
+		return "blocked"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	}
+	return "other"
+}
@@ -0,0 +1,112 @@
+package simpleflash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"cloud.google.com/go/vertexai/genai"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+func TestErrorType(t *testing.T) {
+	tests := map[string]error{
+		"budget_exceeded":       &BudgetExceededError{Spent: 2, Limit: 1},
+		"prompt_too_large":      fmt.Errorf("wrapped: %w", &PromptTooLargeError{}),
+		"inline_data_too_large": &InlineDataTooLargeError{},
+		"output_too_large":      &OutputTooLargeError{},
+		"blocked":               fmt.Errorf("failed to process response: %w", &genai.BlockedError{}),
+		"timeout":               fmt.Errorf("failed: %w", context.DeadlineExceeded),
+		"canceled":              context.Canceled,
+		"other":                 errors.New("something else"),
+	}
+	for expected, err := range tests {
+		if got := errorType(err); got != expected {
+			t.Errorf("expected %q for %v, got %q", expected, err, got)
+		}
+	}
+}
+
+func TestCallTelemetry(t *testing.T) {
+	// Without any configured providers, the global no-op providers are used
+	sf := &SimpleFlash{}
+	_, tel := sf.startCall(context.Background(), "QueryGemini", testModelName)
+	tel.cacheLookup(false)
+	tel.response(&genai.GenerateContentResponse{
+		Candidates:    []*genai.Candidate{{FinishReason: genai.FinishReasonStop}},
+		UsageMetadata: &genai.UsageMetadata{PromptTokenCount: 3, CandidatesTokenCount: 5},
+	})
+	tel.end(nil, errors.New("failed"))
+}
+
+// countingMeterProvider counts how many times a meter is requested
+type countingMeterProvider struct {
+	noop.MeterProvider
+	meters int
+}
+
+func (mp *countingMeterProvider) Meter(name string, opts ...metric.MeterOption) metric.Meter {
+	mp.meters++
+	return mp.MeterProvider.Meter(name, opts...)
+}
+
+func TestInstrumentsAreReused(t *testing.T) {
+	mp := &countingMeterProvider{}
+	sf := &SimpleFlash{MeterProvider: mp}
+	for range 3 {
+		_, tel := sf.startCall(context.Background(), "QueryGemini", testModelName)
+		tel.end(nil, nil)
+	}
+	if mp.meters != 1 {
+		t.Errorf("expected the instruments to be created once, but the meter was requested %d times", mp.meters)
+	}
+}
+
+// contextMeterProvider records the contexts that counters are incremented with
+type contextMeterProvider struct {
+	noop.MeterProvider
+	contexts []context.Context
+}
+
+func (mp *contextMeterProvider) Meter(string, ...metric.MeterOption) metric.Meter {
+	return contextMeter{mp: mp}
+}
+
+type contextMeter struct {
+	noop.Meter
+	mp *contextMeterProvider
+}
+
+func (m contextMeter) Int64Counter(string, ...metric.Int64CounterOption) (metric.Int64Counter, error) {
+	return contextCounter{mp: m.mp}, nil
+}
+
+type contextCounter struct {
+	noop.Int64Counter
+	mp *contextMeterProvider
+}
+
+func (c contextCounter) Add(ctx context.Context, _ int64, _ ...metric.AddOption) {
+	c.mp.contexts = append(c.mp.contexts, ctx)
+}
+
+func TestMetricsUseTheCallContext(t *testing.T) {
+	type key struct{}
+	mp := &contextMeterProvider{}
+	sf := &SimpleFlash{MeterProvider: mp}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "call"))
+	_, tel := sf.startCall(ctx, "QueryGemini", testModelName)
+	tel.cacheLookup(false)
+	cancel()
+	tel.end(nil, context.Canceled)
+	if len(mp.contexts) != 2 {
+		t.Fatalf("expected a cache lookup and an error to be counted, got %d", len(mp.contexts))
+	}
+	for _, metricCtx := range mp.contexts {
+		if metricCtx.Value(key{}) != "call" || metricCtx.Err() != nil {
+			t.Errorf("expected the values of the call context without its cancellation, got %v", metricCtx)
+		}
+	}
+}
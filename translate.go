@@ -0,0 +1,311 @@
+package simpleflash
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/vertexai/genai"
+)
+
+// DefaultTranslateBatchSize is how many texts Translate sends in one request, if TranslateOptions.BatchSize is 0
+const DefaultTranslateBatchSize = 50
+
+// DefaultPlaceholders matches placeholders that must be kept as they are by Translate:
+// printf verbs like %s, %5.2f and %[1]d, and names in braces like {name}, {0} and {{count}}
+var DefaultPlaceholders = regexp.MustCompile(`\{\{[^{}]*\}\}|\{[\w.]*\}|%(?:\[\d+\])?[-+#0]*(?:\d+|\*)?(?:\.(?:\d+|\*))?[a-zA-Z%]`)
+
+// TranslateOptions are the settings of a call to Translate
+type TranslateOptions struct {
+	SourceLang     string            // the language of the texts, detected by the model if empty
+	DoNotTranslate []string          // terms that are kept as they are, like product names
+	Glossary       map[string]string // terms that are always translated to the given text
+	Placeholders   *regexp.Regexp    // placeholders that are kept as they are, DefaultPlaceholders if nil
+	Instructions   string            // optional guidance, like "Use a formal tone"
+	Model          string            // if empty, sf.ModelName is used
+	BatchSize      int               // how many texts are sent in one request, DefaultTranslateBatchSize if 0
+	Concurrency    int               // how many requests are sent at the same time, 4 if 0
+}
+
+// translateItem is a text to be translated, or a translation, as sent to and received from the model
+type translateItem struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// maskedText is a text where the placeholders and glossary terms are replaced by tags like <x id="1"/>
+type maskedText struct {
+	text      string
+	originals []string // what to put back for each tag, the first one is for id 1
+}
+
+// translateTag matches the tags that replace placeholders and glossary terms, also when the model adds spaces
+var translateTag = regexp.MustCompile(`<x\s+id="(\d+)"\s*/>`)
+
+// translatePrompt asks for the translation of a batch of texts
+const translatePrompt = `Translate the text of each item in the JSON array below %sinto %s.
+Reply with a JSON array of items with the same ids, where the text is the translation.
+Tags like <x id="1"/> stand for text that must not be translated. Keep every tag exactly once, where it fits in the translation.
+%s
+Items:
+%s`
+
+// Translate translates the texts to the target language, like "German" or "pt-BR", and returns the
+// translations in the same order. The texts are sent in batches, with ids that do not change between
+// calls, so batches are cached. Placeholders and the terms in the glossary are replaced by tags before
+// the texts are sent, and are put back in the translations. Answers with missing, extra or duplicate
+// ids, or with missing tags, are rejected and asked for again.
+func (sf *SimpleFlash) Translate(ctx context.Context, texts []string, targetLang string, opts TranslateOptions) ([]string, error) {
+	if strings.TrimSpace(targetLang) == "" {
+		return nil, errors.New("no target language given")
+	}
+	if opts.Placeholders == nil {
+		opts.Placeholders = DefaultPlaceholders
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultTranslateBatchSize
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+	protect, err := protectPattern(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Identical texts are translated once, and empty texts are not sent
+	var (
+		unique  []maskedText
+		indexOf = make(map[string]int)
+		items   []translateItem
+	)
+	for _, text := range texts {
+		if _, ok := indexOf[text]; ok || strings.TrimSpace(text) == "" {
+			continue
+		}
+		indexOf[text] = len(unique)
+		masked := maskText(text, protect, opts)
+		items = append(items, translateItem{ID: strconv.Itoa(len(unique) + 1), Text: masked.text})
+		unique = append(unique, masked)
+	}
+
+	translations := make([]string, len(unique))
+	var (
+		wg       sync.WaitGroup
+		mut      sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, opts.Concurrency)
+	)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for start := 0; start < len(items); start += opts.BatchSize {
+		batch := items[start:min(start+opts.BatchSize, len(items))]
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(start int, batch []translateItem) {
+			defer func() { <-sem; wg.Done() }()
+			translated, err := sf.translateBatch(ctx, batch, unique[start:start+len(batch)], targetLang, opts)
+			mut.Lock()
+			defer mut.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed to translate texts %d to %d: %w", start+1, start+len(batch), err)
+					cancel()
+				}
+				return
+			}
+			copy(translations[start:], translated)
+		}(start, batch)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	results := make([]string, len(texts))
+	for i, text := range texts {
+		if index, ok := indexOf[text]; ok {
+			results[i] = translations[index]
+		} else {
+			results[i] = text
+		}
+	}
+	return results, nil
+}
+
+// translateBatch translates a batch of items, and returns the translations with the tags replaced
+func (sf *SimpleFlash) translateBatch(ctx context.Context, batch []translateItem, masked []maskedText, targetLang string, opts TranslateOptions) ([]string, error) {
+	// Keep the tags readable, instead of escaping < and > as \u003c and \u003e
+	var data strings.Builder
+	enc := json.NewEncoder(&data)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(batch); err != nil {
+		return nil, err
+	}
+	var source, instructions string
+	if opts.SourceLang != "" {
+		source = "from " + opts.SourceLang + " "
+	}
+	if opts.Instructions != "" {
+		instructions = strings.TrimSpace(opts.Instructions) + "\n"
+	}
+	req := Request{
+		Prompt:         fmt.Sprintf(translatePrompt, source, targetLang, instructions, strings.TrimSpace(data.String())),
+		Model:          opts.Model,
+		ResponseSchema: translateSchema,
+		Processors: []Processor{func(answer string) (string, error) {
+			_, err := checkTranslations(answer, batch, masked)
+			return answer, err
+		}},
+	}
+	if sf.ValidationRetries == 0 {
+		req.ValidationRetries = structuredRetries
+	}
+	res, err := sf.Generate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return checkTranslations(res.Text, batch, masked)
+}
+
+// translateSchema is the response schema for a batch of translations
+var translateSchema = &genai.Schema{
+	Type: genai.TypeArray,
+	Items: &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"id":   {Type: genai.TypeString},
+			"text": {Type: genai.TypeString},
+		},
+		Required: []string{"id", "text"},
+	},
+}
+
+// checkTranslations decodes the translations of a batch, checks that there is exactly one translation for
+// each item and that every tag is kept, and returns the translations in order, with the tags replaced
+func checkTranslations(answer string, batch []translateItem, masked []maskedText) ([]string, error) {
+	var translated []translateItem
+	if err := json.Unmarshal([]byte(jsonText(answer)), &translated); err != nil {
+		return nil, invalid(answer, `the answer must be a JSON array of items like {"id": "1", "text": "..."}`)
+	}
+	position := make(map[string]int, len(batch))
+	for i, item := range batch {
+		position[item.ID] = i
+	}
+	results := make([]string, len(batch))
+	seen := make([]bool, len(batch))
+	var problems []string
+	for _, item := range translated {
+		i, ok := position[item.ID]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("there is no item with id %q", item.ID))
+			continue
+		case seen[i]:
+			problems = append(problems, fmt.Sprintf("id %q is used more than once", item.ID))
+			continue
+		}
+		seen[i] = true
+		text, err := unmaskText(item.Text, masked[i])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("item %q: %v", item.ID, err))
+			continue
+		}
+		results[i] = text
+	}
+	for i, ok := range seen {
+		if !ok {
+			problems = append(problems, fmt.Sprintf("the item with id %q is missing", batch[i].ID))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, invalid(answer, "%s", strings.Join(problems, "; "))
+	}
+	return results, nil
+}
+
+// protectPattern returns a regular expression that matches the placeholders and the glossary terms.
+// Longer terms are matched first, and terms that start or end with a letter or digit only match whole words.
+func protectPattern(opts TranslateOptions) (*regexp.Regexp, error) {
+	terms := append([]string(nil), opts.DoNotTranslate...)
+	for term := range opts.Glossary {
+		terms = append(terms, term)
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if len(terms[i]) != len(terms[j]) {
+			return len(terms[i]) > len(terms[j])
+		}
+		return terms[i] < terms[j]
+	})
+	alternatives := []string{opts.Placeholders.String()}
+	for _, term := range terms {
+		if strings.TrimSpace(term) == "" {
+			return nil, errors.New("the glossary contains an empty term")
+		}
+		pattern := regexp.QuoteMeta(term)
+		if wordChar(term[0]) {
+			pattern = `\b` + pattern
+		}
+		if wordChar(term[len(term)-1]) {
+			pattern += `\b`
+		}
+		alternatives = append(alternatives, pattern)
+	}
+	// The terms come first, so that a term wins over a placeholder that starts at the same position
+	return regexp.Compile(strings.Join(append(alternatives[1:], alternatives[0]), "|"))
+}
+
+// wordChar returns true if the byte is an ASCII letter, digit or underscore, like \w
+func wordChar(b byte) bool {
+	return b == '_' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+}
+
+// maskText replaces the placeholders and glossary terms in the text with tags. The tags of
+// glossary terms are replaced by the fixed translation when the text is unmasked.
+func maskText(text string, protect *regexp.Regexp, opts TranslateOptions) maskedText {
+	var masked maskedText
+	masked.text = protect.ReplaceAllStringFunc(text, func(match string) string {
+		original := match
+		if translation, ok := opts.Glossary[match]; ok {
+			original = translation
+		}
+		masked.originals = append(masked.originals, original)
+		return fmt.Sprintf(`<x id="%d"/>`, len(masked.originals))
+	})
+	return masked
+}
+
+// unmaskText replaces the tags in a translation with what they stand for, and
+// returns an error if a tag is missing, unknown or used more than once
+func unmaskText(translation string, masked maskedText) (string, error) {
+	count := make([]int, len(masked.originals))
+	var problems []string
+	text := translateTag.ReplaceAllStringFunc(translation, func(tag string) string {
+		id, _ := strconv.Atoi(translateTag.FindStringSubmatch(tag)[1])
+		if id < 1 || id > len(masked.originals) {
+			problems = append(problems, fmt.Sprintf("unknown tag %s", tag))
+			return tag
+		}
+		count[id-1]++
+		return masked.originals[id-1]
+	})
+	for i, n := range count {
+		switch {
+		case n == 0:
+			problems = append(problems, fmt.Sprintf(`the tag <x id="%d"/> is missing`, i+1))
+		case n > 1:
+			problems = append(problems, fmt.Sprintf(`the tag <x id="%d"/> is used %d times`, i+1, n))
+		}
+	}
+	if len(problems) > 0 {
+		return "", errors.New(strings.Join(problems, ", "))
+	}
+	return text, nil
+}
@@ -0,0 +1,59 @@
+package simpleflash
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMaskText(t *testing.T) {
+	opts := TranslateOptions{
+		Placeholders:   DefaultPlaceholders,
+		DoNotTranslate: []string{"SimpleFlash"},
+		Glossary:       map[string]string{"cart": "Warenkorb", "shopping cart": "Einkaufswagen"},
+	}
+	protect, err := protectPattern(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masked := maskText("Hi {name}, SimpleFlash added %d items to your shopping cart ({{count}} in the cart, 100% sure)", protect, opts)
+	expected := `Hi <x id="1"/>, <x id="2"/> added <x id="3"/> items to your <x id="4"/> (<x id="5"/> in the <x id="6"/>, 100% sure)`
+	if masked.text != expected {
+		t.Fatalf("expected %q, got %q", expected, masked.text)
+	}
+	if strings.Join(masked.originals, "|") != "{name}|SimpleFlash|%d|Einkaufswagen|{{count}}|Warenkorb" {
+		t.Errorf("unexpected originals %q", masked.originals)
+	}
+
+	translated := `Hallo <x id="1"/>, <x id="2" /> hat <x id="3"/> Artikel in deinen <x id="4"/> gelegt (<x id="5"/> im <x id="6"/>)`
+	if text, err := unmaskText(translated, masked); err != nil || text != "Hallo {name}, SimpleFlash hat %d Artikel in deinen Einkaufswagen gelegt ({{count}} im Warenkorb)" {
+		t.Errorf("unexpected unmasked text %q (%v)", text, err)
+	}
+	if _, err := unmaskText(`Hallo <x id="1"/> <x id="1"/> <x id="9"/>`, masked); err == nil || !strings.Contains(err.Error(), `<x id="2"/> is missing`) ||
+		!strings.Contains(err.Error(), "used 2 times") || !strings.Contains(err.Error(), "unknown tag") {
+		t.Errorf("expected errors for missing, repeated and unknown tags, got %v", err)
+	}
+
+	// Terms only match whole words
+	if masked := maskText("a cartoon", protect, opts); masked.text != "a cartoon" {
+		t.Errorf("expected no match within a word, got %q", masked.text)
+	}
+}
+
+func TestCheckTranslations(t *testing.T) {
+	batch := []translateItem{{ID: "1", Text: "Yes"}, {ID: "2", Text: "No"}}
+	masked := []maskedText{{text: "Yes"}, {text: "No"}}
+	texts, err := checkTranslations(`[{"id": "2", "text": "Nein"}, {"id": "1", "text": "Ja"}]`, batch, masked)
+	if err != nil || strings.Join(texts, ",") != "Ja,Nein" {
+		t.Errorf("expected the translations in order, got %q (%v)", texts, err)
+	}
+	for answer, problem := range map[string]string{
+		`[{"id": "1", "text": "Ja"}]`: `the item with id "2" is missing`,
+		`[{"id": "1", "text": "Ja"}, {"id": "2", "text": "Nein"}, {"id": "3", "text": "?"}]`:  `no item with id "3"`,
+		`[{"id": "1", "text": "Ja"}, {"id": "1", "text": "Ja"}, {"id": "2", "text": "Nein"}]`: "more than once",
+		`Ja, Nein`: "JSON array",
+	} {
+		if _, err := checkTranslations(answer, batch, masked); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected an error about %q, got %v", problem, err)
+		}
+	}
+}